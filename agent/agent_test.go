@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const serverKeyFile = "../test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc"
+
+// serverKeygrip is the keygrip of the server key as shown by gpg --with-keygrip.
+const serverKeygrip = "2FABDD224FE4B6856EA2FCA68710296E3C5445A4"
+
+func rsaServerKey(t *testing.T) crypto.Signer {
+	file, cleanup := utils.Open(t, serverKeyFile)
+	defer cleanup()
+	signer, err := gpg.NewSoftwareSigner(file, "validation")
+	require.NoError(t, err)
+	return signer
+}
+
+func startStandIn(t *testing.T, keys map[string]crypto.Signer) (socketPath string, stop func()) {
+	dir, err := ioutil.TempDir("", "agent")
+	require.NoError(t, err)
+	socketPath = filepath.Join(dir, "S.gpg-agent")
+
+	standIn, err := NewStandIn(socketPath, keys)
+	require.NoError(t, err)
+	go func() { _ = standIn.Run() }()
+	return socketPath, func() {
+		_ = standIn.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestKeygrip(t *testing.T) {
+	keygrip, err := Keygrip(rsaServerKey(t).Public())
+	require.NoError(t, err)
+	assert.Equal(t, serverKeygrip, keygrip)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = Keygrip(key.Public())
+	assert.Error(t, err)
+}
+
+func TestEscape(t *testing.T) {
+	data := []byte("100%\r\nsure")
+	escaped := escape(data)
+	assert.Equal(t, "100%25%0D%0Asure", escaped)
+
+	unescaped, err := unescape(escaped)
+	require.NoError(t, err)
+	assert.Equal(t, data, unescaped)
+
+	_, err = unescape("100%2")
+	assert.Error(t, err)
+}
+
+func TestParseSexp(t *testing.T) {
+	list, err := parseSexp([]byte("(7:sig-val(3:rsa(1:s3:a)b)))"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("sig-val"), list.atom(0))
+	assert.Equal(t, []byte("a)b"), list.find("rsa").value("s"))
+	assert.Equal(t, "(7:sig-val(3:rsa(1:s3:a)b)))", string(list.encode()))
+
+	for _, malformed := range []string{"", "7:sig-val", "(7:sig-val", "(9:sig-val)", "(sig-val)", "(1:a))"} {
+		_, err = parseSexp([]byte(malformed))
+		assert.Equal(t, errMalformedSexp, err, malformed)
+	}
+}
+
+func TestSignerRSA(t *testing.T) {
+	key := rsaServerKey(t)
+	socketPath, stop := startStandIn(t, map[string]crypto.Signer{serverKeygrip: key})
+	defer stop()
+
+	signer, err := NewSigner(socketPath, "", key.Public())
+	require.NoError(t, err)
+	assert.Equal(t, key.Public(), signer.Public())
+	assert.NoError(t, signer.Check())
+
+	digest := sha256.Sum256([]byte("Hello World!"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err, "Failed to sign via stand-in")
+	assert.NoError(t, rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], signature))
+
+	_, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256})
+	assert.Error(t, err, "RSA-PSS is not supported")
+}
+
+func TestSignerECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	socketPath, stop := startStandIn(t, map[string]crypto.Signer{"0123ABCD": key})
+	defer stop()
+
+	signer, err := NewSigner(socketPath, "0123abcd", key.Public())
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("Hello World!"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err, "Failed to sign via stand-in")
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+}
+
+func TestSignerUnknownKey(t *testing.T) {
+	key := rsaServerKey(t)
+	socketPath, stop := startStandIn(t, map[string]crypto.Signer{})
+	defer stop()
+
+	signer, err := NewSigner(socketPath, "", key.Public())
+	require.NoError(t, err)
+
+	assert.Error(t, signer.Check())
+
+	digest := sha256.Sum256([]byte("Hello World!"))
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if assert.IsType(t, &Error{}, err) {
+		assert.Equal(t, errCodeNoSecretKey, err.(*Error).Code)
+	}
+}
+
+func TestStandInCommands(t *testing.T) {
+	standIn := &StandIn{keys: map[string]crypto.Signer{serverKeygrip: rsaServerKey(t)}}
+	state := &requestState{}
+
+	assert.Equal(t, "OK\n", standIn.handle(state, "HAVEKEY", "0000 "+serverKeygrip))
+	assert.Contains(t, standIn.handle(state, "HAVEKEY", "0000"), "ERR 67108881 ")
+	assert.Contains(t, standIn.handle(state, "PKSIGN", ""), "ERR ", "PKSIGN without key and hash")
+	assert.Contains(t, standIn.handle(state, "SETHASH", "8 00"), "ERR ", "Digest of wrong size")
+	assert.Contains(t, standIn.handle(state, "GETINFO", "version"), "ERR 67109139 ")
+
+	assert.Equal(t, "OK\n", standIn.handle(state, "SIGKEY", serverKeygrip))
+	assert.Equal(t, "OK\n", standIn.handle(state, "RESET", ""))
+	assert.Nil(t, state.key)
+}
+
+func TestDataLines(t *testing.T) {
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = '%'
+	}
+	lines := dataLines(data)
+
+	var unescaped []byte
+	for _, line := range strings.Split(strings.TrimSuffix(lines, "\n"), "\n") {
+		assert.True(t, len(line) < maxLineLength, "Line too long")
+		chunk, err := unescape(line[2:])
+		require.NoError(t, err)
+		unescaped = append(unescaped, chunk...)
+	}
+	assert.Equal(t, data, unescaped)
+}
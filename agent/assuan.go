@@ -0,0 +1,123 @@
+// Package agent lets the server key be held by a gpg-agent instead of the validation server.
+//
+// Signer implements crypto.Signer by sending PKSIGN requests to a gpg-agent using the Assuan protocol, so the server
+// key never leaves the agent (or the smartcard behind it). StandIn speaks the subset of the protocol used by Signer
+// and can be run locally in tests, where no gpg-agent is available.
+//
+// Only RSA and ECDSA server keys can be held by an agent, see gpg.ErrUnsupportedSigner.
+//
+// See https://www.gnupg.org/documentation/manuals/assuan/ for the protocol.
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Error codes of the gpg-agent used by StandIn (GPG_ERR_SOURCE_GPGAGENT combined with the error code).
+const (
+	errCodeNoSecretKey    = 4<<24 | 17
+	errCodeInvalidValue   = 4<<24 | 55
+	errCodeUnknownCommand = 4<<24 | 275
+	errCodeGeneral        = 4<<24 | 1
+)
+
+// maxLineLength is the maximum length of an Assuan line including the line feed.
+const maxLineLength = 1000
+
+// hashAlgorithms maps the libgcrypt algorithm numbers used by SETHASH to hash functions.
+var hashAlgorithms = map[int]crypto.Hash{
+	2:  crypto.SHA1,
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// hashAlgorithmNumber returns the libgcrypt algorithm number of the given hash function.
+func hashAlgorithmNumber(hash crypto.Hash) (int, error) {
+	for number, h := range hashAlgorithms {
+		if h == hash {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("agent: Unsupported hash function %v", hash)
+}
+
+// Error is an error reported by the agent in an ERR line.
+type Error struct {
+	Code        int
+	Description string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("agent: %s (%d)", err.Description, err.Code)
+}
+
+// parseError parses the arguments of an ERR line.
+func parseError(args string) *Error {
+	code, description := splitCommand(args)
+	number, _ := strconv.Atoi(code)
+	return &Error{Code: number, Description: description}
+}
+
+// escape percent-escapes the characters, which must not appear in an Assuan line.
+func escape(data []byte) string {
+	var buf bytes.Buffer
+	for _, b := range data {
+		if b == '%' || b == '\r' || b == '\n' {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// unescape reverses escape.
+func unescape(line string) ([]byte, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(line); i++ {
+		if line[i] != '%' {
+			buf.WriteByte(line[i])
+			continue
+		}
+		if i+2 >= len(line) {
+			return nil, errors.New("agent: Truncated escape sequence")
+		}
+		b, err := hex.DecodeString(line[i+1 : i+3])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		i += 2
+	}
+	return buf.Bytes(), nil
+}
+
+// splitCommand splits an Assuan line into the command and its arguments.
+func splitCommand(line string) (command, args string) {
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' {
+			return line[:i], line[i+1:]
+		}
+	}
+	return line, ""
+}
+
+// readLine reads a single Assuan line without the line feed.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > maxLineLength {
+		return "", errors.New("agent: Line too long")
+	}
+	return line[:len(line)-1], nil
+}
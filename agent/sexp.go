@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// errMalformedSexp is returned when an S-expression cannot be parsed.
+var errMalformedSexp = errors.New("agent: Malformed S-expression")
+
+// sexp is a canonical S-expression. Atoms are of type []byte, lists of type sexp.
+type sexp []interface{}
+
+// parseSexp parses a canonical S-expression, e.g. "(7:sig-val(3:rsa(1:s3:...)))".
+func parseSexp(data []byte) (sexp, error) {
+	list, rest, err := parseList(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errMalformedSexp
+	}
+	return list, nil
+}
+
+func parseList(data []byte) (sexp, []byte, error) {
+	if len(data) == 0 || data[0] != '(' {
+		return nil, nil, errMalformedSexp
+	}
+	data = data[1:]
+
+	list := sexp{}
+	for {
+		if len(data) == 0 {
+			return nil, nil, errMalformedSexp
+		}
+		switch {
+		case data[0] == ')':
+			return list, data[1:], nil
+		case data[0] == '(':
+			element, rest, err := parseList(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			list, data = append(list, element), rest
+		default:
+			colon := bytes.IndexByte(data, ':')
+			if colon <= 0 {
+				return nil, nil, errMalformedSexp
+			}
+			length, err := strconv.Atoi(string(data[:colon]))
+			if err != nil || length < 0 || length > len(data)-colon-1 {
+				return nil, nil, errMalformedSexp
+			}
+			data = data[colon+1:]
+			list, data = append(list, data[:length]), data[length:]
+		}
+	}
+}
+
+// atom returns the atom at the given position of the list, or nil.
+func (list sexp) atom(i int) []byte {
+	if i >= len(list) {
+		return nil
+	}
+	atom, _ := list[i].([]byte)
+	return atom
+}
+
+// find returns the first sub-list whose first atom is name, or nil.
+func (list sexp) find(name string) sexp {
+	for _, element := range list {
+		if sublist, ok := element.(sexp); ok && string(sublist.atom(0)) == name {
+			return sublist
+		}
+	}
+	return nil
+}
+
+// value returns the atom following name in the sub-list starting with name, e.g. s in "(1:s3:...)".
+func (list sexp) value(name string) []byte {
+	return list.find(name).atom(1)
+}
+
+// encode returns the canonical encoding of the list.
+func (list sexp) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+	for _, element := range list {
+		switch element := element.(type) {
+		case []byte:
+			fmt.Fprintf(&buf, "%d:", len(element))
+			buf.Write(element)
+		case sexp:
+			buf.Write(element.encode())
+		}
+	}
+	buf.WriteByte(')')
+	return buf.Bytes()
+}
+
+// ecdsaSignature is the ASN.1 structure of ECDSA signatures returned by crypto.Signer.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// encodeSignature converts a signature returned by a crypto.Signer with the given public key into a sig-val
+// S-expression.
+func encodeSignature(public interface{}, signature []byte) (sexp, error) {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return sexp{[]byte("sig-val"), sexp{[]byte("rsa"), sexp{[]byte("s"), signature}}}, nil
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			return nil, err
+		}
+		return sexp{[]byte("sig-val"), sexp{[]byte("ecdsa"),
+			sexp{[]byte("r"), sig.R.Bytes()}, sexp{[]byte("s"), sig.S.Bytes()}}}, nil
+	}
+	return nil, errors.New("agent: Unsupported key algorithm")
+}
+
+// decodeSignature converts a sig-val S-expression into a signature as returned by a crypto.Signer with the given
+// public key.
+func decodeSignature(public interface{}, sigVal sexp) ([]byte, error) {
+	if string(sigVal.atom(0)) != "sig-val" {
+		return nil, errMalformedSexp
+	}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		s := sigVal.find("rsa").value("s")
+		if s == nil || len(s) > public.Size() {
+			return nil, errMalformedSexp
+		}
+		// The agent strips leading zeros, but crypto.Signer returns signatures of the size of the modulus.
+		return append(make([]byte, public.Size()-len(s)), s...), nil
+	case *ecdsa.PublicKey:
+		ecdsaSigVal := sigVal.find("ecdsa")
+		r, s := ecdsaSigVal.value("r"), ecdsaSigVal.value("s")
+		if r == nil || s == nil {
+			return nil, errMalformedSexp
+		}
+		return asn1.Marshal(ecdsaSignature{R: new(big.Int).SetBytes(r), S: new(big.Int).SetBytes(s)})
+	}
+	return nil, errors.New("agent: Unsupported key algorithm")
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Signer is a crypto.Signer, whose private key is held by a gpg-agent. Each signature is made over a new connection
+// to the agent, so that the agent may be restarted at any time.
+type Signer struct {
+	socketPath string
+	keygrip    string
+	public     crypto.PublicKey
+}
+
+// NewSigner returns a signer using the key with the given keygrip (in hex, see gpg --with-keygrip) held by the agent
+// listening on the given socket. public is the corresponding *rsa.PublicKey or *ecdsa.PublicKey. The keygrip of RSA
+// keys may be omitted.
+func NewSigner(socketPath, keygrip string, public crypto.PublicKey) (*Signer, error) {
+	if keygrip == "" {
+		var err error
+		if keygrip, err = Keygrip(public); err != nil {
+			return nil, err
+		}
+	}
+	return &Signer{socketPath: socketPath, keygrip: strings.ToUpper(keygrip), public: public}, nil
+}
+
+// Keygrip returns the keygrip of an RSA public key as computed by libgcrypt, i.e. the SHA-1 hash of the modulus.
+func Keygrip(public crypto.PublicKey) (string, error) {
+	rsaPublic, ok := public.(*rsa.PublicKey)
+	if !ok {
+		return "", errors.New("agent: The keygrip of non-RSA keys must be given explicitly")
+	}
+	modulus := rsaPublic.N.Bytes()
+	if modulus[0]&0x80 != 0 {
+		modulus = append([]byte{0}, modulus...)
+	}
+	return fmt.Sprintf("%X", sha1.Sum(modulus)), nil
+}
+
+// Public returns the public key of the signer.
+func (signer *Signer) Public() crypto.PublicKey {
+	return signer.public
+}
+
+// Sign lets the agent sign the given digest. RSA signatures use PKCS #1 v1.5 padding, PSS is not supported.
+func (signer *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("agent: RSA-PSS is not supported")
+	}
+	algorithm, err := hashAlgorithmNumber(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := signer.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer session.close()
+
+	if _, err = session.transact("SIGKEY " + signer.keygrip); err != nil {
+		return nil, err
+	}
+	if _, err = session.transact(fmt.Sprintf("SETHASH %d %X", algorithm, digest)); err != nil {
+		return nil, err
+	}
+	data, err := session.transact("PKSIGN")
+	if err != nil {
+		return nil, err
+	}
+
+	sigVal, err := parseSexp(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSignature(signer.public, sigVal)
+}
+
+// Check returns an error, if the agent cannot be reached or does not hold the key of the signer.
+func (signer *Signer) Check() error {
+	session, err := signer.connect()
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	_, err = session.transact("HAVEKEY " + signer.keygrip)
+	return err
+}
+
+// connect opens a new session with the agent.
+func (signer *Signer) connect() (*session, error) {
+	conn, err := net.Dial("unix", signer.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	session := &session{conn: conn, reader: bufio.NewReader(conn)}
+	if _, err = session.response(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// session is the client side of an Assuan connection.
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// close ends the session.
+func (s *session) close() {
+	_, _ = s.transact("BYE")
+	_ = s.conn.Close()
+}
+
+// transact sends a command and returns the data sent by the agent in response.
+func (s *session) transact(command string) ([]byte, error) {
+	if _, err := io.WriteString(s.conn, command+"\n"); err != nil {
+		return nil, err
+	}
+	return s.response()
+}
+
+// response reads lines up to the final OK or ERR and returns the data lines. Inquiries, e.g. for the description
+// shown by pinentry, are answered without data.
+func (s *session) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := readLine(s.reader)
+		if err != nil {
+			return nil, err
+		}
+		command, args := splitCommand(line)
+		switch command {
+		case "OK":
+			return data, nil
+		case "ERR":
+			return nil, parseError(args)
+		case "D":
+			chunk, err := unescape(args)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, chunk...)
+		case "INQUIRE":
+			if _, err = io.WriteString(s.conn, "END\n"); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
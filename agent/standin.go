@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TNG/openpgp-validation-server/internal/socket"
+)
+
+// StandIn is a minimal gpg-agent serving the keys given to it on a Unix domain socket. It implements the commands
+// used by Signer (SIGKEY, SETHASH, PKSIGN) as well as RESET, OPTION, HAVEKEY, NOP and BYE.
+type StandIn struct {
+	listener net.Listener
+	keys     map[string]crypto.Signer
+
+	mutex       sync.Mutex
+	connections map[net.Conn]bool
+}
+
+// NewStandIn creates the Unix domain socket at the given path, which is only accessible by the current user. keys
+// maps keygrips (in hex) to the signers holding the keys.
+func NewStandIn(socketPath string, keys map[string]crypto.Signer) (*StandIn, error) {
+	listener, err := socket.ListenPrivate(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	standIn := &StandIn{listener: listener, keys: map[string]crypto.Signer{}, connections: map[net.Conn]bool{}}
+	for keygrip, key := range keys {
+		standIn.keys[strings.ToUpper(keygrip)] = key
+	}
+	return standIn, nil
+}
+
+// Run serves connections until the stand-in is closed.
+func (standIn *StandIn) Run() error {
+	for {
+		conn, err := standIn.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("agent: Cannot accept connection: %v", err)
+		}
+		go standIn.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections, closes the open connections and removes the socket.
+func (standIn *StandIn) Close() error {
+	err := standIn.listener.Close()
+
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	for conn := range standIn.connections {
+		_ = conn.Close()
+	}
+	return err
+}
+
+func (standIn *StandIn) serveConn(conn net.Conn) {
+	standIn.mutex.Lock()
+	standIn.connections[conn] = true
+	standIn.mutex.Unlock()
+
+	defer func() {
+		_ = conn.Close()
+		standIn.mutex.Lock()
+		delete(standIn.connections, conn)
+		standIn.mutex.Unlock()
+	}()
+
+	state := &requestState{}
+	reader := bufio.NewReader(conn)
+	if _, err := io.WriteString(conn, "OK Pleased to meet you\n"); err != nil {
+		return
+	}
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return
+		}
+		command, args := splitCommand(line)
+		response := standIn.handle(state, strings.ToUpper(command), args)
+		if _, err = io.WriteString(conn, response); err != nil || strings.ToUpper(command) == "BYE" {
+			return
+		}
+	}
+}
+
+// requestState contains the key and digest selected on a connection.
+type requestState struct {
+	key    crypto.Signer
+	hash   crypto.Hash
+	digest []byte
+}
+
+// handle executes a command and returns the complete response.
+func (standIn *StandIn) handle(state *requestState, command, args string) string {
+	switch command {
+	case "NOP", "OPTION", "BYE":
+	case "RESET":
+		*state = requestState{}
+	case "HAVEKEY":
+		for _, keygrip := range strings.Fields(args) {
+			if standIn.keys[strings.ToUpper(keygrip)] != nil {
+				return "OK\n"
+			}
+		}
+		return errorLine(errCodeNoSecretKey, "No secret key")
+	case "SIGKEY", "SETKEY":
+		key := standIn.keys[strings.ToUpper(args)]
+		if key == nil {
+			return errorLine(errCodeNoSecretKey, "No secret key")
+		}
+		state.key = key
+	case "SETHASH":
+		algorithm, digest := splitCommand(args)
+		number, err := strconv.Atoi(algorithm)
+		hash, ok := hashAlgorithms[number]
+		if err != nil || !ok {
+			return errorLine(errCodeInvalidValue, "Unsupported hash algorithm")
+		}
+		data, err := hex.DecodeString(digest)
+		if err != nil || len(data) != hash.Size() {
+			return errorLine(errCodeInvalidValue, "Invalid value")
+		}
+		state.hash, state.digest = hash, data
+	case "PKSIGN":
+		if state.key == nil || state.digest == nil {
+			return errorLine(errCodeInvalidValue, "Missing key or hash")
+		}
+		signature, err := state.key.Sign(rand.Reader, state.digest, state.hash)
+		if err != nil {
+			return errorLine(errCodeGeneral, err.Error())
+		}
+		sigVal, err := encodeSignature(state.key.Public(), signature)
+		if err != nil {
+			return errorLine(errCodeGeneral, err.Error())
+		}
+		return dataLines(sigVal.encode()) + "OK\n"
+	default:
+		return errorLine(errCodeUnknownCommand, "Unknown IPC command")
+	}
+	return "OK\n"
+}
+
+func errorLine(code int, description string) string {
+	return fmt.Sprintf("ERR %d %s <GPG Agent>\n", code, description)
+}
+
+// dataLines returns D lines containing the escaped data, split so that no line exceeds the maximum line length.
+func dataLines(data []byte) string {
+	var lines strings.Builder
+	escaped := escape(data)
+	for len(escaped) > 0 {
+		n := len(escaped)
+		if n > maxLineLength-10 {
+			n = maxLineLength - 10
+			// Do not split escape sequences.
+			if i := strings.LastIndexByte(escaped[n-2:n], '%'); i >= 0 {
+				n -= 2 - i
+			}
+		}
+		lines.WriteString("D " + escaped[:n] + "\n")
+		escaped = escaped[n:]
+	}
+	return lines.String()
+}
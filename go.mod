@@ -0,0 +1,23 @@
+module github.com/TNG/openpgp-validation-server
+
+go 1.22.0
+
+require (
+	github.com/ProtonMail/go-crypto v1.3.0 // gpg/signature_test.go checks that it skips non-exportable certifications
+	github.com/mhale/smtpd v0.8.3
+	github.com/stretchr/testify v1.9.0
+	github.com/urfave/cli v1.22.9
+	golang.org/x/net v0.21.0
+)
+
+require (
+	github.com/cloudflare/circl v1.6.1 // indirect
+	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/russross/blackfriday/v2 v2.1.0 // indirect
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
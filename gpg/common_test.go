@@ -3,8 +3,9 @@ package gpg
 import (
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/crypto/openpgp"
 )
 
 const expectedIdentity = "TEST gpg-validation-server (For Testing Only) <test-gpg-validation@server.local>"
@@ -24,6 +25,29 @@ const asciiKeyFileClientSecret = prefixClient + "sec.asc"
 const prefixOther = "../test/keys/test-gpg-validation@other.local (0xF043F26E) "
 const asciiKeyFileOther = prefixOther + "pub.asc"
 
+const expectedECCIdentity = "TEST-ecc-server gpg-validation-server (For Testing Only) <test-gpg-validation@ecc-server.local>"
+const prefixECC = "../test/keys/test-gpg-validation@ecc-server.local (0x459EB685) "
+const asciiKeyFileECCPublic = prefixECC + "pub.asc"
+const asciiKeyFileECCSecret = prefixECC + "sec.asc"
+
+const expectedECCClientIdentity = "TEST-ecc gpg-validation-server (For Testing Only) <test-gpg-validation@ecc.local>"
+const prefixECCClient = "../test/keys/test-gpg-validation@ecc.local (0x416BD9FB) "
+const asciiKeyFileECCClient = prefixECCClient + "pub.asc"
+const asciiKeyFileECCClientSecret = prefixECCClient + "sec.asc"
+
+const expectedLifetime = uint32(396 * 24 * 3600)
+
+// certifications returns the signatures of an identity, which have not been made by the key itself.
+func certifications(entity *openpgp.Entity, identity string) []*packet.Signature {
+	var result []*packet.Signature
+	for _, sig := range entity.Identities[identity].Signatures {
+		if !sig.CheckKeyIdOrFingerprint(entity.PrimaryKey) {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
 func verifySignatureTest(t *testing.T, signedIdentity string, signedClientEntity *openpgp.Entity) {
 	serverPublicEntity := readEntityFromFile(binaryKeyFilePublic, false)
 
@@ -32,12 +56,16 @@ func verifySignatureTest(t *testing.T, signedIdentity string, signedClientEntity
 		t.Fatal("Signed entity does not have identity:", signedIdentity)
 	}
 
-	for index, signature := range signedClientEntity.Identities[signedIdentity].Signatures {
+	signatures := certifications(signedClientEntity, signedIdentity)
+	assert.NotEmpty(t, signatures, "No certification found")
+	for index, signature := range signatures {
 		err := serverPublicEntity.PrimaryKey.VerifyUserIdSignature(signedIdentity, signedClientEntity.PrimaryKey, signature)
 		if err != nil {
 			t.Error("Signature", index, "not valid:", err)
 		}
 
-		assert.Equal(t, uint32(15768000), *signature.SigLifetimeSecs, "Invalid signature expiry")
+		if assert.NotNil(t, signature.SigLifetimeSecs, "Missing signature expiry") {
+			assert.Equal(t, expectedLifetime, *signature.SigLifetimeSecs, "Invalid signature expiry")
+		}
 	}
 }
@@ -0,0 +1,155 @@
+package gpg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupECCGPG(t *testing.T) *GPG {
+	t.Log("Creating GPG object from", asciiKeyFileECCSecret)
+	file, cleanup := utils.Open(t, asciiKeyFileECCSecret)
+	defer cleanup()
+
+	gpg, err := NewGPG(file, passphrase)
+	require.NoError(t, err, "Failed to create GPG object")
+	return gpg
+}
+
+func TestECCKeys(t *testing.T) {
+	for _, path := range []string{asciiKeyFileECCPublic, asciiKeyFileECCClient} {
+		entity := readEntityFromFile(path, true)
+		assert.Equal(t, packet.PubKeyAlgoEdDSA, entity.PrimaryKey.PubKeyAlgo, "Unexpected primary key algorithm")
+		require.Len(t, entity.Subkeys, 1)
+		assert.Equal(t, packet.PubKeyAlgoECDH, entity.Subkeys[0].PublicKey.PubKeyAlgo, "Unexpected subkey algorithm")
+	}
+
+	report := DefaultKeyPolicy().Check(readEntityFromFile(asciiKeyFileECCClient, true), time.Now())
+	assert.True(t, report.Accepted(expectedECCClientIdentity), "ECC key rejected: %v", report.Problems)
+}
+
+func TestECCServerIdentity(t *testing.T) {
+	gpg := setupECCGPG(t)
+	assert.Equal(t, expectedECCIdentity, gpg.ServerIdentity())
+}
+
+func eccSignUserIDTest(t *testing.T, gpg *GPG, serverPublicKeyPath, clientPublicKeyPath, email, identity string) {
+	clientPublicKey := readEntityFromFile(clientPublicKeyPath, true)
+
+	buffer := new(bytes.Buffer)
+	_, err := gpg.SignUserID(email, clientPublicKey, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	signatures := certifications(signedClientEntity, identity)
+	require.Len(t, signatures, 1)
+
+	serverPublicEntity := readEntityFromFile(serverPublicKeyPath, true)
+	err = serverPublicEntity.PrimaryKey.VerifyUserIdSignature(identity, signedClientEntity.PrimaryKey, signatures[0])
+	assert.NoError(t, err, "Certification not valid")
+	assert.Equal(t, DefaultPolicyURI, signatures[0].PolicyURI)
+}
+
+func TestECCSignUserID(t *testing.T) {
+	eccSignUserIDTest(t, setupECCGPG(t), asciiKeyFileECCPublic, asciiKeyFileECCClient,
+		"test-gpg-validation@ecc.local", expectedECCClientIdentity)
+	eccSignUserIDTest(t, setupECCGPG(t), asciiKeyFileECCPublic, asciiKeyFileClient,
+		"test-gpg-validation@client.local", expectedClientIdentity)
+	eccSignUserIDTest(t, setupGPG(t), asciiKeyFilePublic, asciiKeyFileECCClient,
+		"test-gpg-validation@ecc.local", expectedECCClientIdentity)
+}
+
+func TestECCSignAndCheckMessage(t *testing.T) {
+	gpg := setupECCGPG(t)
+
+	signature := new(bytes.Buffer)
+	require.NoError(t, gpg.SignMessage(bytes.NewReader(testMessageBytes), signature), "Signing message failed")
+	signatureBytes := signature.Bytes()
+
+	checkMessageSignatureTest(t, gpg, testMessageBytes, signatureBytes, asciiKeyFileECCPublic, nil)
+	checkMessageSignatureTest(t, gpg, testMessageBytes, signatureBytes, asciiKeyFileClient, ErrUnknownIssuer)
+}
+
+func TestECCCheckClientMessageSignature(t *testing.T) {
+	gpg := setupGPG(t)
+
+	clientEntity := readEntityFromFile(asciiKeyFileECCClientSecret, true)
+	require.NoError(t, decryptPrivateKeys(clientEntity, []byte(passphrase)))
+	signature := new(bytes.Buffer)
+	require.NoError(t, openpgp.ArmoredDetachSign(signature, clientEntity, bytes.NewReader(testMessageBytes), nil))
+
+	checkMessageSignatureTest(t, gpg, testMessageBytes, signature.Bytes(), asciiKeyFileECCClient, nil)
+	checkMessageSignatureTest(t, gpg, testMessageBytes, signature.Bytes(), asciiKeyFileClient, ErrUnknownIssuer)
+}
+
+func TestECCEncryptMessage(t *testing.T) {
+	gpg := setupECCGPG(t)
+
+	cipherTextBuffer := new(bytes.Buffer)
+	writeCloser, err := gpg.EncryptMessage(cipherTextBuffer, readEntityFromFile(asciiKeyFileECCClient, true))
+	require.NoError(t, err)
+	_, err = writeCloser.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, writeCloser.Close(), "Encryption failed")
+
+	clientEntity := readEntityFromFile(asciiKeyFileECCClientSecret, true)
+	require.NoError(t, decryptPrivateKeys(clientEntity, []byte(passphrase)))
+	keyRing := openpgp.EntityList([]*openpgp.Entity{clientEntity, readEntityFromFile(asciiKeyFileECCPublic, true)})
+
+	block, err := armor.Decode(cipherTextBuffer)
+	require.NoError(t, err)
+	md, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	require.NoError(t, err, "Decryption failed")
+	assert.True(t, md.IsEncrypted, "Encrypted message has not actually been encrypted")
+	assert.True(t, md.IsSigned, "Encrypted message has not been signed")
+
+	decryptedMessageBytes, err := ioutil.ReadAll(md.UnverifiedBody)
+	require.NoError(t, err, "Reading decrypted text failed")
+	assert.Equal(t, string(testMessageBytes), string(decryptedMessageBytes), "Decrypted text does not match")
+	assert.NoError(t, md.SignatureError, "Validating signature failed")
+	assert.Equal(t, gpg.serverEntity.PrimaryKey.KeyId, md.SignedByKeyId, "Message signed by wrong key")
+}
+
+func TestECCDecryptSignedMessage(t *testing.T) {
+	gpg := setupECCGPG(t)
+
+	senderEntity := readEntityFromFile(asciiKeyFileECCClientSecret, true)
+	require.NoError(t, decryptPrivateKeys(senderEntity, []byte(passphrase)))
+	recipientEntity := readEntityFromFile(asciiKeyFileECCPublic, true)
+
+	cipherTextBuffer := new(bytes.Buffer)
+	armorWriter, err := armor.Encode(cipherTextBuffer, "PGP MESSAGE", nil)
+	require.NoError(t, err)
+	w, err := openpgp.Encrypt(armorWriter, []*openpgp.Entity{recipientEntity}, senderEntity, nil, nil)
+	require.NoError(t, err)
+	_, err = w.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, armorWriter.Close())
+	cipherTextBytes := cipherTextBuffer.Bytes()
+
+	decryptedTextBuffer := new(bytes.Buffer)
+	err = gpg.DecryptSignedMessage(bytes.NewReader(cipherTextBytes), decryptedTextBuffer,
+		readEntityFromFile(asciiKeyFileECCClient, true))
+	require.NoError(t, err, "Decryption failed")
+	assert.Equal(t, string(testMessageBytes), decryptedTextBuffer.String(), "Decrypted text does not match")
+
+	plainText, err := gpg.DecryptMessage(bytes.NewReader(cipherTextBytes))
+	require.NoError(t, err, "Decryption failed")
+	decryptedMessageBytes, err := ioutil.ReadAll(plainText)
+	require.NoError(t, err)
+	assert.Equal(t, string(testMessageBytes), string(decryptedMessageBytes), "Decrypted text does not match")
+
+	err = gpg.DecryptSignedMessage(bytes.NewReader(cipherTextBytes), new(bytes.Buffer),
+		readEntityFromFile(asciiKeyFileClient, true))
+	assert.Equal(t, ErrUnknownIssuer, err, "Unexpected error for decrypting message from wrong signer")
+}
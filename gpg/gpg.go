@@ -1,12 +1,23 @@
 package gpg
 
 import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
-	openpgpErrors "golang.org/x/crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	openpgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
 // ErrNoPrivateKey is returned when an entity does not contain needed private keys.
@@ -21,30 +32,136 @@ var ErrMessageNotEncrypted = errors.New("gpg: Message not encrypted")
 // ErrUnknownIdentity is returned when an identity could not be found within the identities of a key.
 var ErrUnknownIdentity = errors.New("gpg: Identity not associated with client key")
 
+// ErrKeyExpired is returned when a key or identity has already expired.
+var ErrKeyExpired = errors.New("gpg: Key or identity expired")
+
+// ErrUnknownServerKey is returned when a server key could not be found within the loaded server keys.
+var ErrUnknownServerKey = errors.New("gpg: No such server key")
+
+// ErrUnknownKey is returned when a key could not be found within a list of keys.
+var ErrUnknownKey = errors.New("gpg: No such key")
+
+// ErrInvalidKeyID is returned when a key is neither given by a key ID of 16 nor by a fingerprint of 40 hex digits.
+var ErrInvalidKeyID = errors.New("gpg: Key must be given by a 16 digit key ID or a 40 digit fingerprint")
+
+// ErrAmbiguousKey is returned when several keys match a key ID.
+var ErrAmbiguousKey = errors.New("gpg: Several keys match the key ID")
+
+// keyIDPattern matches key IDs and fingerprints in upper case hex without spaces.
+var keyIDPattern = regexp.MustCompile("^([0-9A-F]{16}|[0-9A-F]{40})$")
+
+// ErrUnknownSigner is returned when a signature has not been made by any of the given keys.
+var ErrUnknownSigner = errors.New("gpg: Signature not made by any of the given keys")
+
 // ErrUnknownIssuer is returned when the issuer of a signature is not known.
 var ErrUnknownIssuer = openpgpErrors.ErrUnknownIssuer
 
 // GPG contains the data necessary to perform our cryptographical actions, but hides the private key.
 type GPG struct {
+	// serverEntity is the active server key, which is used to certify keys and to sign and encrypt messages.
 	serverEntity *openpgp.Entity
+
+	// serverEntities contains all loaded server keys including serverEntity. They are used to decrypt messages, so
+	// that requests encrypted for a former server key can still be processed after a key rotation.
+	serverEntities openpgp.EntityList
+
+	// Policy describes the certifications made by SignUserID.
+	Policy CertificationPolicy
+
+	// KeyPolicy describes the requirements for client keys checked by CheckKey.
+	KeyPolicy KeyPolicy
+
+	// MinimalExport lets SignUserID export only the signed identity of a key, so that the recipient of the signed
+	// key does not learn the other identities.
+	MinimalExport bool
 }
 
-// NewGPG initializes a GPG object from a buffer containing the server's private key.
+// NewGPG initializes a GPG object from a buffer containing the server's private keys.
+// The first key becomes the active server key, see SetActiveKey.
 func NewGPG(serverPrivateKey io.Reader, passphrase string) (*GPG, error) {
-	var err error
-
-	gpg := new(GPG)
-	gpg.serverEntity, err = readEntityMaybeArmored(serverPrivateKey)
+	gpg := &GPG{Policy: DefaultCertificationPolicy(), KeyPolicy: DefaultKeyPolicy()}
+	err := gpg.AddServerKeys(serverPrivateKey, passphrase)
 	if err != nil {
 		return nil, err
 	}
 
-	err = decryptPrivateKeys(gpg.serverEntity, []byte(passphrase))
+	gpg.serverEntity = gpg.serverEntities[0]
+	return gpg, nil
+}
+
+// AddServerKeys adds further private server keys from the given buffer. The active server key is not changed, the
+// added keys are only used to decrypt messages unless activated by SetActiveKey.
+func (gpg *GPG) AddServerKeys(serverPrivateKey io.Reader, passphrase string) error {
+	entities, err := readEntitiesMaybeArmored(serverPrivateKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return gpg, nil
+	for _, entity := range entities {
+		err = decryptPrivateKeys(entity, []byte(passphrase))
+		if err != nil {
+			return err
+		}
+		if gpg.findServerEntity(entity.PrimaryKey.Fingerprint) == nil {
+			gpg.serverEntities = append(gpg.serverEntities, entity)
+		}
+	}
+	return nil
+}
+
+// SetActiveKey selects the server key with the given fingerprint or key ID (in hex) as the active server key.
+func (gpg *GPG) SetActiveKey(fingerprint string) error {
+	entity, err := findEntity(gpg.serverEntities, fingerprint)
+	if err != nil {
+		return err
+	}
+	if entity == nil {
+		return ErrUnknownServerKey
+	}
+	gpg.serverEntity = entity
+	return nil
+}
+
+// findEntity returns the entity with the given fingerprint (40 hex digits) or key ID (16 hex digits), or nil if there
+// is none. Spaces and a leading "0x" are ignored.
+func findEntity(entities openpgp.EntityList, fingerprint string) (*openpgp.Entity, error) {
+	fingerprint = strings.ToUpper(strings.Replace(strings.TrimPrefix(fingerprint, "0x"), " ", "", -1))
+	if !keyIDPattern.MatchString(fingerprint) {
+		return nil, ErrInvalidKeyID
+	}
+
+	var found *openpgp.Entity
+	for _, entity := range entities {
+		entityFingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+		if entityFingerprint != fingerprint && fmt.Sprintf("%016X", entity.PrimaryKey.KeyId) != fingerprint {
+			continue
+		}
+		if found != nil && !bytes.Equal(found.PrimaryKey.Fingerprint, entity.PrimaryKey.Fingerprint) {
+			return nil, ErrAmbiguousKey
+		}
+		found = entity
+	}
+	return found, nil
+}
+
+// ServerKeyFingerprints returns the fingerprints (in hex) of all loaded server keys, starting with the active one.
+func (gpg *GPG) ServerKeyFingerprints() []string {
+	fingerprints := []string{fmt.Sprintf("%X", gpg.serverEntity.PrimaryKey.Fingerprint)}
+	for _, entity := range gpg.serverEntities {
+		if entity != gpg.serverEntity {
+			fingerprints = append(fingerprints, fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint))
+		}
+	}
+	return fingerprints
+}
+
+func (gpg *GPG) findServerEntity(fingerprint []byte) *openpgp.Entity {
+	for _, entity := range gpg.serverEntities {
+		if bytes.Equal(entity.PrimaryKey.Fingerprint, fingerprint) {
+			return entity
+		}
+	}
+	return nil
 }
 
 // ReadKey reads a PGP public or private key from the given reader.
@@ -52,21 +169,79 @@ func (gpg *GPG) ReadKey(r io.Reader) (Key, error) {
 	return readKey(r)
 }
 
-// SignUserID signs the part in the given public key corresponding to the given email and writes the signed public key to w.
-func (gpg *GPG) SignUserID(signedEMail string, pubkey Key, w io.Writer) error {
-	signedIdentity := ""
+// ReadKeyRing reads all PGP public or private keys from the given reader, which contains either a binary keyring or
+// one or more armored blocks of keys.
+func (gpg *GPG) ReadKeyRing(r io.Reader) ([]Key, error) {
+	return readKeyRing(r)
+}
+
+// FindKey reads the key with the given fingerprint or key ID (in hex) from a list of keys, which is either binary or
+// contained in one or more armored blocks.
+func FindKey(r io.Reader, fingerprint string) (Key, error) {
+	entities, err := readEntitiesMaybeArmored(r)
+	if err != nil {
+		return nil, err
+	}
+	entity, err := findEntity(entities, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if entity == nil {
+		return nil, ErrUnknownKey
+	}
+	return entity, nil
+}
+
+// CheckKey checks whether the given client key complies with the key policy.
+func (gpg *GPG) CheckKey(key Key) KeyReport {
+	return gpg.KeyPolicy.Check(key, time.Now())
+}
+
+// SignUserID certifies all identities of the given public key with the given email and writes the signed public key
+// to w. Identities rejected by the key policy, e.g. revoked ones, are skipped. The names of the certified identities
+// are returned in lexical order.
+func (gpg *GPG) SignUserID(signedEMail string, pubkey Key, w io.Writer) ([]string, error) {
+	report := gpg.CheckKey(pubkey)
+	var signedIdentities []string
 	for _, identity := range pubkey.Identities {
-		if identity.UserId.Email == signedEMail {
-			signedIdentity = identity.Name
-			break
+		if identity.UserId.Email == signedEMail && len(report.IdentityProblems[identity.Name]) == 0 {
+			signedIdentities = append(signedIdentities, identity.Name)
 		}
 	}
+	sort.Strings(signedIdentities)
+
+	if len(signedIdentities) == 0 {
+		return nil, ErrUnknownIdentity
+	}
+
+	err := signClientPublicKey(pubkey, signedIdentities, gpg.serverEntity, gpg.Policy, gpg.MinimalExport, w)
+	if err != nil {
+		return nil, err
+	}
+	return signedIdentities, nil
+}
+
+// CrossSignKey certifies all identities of another server key with the active server key and writes the armored
+// public key to w. During a key rotation, this introduces the new server key to users who trust the old one.
+// The certifications neither expire before the keys do, nor do they reference the certification policy.
+func (gpg *GPG) CrossSignKey(newKey Key, w io.Writer) error {
+	if bytes.Equal(newKey.PrimaryKey.Fingerprint, gpg.serverEntity.PrimaryKey.Fingerprint) {
+		return errors.New("gpg: Cannot cross-sign the active server key with itself")
+	}
 
-	if signedIdentity == "" {
-		return ErrUnknownIdentity
+	names := make([]string, 0, len(newKey.Identities))
+	for name := range newKey.Identities {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	return signClientPublicKey(pubkey, signedIdentity, gpg.serverEntity, w)
+	for _, name := range names {
+		_, err := signIdentity(name, newKey, gpg.serverEntity, CertificationPolicy{}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return exportArmoredPublicKey(newKey, nil, w)
 }
 
 // SignMessage signs message and writes the armored detached signature to w.
@@ -76,12 +251,146 @@ func (gpg *GPG) SignMessage(message io.Reader, w io.Writer) error {
 
 // CheckMessageSignature checks whether an armored detached signature is valid for a given message and has been made by the given signer.
 func (gpg *GPG) CheckMessageSignature(message io.Reader, signature io.Reader, checkedSignerKey Key) error {
+	return CheckMessageSignature(message, signature, checkedSignerKey)
+}
+
+// CheckMessageSignature checks whether an armored detached signature is valid for a given message and has been made by the given signer.
+// It does not need a server key.
+func CheckMessageSignature(message io.Reader, signature io.Reader, checkedSignerKey Key) error {
 	keyRing := openpgp.EntityList([]*openpgp.Entity{checkedSignerKey})
 
-	_, err := openpgp.CheckArmoredDetachedSignature(keyRing, message, signature)
+	_, err := openpgp.CheckArmoredDetachedSignature(keyRing, message, signature, nil)
 	return err
 }
 
+// FindSigner returns the key among keys, whose primary key or subkey is the issuer of the given detached signature.
+func (gpg *GPG) FindSigner(keys []Key, signature io.Reader) (Key, error) {
+	return FindSigner(keys, signature)
+}
+
+// FindSigner returns the key among keys, whose primary key or subkey is the issuer of the given armored or binary
+// detached signature. It does not need a server key.
+func FindSigner(keys []Key, signature io.Reader) (Key, error) {
+	sig, err := readSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if sig.CheckKeyIdOrFingerprint(key.PrimaryKey) {
+			return key, nil
+		}
+		for _, subkey := range key.Subkeys {
+			if sig.CheckKeyIdOrFingerprint(subkey.PublicKey) {
+				return key, nil
+			}
+		}
+	}
+	return nil, ErrUnknownSigner
+}
+
+// SignatureIssuer returns the key ID of the issuer of the given armored or binary detached signature.
+func SignatureIssuer(signature io.Reader) (uint64, error) {
+	sig, err := readSignature(signature)
+	if err != nil {
+		return 0, err
+	}
+	if sig.IssuerKeyId != nil {
+		return *sig.IssuerKeyId, nil
+	}
+	// Version 4 key IDs are the low 64 bits of the fingerprint.
+	if len(sig.IssuerFingerprint) == 20 {
+		return binary.BigEndian.Uint64(sig.IssuerFingerprint[12:]), nil
+	}
+	return 0, ErrUnknownIssuer
+}
+
+// InlineSignatureIssuer returns the key ID of the issuer of the signature of a clear-signed message or of an armored
+// signed message, which is not encrypted.
+func InlineSignatureIssuer(message io.Reader) (uint64, error) {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return 0, err
+	}
+	if block, _ := clearsign.Decode(data); block != nil {
+		return SignatureIssuer(block.ArmoredSignature.Body)
+	}
+
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !md.IsSigned {
+		return 0, ErrMessageNotSigned
+	}
+	return md.SignedByKeyId, nil
+}
+
+// SignatureHash returns the hash algorithm of the given armored or binary detached signature.
+func SignatureHash(signature io.Reader) (crypto.Hash, error) {
+	sig, err := readSignature(signature)
+	if err != nil {
+		return 0, err
+	}
+	return sig.Hash, nil
+}
+
+// VerifyInlineMessage checks the signature of a clear-signed message or of an armored signed message, which is not
+// encrypted, and returns the key among keys that made it together with the signed plain text.
+func (gpg *GPG) VerifyInlineMessage(message io.Reader, keys []Key) (Key, []byte, error) {
+	return VerifyInlineMessage(message, keys)
+}
+
+// VerifyInlineMessage checks the signature of a clear-signed message or of an armored signed message, which is not
+// encrypted, and returns the key among keys that made it together with the signed plain text. It does not need a
+// server key, so encrypted messages cannot be read.
+func VerifyInlineMessage(message io.Reader, keys []Key) (Key, []byte, error) {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyRing := make(openpgp.EntityList, len(keys))
+	for i, key := range keys {
+		keyRing[i] = key
+	}
+
+	if block, _ := clearsign.Decode(data); block != nil {
+		signer, err := block.VerifySignature(keyRing, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return signer, block.Plaintext, nil
+	}
+
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !md.IsSigned {
+		return nil, nil, ErrMessageNotSigned
+	}
+	if md.SignedBy == nil {
+		return nil, nil, ErrUnknownIssuer
+	}
+
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	// SignatureError can only be checked after reading all of UnverifiedBody
+	if md.SignatureError != nil {
+		return nil, nil, md.SignatureError
+	}
+	return md.SignedBy.Entity, plaintext, nil
+}
+
 type encodeEncryptStream struct {
 	encryptStream, armorStream io.WriteCloser
 }
@@ -113,62 +422,150 @@ func (gpg *GPG) EncryptMessage(output io.Writer, recipient Key) (plaintext io.Wr
 
 // DecryptSignedMessage decrypts an encrypted message sent to server, checks the (mandatory) embedded signature made by the given sender and write the plain text to output.
 func (gpg *GPG) DecryptSignedMessage(message io.Reader, output io.Writer, senderPublicKey Key) error {
-	keyRing := openpgp.EntityList([]*openpgp.Entity{gpg.serverEntity, senderPublicKey})
-
-	block, err := armor.Decode(message)
+	packets, err := gpg.DecryptPackets(message)
 	if err != nil {
 		return err
 	}
-	md, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	decrypted, err := ReadDecryptedMessage(packets, []Key{senderPublicKey})
 	if err != nil {
 		return err
 	}
-	if !md.IsEncrypted {
-		return ErrMessageNotEncrypted
-	}
-	if !md.IsSigned {
+	if !decrypted.IsSigned {
 		return ErrMessageNotSigned
 	}
-	if md.SignedByKeyId != senderPublicKey.PrimaryKey.KeyId {
+	if decrypted.SignedBy == nil {
 		return openpgpErrors.ErrUnknownIssuer
 	}
+	_, err = output.Write(decrypted.Body)
+	return err
+}
 
-	_, err = io.Copy(output, md.UnverifiedBody)
+// DecryptMessage decrypts an encrypted message sent to server, but does not check the signature. It writes the plain text to the output
+func (gpg *GPG) DecryptMessage(message io.Reader) (io.Reader, error) {
+	packets, err := gpg.DecryptPackets(message)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	decrypted, err := ReadDecryptedMessage(packets, nil)
+	if err != nil {
+		return nil, err
 	}
+	return bytes.NewReader(decrypted.Body), nil
+}
 
-	// SignatureError can only be checked after reading all of UnverifiedBody
-	if md.SignatureError != nil {
-		// TODO Find a way to test this branch?
-		return md.SignatureError
+// DecryptPackets decrypts an armored message sent to server and returns the OpenPGP message it contains, i.e. the
+// packets of the plain text and of its signature, if any. The message is decrypted once, ReadDecryptedMessage reads
+// the result and checks its signature as soon as the signer key is known.
+func (gpg *GPG) DecryptPackets(message io.Reader) ([]byte, error) {
+	block, err := armor.Decode(message)
+	if err != nil {
+		return nil, err
+	}
+	packets := packet.NewReader(block.Body)
+	var encryptedKeys []*packet.EncryptedKey
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			return nil, err
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			encryptedKeys = append(encryptedKeys, p)
+		case *packet.SymmetricKeyEncrypted:
+			// The server has no passphrase, but the message may be encrypted to its key as well.
+		case *packet.SymmetricallyEncrypted:
+			if !p.IntegrityProtected {
+				return nil, openpgpErrors.UnsupportedError("message is not integrity protected")
+			}
+			return gpg.decryptData(p, encryptedKeys)
+		case *packet.AEADEncrypted:
+			return gpg.decryptData(p, encryptedKeys)
+		default:
+			return nil, ErrMessageNotEncrypted
+		}
 	}
+}
 
-	return nil
+// decryptData decrypts the encrypted data with the session key of the first of encryptedKeys, which one of the
+// server keys can decrypt, and checks its integrity.
+func (gpg *GPG) decryptData(data packet.EncryptedDataPacket, encryptedKeys []*packet.EncryptedKey) ([]byte, error) {
+	for _, encryptedKey := range encryptedKeys {
+		keys := gpg.serverEntities.DecryptionKeys()
+		if encryptedKey.KeyId != 0 {
+			keys = gpg.serverEntities.KeysById(encryptedKey.KeyId)
+		}
+		for _, key := range keys {
+			if key.PrivateKey == nil || key.PrivateKey.Encrypted || encryptedKey.Decrypt(key.PrivateKey, nil) != nil {
+				continue
+			}
+			decrypted, err := data.Decrypt(encryptedKey.CipherFunc, encryptedKey.Key)
+			if err != nil {
+				return nil, err
+			}
+			packets, err := ioutil.ReadAll(decrypted)
+			if err != nil {
+				return nil, err
+			}
+			// The integrity of the data is only checked when closing the reader.
+			if err = decrypted.Close(); err != nil {
+				return nil, err
+			}
+			return packets, nil
+		}
+	}
+	return nil, openpgpErrors.ErrKeyIncorrect
 }
 
-// DecryptMessage decrypts an encrypted message sent to server, but does not check the signature. It writes the plain text to the output
-func (gpg *GPG) DecryptMessage(message io.Reader) (io.Reader, error) {
-	keyRing := openpgp.EntityList([]*openpgp.Entity{gpg.serverEntity})
+// DecryptedMessage is the plain text of a message sent to server together with the details of its signature.
+type DecryptedMessage struct {
+	Body []byte
 
-	block, err := armor.Decode(message)
+	// IsSigned is set if the message carries a signature, whose issuer is given by SignedByKeyID.
+	IsSigned      bool
+	SignedByKeyID uint64
+
+	// SignedBy is the key, which made a valid signature, or nil if the signer key is not known.
+	SignedBy Key
+}
+
+// ReadDecryptedMessage reads the OpenPGP message returned by DecryptPackets and checks its signature, if it has
+// been made by one of keys.
+func (gpg *GPG) ReadDecryptedMessage(packets []byte, keys []Key) (*DecryptedMessage, error) {
+	return ReadDecryptedMessage(packets, keys)
+}
+
+// ReadDecryptedMessage reads the OpenPGP message returned by DecryptPackets and checks its signature, if it has
+// been made by one of keys. It does not need a server key.
+func ReadDecryptedMessage(packets []byte, keys []Key) (*DecryptedMessage, error) {
+	keyRing := make(openpgp.EntityList, len(keys))
+	for i, key := range keys {
+		keyRing[i] = key
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(packets), keyRing, nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	md, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	body, err := ioutil.ReadAll(md.UnverifiedBody)
 	if err != nil {
 		return nil, err
 	}
-	if !md.IsEncrypted {
-		return nil, ErrMessageNotEncrypted
+	decrypted := &DecryptedMessage{Body: body, IsSigned: md.IsSigned, SignedByKeyID: md.SignedByKeyId}
+	if md.SignedBy != nil {
+		// SignatureError can only be checked after reading all of UnverifiedBody
+		if md.SignatureError != nil {
+			return nil, md.SignatureError
+		}
+		decrypted.SignedBy = md.SignedBy.Entity
 	}
-	return md.UnverifiedBody, nil
+	return decrypted, nil
 }
 
-// ServerIdentity returns the full identity string for the server key in use
+// ServerIdentity returns the full identity string for the server key in use. If the key has several identities, the
+// primary identity is returned.
 func (gpg *GPG) ServerIdentity() string {
-	for key := range gpg.serverEntity.Identities {
-		return key
+	identity := primaryIdentity(gpg.serverEntity)
+	if identity == nil {
+		panic("No identity in server key")
 	}
-	panic("No identity in server key")
+	return identity.Name
 }
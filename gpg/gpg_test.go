@@ -2,16 +2,18 @@ package gpg
 
 import (
 	"bytes"
+	"crypto"
 	"io"
 	"io/ioutil"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/errors"
 	"github.com/TNG/openpgp-validation-server/test/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/openpgp/errors"
 )
 
 var testMessageBytes = []byte("Hello World!")
@@ -84,7 +86,7 @@ func TestGPGSignUserIDWithCorrectEmail(t *testing.T) {
 	require.NoError(t, err)
 
 	buffer := new(bytes.Buffer)
-	err = gpg.SignUserID("test-gpg-validation@client.local", clientPublicKey, buffer)
+	_, err = gpg.SignUserID("test-gpg-validation@client.local", clientPublicKey, buffer)
 	require.NoError(t, err, "Failed to sign user id")
 
 	signedClientEntity, _ := readEntity(buffer, true)
@@ -100,7 +102,7 @@ func TestGPGSignUserIDWithIncorrectEmail(t *testing.T) {
 	require.NoError(t, err)
 
 	buffer := new(bytes.Buffer)
-	err = gpg.SignUserID("impostor@faux.fake", clientPublicKey, buffer)
+	_, err = gpg.SignUserID("impostor@faux.fake", clientPublicKey, buffer)
 	if assert.Error(t, err, "Signing user id with fake email succeeded") {
 		assert.Equal(t, ErrUnknownIdentity, err, "Unexpected error for signing user id with fake email", err.Error())
 	}
@@ -111,7 +113,7 @@ func TestGPGSignUserIDWithInvalidKeyFile(t *testing.T) {
 
 	buffer := new(bytes.Buffer)
 
-	assert.Panics(t, func() { _ = gpg.SignUserID("test-gpg-validation@client.local", nil, buffer) })
+	assert.Panics(t, func() { _, _ = gpg.SignUserID("test-gpg-validation@client.local", nil, buffer) })
 }
 
 func TestGPGSignMessage(t *testing.T) {
@@ -128,7 +130,7 @@ func TestGPGSignMessage(t *testing.T) {
 	keyRing, err := openpgp.ReadKeyRing(keyFile)
 	require.NoError(t, err, "Failed to read key ring")
 
-	signer, err := openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(testMessageBytes), signature)
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(testMessageBytes), signature, nil)
 	require.NoError(t, err, "Failed to verify signature")
 	assert.Contains(t, signer.Identities, expectedIdentity, "Signature signed by wrong identity")
 }
@@ -289,6 +291,32 @@ func TestGPGDecryptSignedMessage(t *testing.T) {
 	assert.Equal(t, string(testMessageBytes), decryptedTextBuffer.String(), "Decrypted text does not match")
 }
 
+func TestGPGReadDecryptedMessage(t *testing.T) {
+	gpg := setupGPG(t)
+
+	packets, err := gpg.DecryptPackets(makeEncryptedMessage(t, testMessageBytes, true))
+	require.NoError(t, err, "Decryption failed")
+	decrypted, err := ReadDecryptedMessage(packets, nil)
+	require.NoError(t, err)
+	assert.Equal(t, testMessageBytes, decrypted.Body)
+	assert.True(t, decrypted.IsSigned)
+	assert.Nil(t, decrypted.SignedBy, "Signature cannot be checked without the signer key")
+
+	senderKey := readEntityFromFile(asciiKeyFileClient, true)
+	otherKey := readEntityFromFile(asciiKeyFileOther, true)
+	require.Equal(t, senderKey.PrimaryKey.KeyId, decrypted.SignedByKeyID)
+	decrypted, err = ReadDecryptedMessage(packets, []Key{otherKey, senderKey})
+	require.NoError(t, err)
+	assert.Equal(t, Key(senderKey), decrypted.SignedBy, "Signer must be picked by its key ID")
+
+	packets, err = gpg.DecryptPackets(makeEncryptedMessage(t, testMessageBytes, false))
+	require.NoError(t, err, "Decryption failed")
+	decrypted, err = ReadDecryptedMessage(packets, []Key{senderKey})
+	require.NoError(t, err)
+	assert.False(t, decrypted.IsSigned)
+	assert.Nil(t, decrypted.SignedBy)
+}
+
 func decryptSignedMessageSignatureErrorTest(t *testing.T, signed bool, senderKeyFilePath string) error {
 	gpg := setupGPG(t)
 
@@ -339,3 +367,289 @@ func TestGPGDecryptSignedMessageWithEmptySenderKey(t *testing.T) {
 
 	assert.Panics(t, func() { _ = gpg.DecryptSignedMessage(cipherTextBuffer, decryptedTextBuffer, nil) })
 }
+
+func openServerKeys(t *testing.T, paths ...string) io.Reader {
+	keys := new(bytes.Buffer)
+	for _, path := range paths {
+		file, cleanup := utils.Open(t, path)
+		block, err := armor.Decode(file)
+		require.NoError(t, err)
+		_, err = io.Copy(keys, block.Body)
+		require.NoError(t, err)
+		cleanup()
+	}
+	return keys
+}
+
+func TestNewGPGWithSeveralKeys(t *testing.T) {
+	gpg, err := NewGPG(openServerKeys(t, asciiKeyFileECCSecret, asciiKeyFileSecret), passphrase)
+	require.NoError(t, err, "Failed to create GPG object")
+
+	assert.Len(t, gpg.serverEntities, 2)
+	assert.Equal(t, expectedECCIdentity, gpg.ServerIdentity(), "First key must be active")
+	assert.Equal(t, []string{"AC0AD867AE27DB4DE50D31ECC89B744D459EB685", "D6793B32C8AD971DBA30E44A5AE5111887144E5E"},
+		gpg.ServerKeyFingerprints())
+
+	require.NoError(t, gpg.SetActiveKey("0x5AE5111887144E5E"))
+	assert.Equal(t, expectedIdentity, gpg.ServerIdentity())
+	require.NoError(t, gpg.SetActiveKey("ac0a d867 ae27 db4d e50d  31ec c89b 744d 459e b685"))
+	assert.Equal(t, expectedECCIdentity, gpg.ServerIdentity())
+
+	assert.Equal(t, ErrUnknownServerKey, gpg.SetActiveKey("0x42744CC1E93B112A"))
+	assert.Equal(t, ErrInvalidKeyID, gpg.SetActiveKey("0x87144E5E"), "Short key IDs must not be accepted")
+	assert.Equal(t, ErrInvalidKeyID, gpg.SetActiveKey("0xE"), "Suffixes must not be accepted")
+	assert.Equal(t, ErrInvalidKeyID, gpg.SetActiveKey(""))
+	assert.Equal(t, expectedECCIdentity, gpg.ServerIdentity(), "Active key must not change on errors")
+}
+
+func TestFindEntity(t *testing.T) {
+	first := readEntityFromFile(asciiKeyFileClient, true)
+	second := readEntityFromFile(asciiKeyFileClient, true)
+	second.PrimaryKey.Fingerprint = append([]byte{0}, second.PrimaryKey.Fingerprint[1:]...)
+	entities := openpgp.EntityList{first, second}
+
+	entity, err := findEntity(entities, "794F FD88 96C8 9322 DEE2  4CDB 4274 4CC1 E93B 112A")
+	require.NoError(t, err)
+	assert.Equal(t, first, entity)
+
+	_, err = findEntity(entities, "0x42744CC1E93B112A")
+	assert.Equal(t, ErrAmbiguousKey, err, "Key IDs of several keys must not select any of them")
+	entity, err = findEntity(openpgp.EntityList{first, first}, "0x42744cc1e93b112a")
+	require.NoError(t, err)
+	assert.Equal(t, first, entity)
+}
+
+func TestGPGAddServerKeys(t *testing.T) {
+	gpg := setupECCGPG(t)
+
+	file, cleanup := utils.Open(t, asciiKeyFileSecret)
+	defer cleanup()
+	require.NoError(t, gpg.AddServerKeys(file, passphrase))
+	assert.Equal(t, expectedECCIdentity, gpg.ServerIdentity(), "Added key must not become active")
+
+	file, cleanup = utils.Open(t, binaryKeyFileSecret)
+	defer cleanup()
+	require.NoError(t, gpg.AddServerKeys(file, passphrase))
+	assert.Len(t, gpg.serverEntities, 2, "Keys must only be added once")
+
+	file, cleanup = utils.Open(t, asciiKeyFileClientSecret)
+	defer cleanup()
+	assert.Error(t, gpg.AddServerKeys(file, "invalidpassphrase"))
+
+	// Requests encrypted for the former server key can still be decrypted
+	senderKey := readEntityFromFile(asciiKeyFileClient, true)
+	decryptedTextBuffer := new(bytes.Buffer)
+	err := gpg.DecryptSignedMessage(makeEncryptedMessage(t, testMessageBytes, true), decryptedTextBuffer, senderKey)
+	require.NoError(t, err, "Decryption failed")
+	assert.Equal(t, string(testMessageBytes), decryptedTextBuffer.String(), "Decrypted text does not match")
+
+	plainText, err := gpg.DecryptMessage(makeEncryptedMessage(t, testMessageBytes, false))
+	require.NoError(t, err, "Decryption failed")
+	decryptedMessageBytes, err := ioutil.ReadAll(plainText)
+	require.NoError(t, err)
+	assert.Equal(t, string(testMessageBytes), string(decryptedMessageBytes), "Decrypted text does not match")
+}
+
+func TestGPGCrossSignKey(t *testing.T) {
+	gpg := setupGPG(t)
+
+	buffer := new(bytes.Buffer)
+	require.NoError(t, gpg.CrossSignKey(readEntityFromFile(asciiKeyFileECCSecret, true), buffer))
+
+	newServerEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	assert.Nil(t, newServerEntity.PrivateKey, "Private key must not be exported")
+
+	signatures := certifications(newServerEntity, expectedECCIdentity)
+	require.Len(t, signatures, 1)
+	oldServerEntity := readEntityFromFile(asciiKeyFilePublic, true)
+	err = oldServerEntity.PrimaryKey.VerifyUserIdSignature(expectedECCIdentity, newServerEntity.PrimaryKey, signatures[0])
+	assert.NoError(t, err, "Certification not valid")
+	assert.Nil(t, signatures[0].SigLifetimeSecs, "Cross-certification must not expire")
+	assert.Empty(t, signatures[0].PolicyURI)
+
+	assert.Error(t, gpg.CrossSignKey(readEntityFromFile(asciiKeyFilePublic, true), new(bytes.Buffer)))
+}
+
+func TestGPGSignUserIDMinimalExport(t *testing.T) {
+	gpg := setupGPG(t)
+	gpg.MinimalExport = true
+
+	clientPublicKey := readEntityFromFile("../test/keys/test-gpg-validation@multi.local (0xC1B5BC0A) pub.asc", true)
+	require.Len(t, clientPublicKey.Identities, 2)
+	otherEntity := readEntityFromFile(asciiKeyFileClientSecret, true)
+	require.NoError(t, decryptPrivateKeys(otherEntity, []byte(passphrase)))
+	otherCertification, err := signIdentity(expectedMultiIdentity, clientPublicKey, otherEntity, CertificationPolicy{}, nil)
+	require.NoError(t, err)
+
+	buffer := new(bytes.Buffer)
+	_, err = gpg.SignUserID("test-gpg-validation@multi.local", clientPublicKey, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	assert.Len(t, signedClientEntity.Identities, 1, "Other identities must not be exported")
+	assert.NotContains(t, signedClientEntity.Identities, expectedMultiRevokedIdentity)
+	assert.Len(t, signedClientEntity.Subkeys, len(clientPublicKey.Subkeys))
+
+	signatures := certifications(signedClientEntity, expectedMultiIdentity)
+	if assert.Len(t, signatures, 1, "Third-party certifications must not be exported") {
+		assert.NotEqual(t, otherCertification.IssuerKeyId, signatures[0].IssuerKeyId)
+	}
+	verifySignatureTest(t, expectedMultiIdentity, signedClientEntity)
+}
+
+func TestGPGSignUserIDFullExport(t *testing.T) {
+	gpg := setupGPG(t)
+
+	clientPublicKey := readEntityFromFile("../test/keys/test-gpg-validation@multi.local (0xC1B5BC0A) pub.asc", true)
+	buffer := new(bytes.Buffer)
+	_, err := gpg.SignUserID("test-gpg-validation@multi.local", clientPublicKey, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	assert.Contains(t, signedClientEntity.Identities, expectedMultiRevokedIdentity)
+}
+
+func TestGPGSignUserIDSignsAllIdentitiesWithEmail(t *testing.T) {
+	gpg := setupGPG(t)
+
+	clientEntity := readEntityFromFile(asciiKeyFileClientSecret, true)
+	require.NoError(t, decryptPrivateKeys(clientEntity, []byte(passphrase)))
+	require.NoError(t, clientEntity.AddUserId("TEST-client", "work", "test-gpg-validation@client.local", nil))
+	const workIdentity = "TEST-client (work) <test-gpg-validation@client.local>"
+	keyData, err := MarshalKey(clientEntity)
+	require.NoError(t, err)
+	clientPublicKey, err := UnmarshalKey(keyData)
+	require.NoError(t, err)
+
+	buffer := new(bytes.Buffer)
+	identities, err := gpg.SignUserID("test-gpg-validation@client.local", clientPublicKey, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+	assert.Equal(t, []string{workIdentity, expectedClientIdentity}, identities, "Identities must be sorted by name")
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	verifySignatureTest(t, expectedClientIdentity, signedClientEntity)
+	verifySignatureTest(t, workIdentity, signedClientEntity)
+}
+
+func readFile(t *testing.T, path string) []byte {
+	file, cleanup := utils.Open(t, path)
+	defer cleanup()
+	data, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	return data
+}
+
+func TestReadKeyRing(t *testing.T) {
+	gpg := setupGPG(t)
+
+	block := new(bytes.Buffer)
+	armoredWriter, err := armor.Encode(block, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, readEntityFromFile(asciiKeyFileOther, true).Serialize(armoredWriter))
+	require.NoError(t, readEntityFromFile(asciiKeyFileClient, true).Serialize(armoredWriter))
+	require.NoError(t, armoredWriter.Close())
+
+	keys, err := gpg.ReadKeyRing(bytes.NewReader(block.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, keys, 2, "All keys of an armored block must be read")
+	assert.Equal(t, "F043F26E", keys[0].PrimaryKey.KeyIdShortString())
+	assert.Equal(t, "E93B112A", keys[1].PrimaryKey.KeyIdShortString())
+
+	blocks := append(block.Bytes(), readFile(t, asciiKeyFilePublic)...)
+	keys, err = gpg.ReadKeyRing(bytes.NewReader(blocks))
+	require.NoError(t, err)
+	assert.Len(t, keys, 3, "All armored blocks must be read")
+
+	keys, err = gpg.ReadKeyRing(bytes.NewReader(readFile(t, binaryKeyFilePublic)))
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+}
+
+func TestFindSigner(t *testing.T) {
+	file, cleanup := utils.Open(t, asciiKeyFileClientSecret)
+	defer cleanup()
+	client, err := NewGPG(file, passphrase)
+	require.NoError(t, err)
+	signature := new(bytes.Buffer)
+	require.NoError(t, client.SignMessage(bytes.NewReader(testMessageBytes), signature))
+
+	other := readEntityFromFile(asciiKeyFileOther, true)
+	clientKey := readEntityFromFile(asciiKeyFileClient, true)
+	signer, err := FindSigner([]Key{other, clientKey}, bytes.NewReader(signature.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, clientKey.PrimaryKey.Fingerprint, signer.PrimaryKey.Fingerprint)
+
+	_, err = FindSigner([]Key{other}, bytes.NewReader(signature.Bytes()))
+	assert.Equal(t, ErrUnknownSigner, err)
+
+	_, err = FindSigner([]Key{clientKey}, bytes.NewReader(testMessageBytes))
+	assert.Error(t, err, "Message is not a signature")
+
+	keyID, err := SignatureIssuer(bytes.NewReader(signature.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, clientKey.PrimaryKey.KeyId, keyID)
+
+	hash, err := SignatureHash(bytes.NewReader(signature.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, crypto.SHA256, hash)
+}
+
+func TestVerifyInlineMessage(t *testing.T) {
+	file, cleanup := utils.Open(t, asciiKeyFileClientSecret)
+	defer cleanup()
+	client, err := NewGPG(file, passphrase)
+	require.NoError(t, err)
+	other := readEntityFromFile(asciiKeyFileOther, true)
+	clientKey := readEntityFromFile(asciiKeyFileClient, true)
+
+	clearSigned := new(bytes.Buffer)
+	plaintext, err := clearsign.Encode(clearSigned, client.serverEntity.PrivateKey, nil)
+	require.NoError(t, err)
+	_, err = plaintext.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+
+	signer, text, err := VerifyInlineMessage(bytes.NewReader(clearSigned.Bytes()), []Key{other, clientKey})
+	require.NoError(t, err)
+	assert.Equal(t, clientKey.PrimaryKey.Fingerprint, signer.PrimaryKey.Fingerprint)
+	assert.Equal(t, testMessageBytes, text)
+
+	_, _, err = VerifyInlineMessage(bytes.NewReader(clearSigned.Bytes()), []Key{other})
+	assert.Equal(t, ErrUnknownIssuer, err)
+
+	keyID, err := InlineSignatureIssuer(bytes.NewReader(clearSigned.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, clientKey.PrimaryKey.KeyId, keyID)
+
+	armored := new(bytes.Buffer)
+	armorWriter, err := armor.Encode(armored, "PGP MESSAGE", nil)
+	require.NoError(t, err)
+	plaintext, err = openpgp.Sign(armorWriter, client.serverEntity, nil, nil)
+	require.NoError(t, err)
+	_, err = plaintext.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+	require.NoError(t, armorWriter.Close())
+
+	signer, text, err = VerifyInlineMessage(bytes.NewReader(armored.Bytes()), []Key{clientKey})
+	require.NoError(t, err)
+	assert.Equal(t, clientKey.PrimaryKey.Fingerprint, signer.PrimaryKey.Fingerprint)
+	assert.Equal(t, testMessageBytes, text)
+
+	keyID, err = InlineSignatureIssuer(bytes.NewReader(armored.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, clientKey.PrimaryKey.KeyId, keyID)
+
+	encrypted := new(bytes.Buffer)
+	plaintext, err = client.EncryptMessage(encrypted, readEntityFromFile(asciiKeyFilePublic, true))
+	require.NoError(t, err)
+	_, err = plaintext.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+	_, _, err = VerifyInlineMessage(bytes.NewReader(encrypted.Bytes()), []Key{clientKey})
+	assert.Error(t, err, "Encrypted messages cannot be verified without decryption")
+}
@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"time"
 
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	openpgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
 // Key is a reference to an OpenPGP entity containing some public keys
@@ -21,6 +24,50 @@ func MarshalKey(k *openpgp.Entity) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// MergeKey adds the identities and identity signatures of other, which key lacks, to key. Both must have the same
+// primary key. It keeps the certifications of a stored key, when a newly certified version of it replaces it.
+func MergeKey(key, other Key) {
+	if !bytes.Equal(key.PrimaryKey.Fingerprint, other.PrimaryKey.Fingerprint) {
+		return
+	}
+	for name, otherIdentity := range other.Identities {
+		identity, ok := key.Identities[name]
+		if !ok {
+			key.Identities[name] = otherIdentity
+			continue
+		}
+		identity.Signatures = mergeSignatures(identity.Signatures, otherIdentity.Signatures)
+		identity.Revocations = mergeSignatures(identity.Revocations, otherIdentity.Revocations)
+	}
+}
+
+// mergeSignatures returns signatures with the signatures of other, which are not contained in it, appended.
+func mergeSignatures(signatures, other []*packet.Signature) []*packet.Signature {
+	result := signatures
+	for _, sig := range other {
+		if !containsSignature(signatures, sig) {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
+// containsSignature returns true if signatures contains a signature of the same type, issuer, creation time and hash.
+func containsSignature(signatures []*packet.Signature, sig *packet.Signature) bool {
+	for _, s := range signatures {
+		if s.SigType == sig.SigType && s.HashTag == sig.HashTag && s.CreationTime.Equal(sig.CreationTime) &&
+			s.IssuerKeyId != nil && sig.IssuerKeyId != nil && *s.IssuerKeyId == *sig.IssuerKeyId {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalKeyRing reads all keys from a binary keyring or one or more ascii armored blocks
+func UnmarshalKeyRing(data []byte) ([]Key, error) {
+	return readKeyRing(bytes.NewReader(data))
+}
+
 // UnmarshalKey reads a key from an ascii armor or binary encoding
 func UnmarshalKey(data []byte) (Key, error) {
 	return readKey(bytes.NewReader(data))
@@ -71,6 +118,102 @@ func readEntityMaybeArmored(r io.Reader) (*openpgp.Entity, error) {
 	return entity, nil
 }
 
+// readEntities reads all entities from a reader containing a list of entities.
+func readEntities(r io.Reader, armored bool) (openpgp.EntityList, error) {
+	if armored {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		r = block.Body
+	}
+	pr := packet.NewReader(r)
+
+	var entities openpgp.EntityList
+	for {
+		entity, err := openpgp.ReadEntity(pr)
+		if err == io.EOF && len(entities) > 0 {
+			return entities, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+}
+
+// armorHeader starts each armored block.
+var armorHeader = []byte("-----BEGIN PGP ")
+
+// readEntitiesMaybeArmored reads all entities using readEntities from either a binary keyring or one or more
+// armored blocks.
+func readEntitiesMaybeArmored(r io.Reader) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.Index(data, armorHeader)
+	if start < 0 {
+		return readEntities(bytes.NewReader(data), false)
+	}
+
+	var entities openpgp.EntityList
+	for start >= 0 {
+		data = data[start:]
+		end := bytes.Index(data[len(armorHeader):], armorHeader)
+		block := data
+		if end >= 0 {
+			block = data[:len(armorHeader)+end]
+		}
+		blockEntities, err := readEntities(bytes.NewReader(block), true)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, blockEntities...)
+		data = data[len(block):]
+		start = bytes.Index(data, armorHeader)
+	}
+	return entities, nil
+}
+
+// readKeyRing reads all keys using readEntitiesMaybeArmored.
+func readKeyRing(r io.Reader) ([]Key, error) {
+	entities, err := readEntitiesMaybeArmored(r)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]Key, len(entities))
+	for i, entity := range entities {
+		keys[i] = entity
+	}
+	return keys, nil
+}
+
+// readSignature reads a single armored or binary signature packet.
+func readSignature(r io.Reader) (*packet.Signature, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	r = bytes.NewReader(data)
+	if bytes.Contains(data, armorHeader) {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		r = block.Body
+	}
+	p, err := packet.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return nil, openpgpErrors.StructuralError("signature packet expected")
+	}
+	return sig, nil
+}
+
 // decryptPrivateKeys decrypts the private key and all private subkeys of an entity (in-place).
 func decryptPrivateKeys(entity *openpgp.Entity, passphrase []byte) error {
 	if entity.PrivateKey == nil {
@@ -90,58 +233,199 @@ func decryptPrivateKeys(entity *openpgp.Entity, passphrase []byte) error {
 	return nil
 }
 
-// signClientPublicKey uses the server private key to sign the public key of the client to be validated as the given identity.
-// The value of {signedIdentity} must be a valid key of {clientEntity.Identities}.
+// primaryIdentity returns the identity of an entity that is marked as primary. If several or no identities are
+// marked as primary, the one with the most recent self-signature is returned. Remaining ties are broken by name, so
+// that the result does not depend on the iteration order of the identity map.
+func primaryIdentity(entity *openpgp.Entity) *openpgp.Identity {
+	var result *openpgp.Identity
+	for _, identity := range entity.Identities {
+		if result == nil || isPreferredIdentity(identity, result) {
+			result = identity
+		}
+	}
+	return result
+}
+
+func isPreferredIdentity(identity, other *openpgp.Identity) bool {
+	isPrimary, otherIsPrimary := isPrimaryIdentity(identity), isPrimaryIdentity(other)
+	if isPrimary != otherIsPrimary {
+		return isPrimary
+	}
+	created, otherCreated := selfSignatureCreationTime(identity), selfSignatureCreationTime(other)
+	if !created.Equal(otherCreated) {
+		return created.After(otherCreated)
+	}
+	return identity.Name < other.Name
+}
+
+func isPrimaryIdentity(identity *openpgp.Identity) bool {
+	return identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId
+}
+
+func selfSignatureCreationTime(identity *openpgp.Identity) time.Time {
+	if identity.SelfSignature == nil {
+		return time.Time{}
+	}
+	return identity.SelfSignature.CreationTime
+}
+
+// signClientPublicKey uses the server private key to sign the public key of the client to be validated as the given identities.
+// The values of {signedIdentities} must be valid keys of {clientEntity.Identities}.
 // The private keys of {serverEntity} must have been decrypted before-hand.
-func signClientPublicKey(clientEntity *openpgp.Entity, signedIdentity string, serverEntity *openpgp.Entity, w io.Writer) error {
-	_, ok := clientEntity.Identities[signedIdentity]
-	if !ok {
-		return errors.New(fmt.Sprint("Client does not have identity:", signedIdentity))
+// The certifications are made according to the given policy. If minimal is set, only the signed identities are exported.
+func signClientPublicKey(clientEntity *openpgp.Entity, signedIdentities []string, serverEntity *openpgp.Entity,
+	policy CertificationPolicy, minimal bool, w io.Writer) error {
+	certifications := map[string][]*packet.Signature{}
+	local := map[string][]byte{}
+	for _, signedIdentity := range signedIdentities {
+		_, ok := clientEntity.Identities[signedIdentity]
+		if !ok {
+			return errors.New(fmt.Sprint("Client does not have identity:", signedIdentity))
+		}
+
+		if policy.Local {
+			certification, err := signLocalIdentity(signedIdentity, clientEntity, serverEntity, policy, nil)
+			if err != nil {
+				return err
+			}
+			certifications[signedIdentity] = nil
+			local[signedIdentity] = certification
+			continue
+		}
+		sig, err := signIdentity(signedIdentity, clientEntity, serverEntity, policy, nil)
+		if err != nil {
+			return err
+		}
+		certifications[signedIdentity] = []*packet.Signature{sig}
 	}
 
-	err := signIdentity(signedIdentity, clientEntity, serverEntity, nil)
+	if minimal {
+		clientEntity = minimalKey(clientEntity, certifications, time.Now())
+	}
+	return exportArmoredPublicKey(clientEntity, local, w)
+}
+
+func signIdentity(identity string, e, signer *openpgp.Entity, policy CertificationPolicy,
+	config *packet.Config) (*packet.Signature, error) {
+	sig, ident, err := policy.identityCertification(identity, e, signer, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = exportArmoredPublicKey(clientEntity, w)
-	return err
+	if err = signUserID(sig, identity, e.PrimaryKey, signer.PrivateKey, config); err != nil {
+		return nil, err
+	}
+	ident.Signatures = append(ident.Signatures, sig)
+	return sig, nil
+}
+
+// signLocalIdentity works like signIdentity, but makes a non-exportable certification. It returns the serialized
+// signature packet, which is not added to e, as go-crypto cannot represent it.
+func signLocalIdentity(identity string, e, signer *openpgp.Entity, policy CertificationPolicy,
+	config *packet.Config) ([]byte, error) {
+	sig, _, err := policy.identityCertification(identity, e, signer, config)
+	if err != nil {
+		return nil, err
+	}
+	buffer := new(bytes.Buffer)
+	if err = writeLocalCertification(buffer, sig, identity, e.PrimaryKey, signer.PrivateKey, config); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
 }
 
-func signIdentity(identity string, e, signer *openpgp.Entity, config *packet.Config) error {
+// identityCertification returns the unsigned certification of the given identity of e by signer according to the
+// policy, together with the identity.
+func (policy CertificationPolicy) identityCertification(identity string, e, signer *openpgp.Entity,
+	config *packet.Config) (*packet.Signature, *openpgp.Identity, error) {
 	if signer.PrivateKey == nil {
-		return errors.New("signing Entity must have a private key")
+		return nil, nil, errors.New("signing Entity must have a private key")
 	}
 	if signer.PrivateKey.Encrypted {
-		return errors.New("signing Entity's private key must be decrypted")
+		return nil, nil, errors.New("signing Entity's private key must be decrypted")
 	}
 	ident, ok := e.Identities[identity]
 	if !ok {
-		return errors.New("given identity string not found in Entity")
+		return nil, nil, errors.New("given identity string not found in Entity")
 	}
 
-	lifetime := uint32((3600 * 24 * 365) / 2)
-	sig := &packet.Signature{
-		SigType:         packet.SigTypeGenericCert,
-		PubKeyAlgo:      signer.PrivateKey.PubKeyAlgo,
-		Hash:            config.Hash(),
-		CreationTime:    config.Now(),
-		IssuerKeyId:     &signer.PrivateKey.KeyId,
-		SigLifetimeSecs: &lifetime,
+	now := config.Now()
+	lifetime, err := policy.certificationLifetime(now, e, ident, signer)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := sig.SignUserId(identity, e.PrimaryKey, signer.PrivateKey, config); err != nil {
-		return err
+	sigType, err := policy.certificationType()
+	if err != nil {
+		return nil, nil, err
+	}
+	return policy.certification(sigType, now, lifetime, signer.PrivateKey, config), ident, nil
+}
+
+// revokeIdentity adds a certification revocation made by signer with the given reason to the given identity of e.
+// The revocation does not refer to the certification policy.
+func revokeIdentity(identity string, e, signer *openpgp.Entity, reason packet.ReasonForRevocation, reasonText string,
+	config *packet.Config) (*packet.Signature, error) {
+	if signer.PrivateKey == nil {
+		return nil, errors.New("signing Entity must have a private key")
+	}
+	if signer.PrivateKey.Encrypted {
+		return nil, errors.New("signing Entity's private key must be decrypted")
+	}
+	ident, ok := e.Identities[identity]
+	if !ok {
+		return nil, errors.New("given identity string not found in Entity")
+	}
+
+	sig := CertificationPolicy{}.certification(packet.SigTypeCertificationRevocation, config.Now(), 0,
+		signer.PrivateKey, config)
+	sig.RevocationReason = &reason
+	sig.RevocationReasonText = reasonText
+	if err := signUserID(sig, identity, e.PrimaryKey, signer.PrivateKey, config); err != nil {
+		return nil, err
 	}
 	ident.Signatures = append(ident.Signatures, sig)
-	return nil
+	return sig, nil
+}
+
+// minimalKey returns a copy of entity, which only contains the primary key with its revocations and direct-key
+// self-signatures, the subkeys valid at the given time and the certified identities with their latest self-signatures
+// and the given certifications (or certification revocations). Other identities and third-party signatures are left
+// out, so that they are not disclosed to the owner of the certified identities.
+func minimalKey(entity *openpgp.Entity, certifications map[string][]*packet.Signature, now time.Time) *openpgp.Entity {
+	minimal := &openpgp.Entity{
+		PrimaryKey:  entity.PrimaryKey,
+		Revocations: entity.Revocations,
+		Identities:  map[string]*openpgp.Identity{},
+	}
+	for name, sigs := range certifications {
+		ident := entity.Identities[name]
+		minimalIdentity := &openpgp.Identity{Name: ident.Name, UserId: ident.UserId, SelfSignature: ident.SelfSignature}
+		if ident.SelfSignature != nil {
+			minimalIdentity.Signatures = append(minimalIdentity.Signatures, ident.SelfSignature)
+		}
+		minimalIdentity.Signatures = append(minimalIdentity.Signatures, sigs...)
+		minimal.Identities[name] = minimalIdentity
+	}
+	for _, directSignature := range entity.Signatures {
+		if directSignature.CheckKeyIdOrFingerprint(entity.PrimaryKey) {
+			minimal.Signatures = append(minimal.Signatures, directSignature)
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if !subkey.PublicKey.KeyExpired(subkey.Sig, now) && !subkey.Revoked(now) {
+			minimal.Subkeys = append(minimal.Subkeys, openpgp.Subkey{PublicKey: subkey.PublicKey, Sig: subkey.Sig})
+		}
+	}
+	return minimal
 }
 
-// exportArmoredPublicKey exports the public key of an entity with armor as ASCII.
-func exportArmoredPublicKey(entity *openpgp.Entity, w io.Writer) error {
+// exportArmoredPublicKey exports the public key of an entity with armor as ASCII, including the given serialized local
+// certifications of its identities.
+func exportArmoredPublicKey(entity *openpgp.Entity, local map[string][]byte, w io.Writer) error {
 	armoredWriter, err := armor.Encode(w, openpgp.PublicKeyType, nil)
 	if err != nil {
 		return err
 	}
-	err = entity.Serialize(armoredWriter)
+	err = serializeEntity(entity, local, armoredWriter)
 	if err != nil {
 		return err
 	}
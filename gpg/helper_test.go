@@ -5,9 +5,12 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/crypto/openpgp"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMarshalUnmarshalKey(t *testing.T) {
@@ -123,7 +126,7 @@ func TestSignClientPublicKey(t *testing.T) {
 	oldSigCount := len(clientEntity.Identities[signedIdentity].Signatures)
 
 	buffer := new(bytes.Buffer)
-	err = signClientPublicKey(clientEntity, signedIdentity, serverEntity, buffer)
+	err = signClientPublicKey(clientEntity, []string{signedIdentity}, serverEntity, DefaultCertificationPolicy(), false, buffer)
 	if err != nil {
 		t.Fatal("Signing failed:", err)
 	}
@@ -141,3 +144,26 @@ func TestSignClientPublicKey(t *testing.T) {
 
 	verifySignatureTest(t, signedIdentity, signedClientEntity)
 }
+
+func TestPrimaryIdentity(t *testing.T) {
+	entity := readEntityFromFile(asciiKeyFileClient, true)
+	assert.Equal(t, expectedClientIdentity, primaryIdentity(entity).Name)
+
+	isPrimary := true
+	other := &openpgp.Identity{Name: "Other <other@client.local>", SelfSignature: &packet.Signature{IsPrimaryId: &isPrimary}}
+	entity.Identities[other.Name] = other
+	assert.Equal(t, other.Name, primaryIdentity(entity).Name, "Identity marked as primary must be preferred")
+}
+
+func TestMinimalKeyDropsExpiredSubkeys(t *testing.T) {
+	entity := readEntityFromFile("../test/keys/test-gpg-validation@expired.local (0x61CB8D83) pub.asc", true)
+	identity := primaryIdentity(entity)
+	require.NotEmpty(t, entity.Subkeys)
+
+	certifications := map[string][]*packet.Signature{identity.Name: {identity.SelfSignature}}
+	minimal := minimalKey(entity, certifications, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Len(t, minimal.Subkeys, len(entity.Subkeys), "Subkeys were valid before their expiry")
+
+	minimal = minimalKey(entity, certifications, time.Now())
+	assert.Empty(t, minimal.Subkeys, "Expired subkeys must not be exported")
+}
@@ -0,0 +1,133 @@
+package gpg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Problems reported by KeyPolicy.Check.
+const (
+	ProblemDSA             = "DSA"
+	ProblemRevoked         = "revoked"
+	ProblemExpired         = "expired"
+	ProblemNoEncryptionKey = "no encryption-capable subkey"
+	ProblemRevokedIdentity = "revoked UID"
+	ProblemExpiredIdentity = "expired UID"
+)
+
+// DefaultMinRSABits is the minimum size of RSA and ElGamal client keys accepted by default.
+const DefaultMinRSABits = 2048
+
+// KeyPolicy describes the requirements a client key has to fulfil before its identities are validated.
+type KeyPolicy struct {
+	// MinRSABits is the minimum size of RSA and ElGamal keys.
+	MinRSABits int
+}
+
+// DefaultKeyPolicy returns the key policy used unless configured otherwise.
+func DefaultKeyPolicy() KeyPolicy {
+	return KeyPolicy{
+		MinRSABits: DefaultMinRSABits,
+	}
+}
+
+// KeyReport contains the result of checking a key against a KeyPolicy.
+type KeyReport struct {
+	// Problems lists the reasons why the key as a whole is rejected.
+	Problems []string
+
+	// IdentityProblems lists the reasons why single identities are rejected, indexed by identity name.
+	IdentityProblems map[string][]string
+}
+
+// IdentityVerdict returns all reasons why the given identity is rejected, including those of the whole key.
+// An empty result means that the identity may be validated.
+func (report KeyReport) IdentityVerdict(identity string) []string {
+	problems := append([]string{}, report.Problems...)
+	return append(problems, report.IdentityProblems[identity]...)
+}
+
+// Accepted returns true, if neither the key nor the given identity have any problems.
+func (report KeyReport) Accepted(identity string) bool {
+	return len(report.IdentityVerdict(identity)) == 0
+}
+
+// Check reports per key and per identity, whether the given key complies with the policy at the given time.
+func (policy KeyPolicy) Check(key Key, now time.Time) KeyReport {
+	report := KeyReport{IdentityProblems: map[string][]string{}}
+
+	if problem := policy.checkAlgorithm(key.PrimaryKey); problem != "" {
+		report.Problems = append(report.Problems, problem)
+	}
+	if (*openpgp.Entity)(key).Revoked(now) {
+		report.Problems = append(report.Problems, ProblemRevoked)
+	}
+	if expiry, expires := keyExpiry(key); expires && !expiry.After(now) {
+		report.Problems = append(report.Problems, ProblemExpired)
+	}
+	if !policy.hasEncryptionKey(key, now) {
+		report.Problems = append(report.Problems, ProblemNoEncryptionKey)
+	}
+
+	for name, identity := range key.Identities {
+		var problems []string
+		if isRevokedIdentity(identity) {
+			problems = append(problems, ProblemRevokedIdentity)
+		}
+		if expiry, expires := signatureExpiry(identity.SelfSignature); expires && !expiry.After(now) {
+			problems = append(problems, ProblemExpiredIdentity)
+		}
+		if len(problems) > 0 {
+			report.IdentityProblems[name] = problems
+		}
+	}
+
+	return report
+}
+
+// checkAlgorithm returns a description of the problem with the algorithm or size of the given key, if any.
+func (policy KeyPolicy) checkAlgorithm(pk *packet.PublicKey) string {
+	switch pk.PubKeyAlgo {
+	case packet.PubKeyAlgoDSA:
+		return ProblemDSA
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		if bits, err := pk.BitLength(); err != nil || int(bits) < policy.MinRSABits {
+			return fmt.Sprintf("RSA < %d", policy.MinRSABits)
+		}
+	case packet.PubKeyAlgoElGamal:
+		if bits, err := pk.BitLength(); err != nil || int(bits) < policy.MinRSABits {
+			return fmt.Sprintf("ElGamal < %d", policy.MinRSABits)
+		}
+	}
+	return ""
+}
+
+// hasEncryptionKey returns true, if the key has a valid subkey for encryption, which complies with the policy.
+func (policy KeyPolicy) hasEncryptionKey(key Key, now time.Time) bool {
+	for _, subkey := range key.Subkeys {
+		sig := subkey.Sig
+		if sig.SigType == packet.SigTypeSubkeyBinding &&
+			sig.FlagsValid && (sig.FlagEncryptCommunications || sig.FlagEncryptStorage) &&
+			subkey.PublicKey.PubKeyAlgo.CanEncrypt() &&
+			!subkey.PublicKey.KeyExpired(sig, now) &&
+			!subkey.Revoked(now) &&
+			policy.checkAlgorithm(subkey.PublicKey) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isRevokedIdentity returns true, if the identity has been revoked by the key itself after its latest
+// self-signature. The revocations have already been verified when reading the key.
+func isRevokedIdentity(identity *openpgp.Identity) bool {
+	for _, sig := range identity.Revocations {
+		if identity.SelfSignature == nil || !sig.CreationTime.Before(identity.SelfSignature.CreationTime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package gpg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const expectedMultiIdentity = "TEST-multi gpg-validation-server (For Testing Only) <test-gpg-validation@multi.local>"
+const expectedMultiRevokedIdentity = "TEST-multi-revoked gpg-validation-server (For Testing Only) <test-gpg-validation-revoked@multi.local>"
+
+func checkKeyTest(t *testing.T, path string) KeyReport {
+	t.Log("Checking key", path)
+	return DefaultKeyPolicy().Check(readEntityFromFile(path, true), time.Now())
+}
+
+func TestCheckKeyAccepted(t *testing.T) {
+	report := checkKeyTest(t, asciiKeyFileClient)
+	assert.Empty(t, report.Problems)
+	assert.Empty(t, report.IdentityProblems)
+	assert.True(t, report.Accepted(expectedClientIdentity))
+	assert.Empty(t, report.IdentityVerdict(expectedClientIdentity))
+}
+
+func TestCheckKeyRevoked(t *testing.T) {
+	report := checkKeyTest(t, "../test/keys/test-gpg-validation@server.local (0x87144E5E) pub-rev.asc")
+	assert.Equal(t, []string{ProblemRevoked}, report.Problems)
+	assert.False(t, report.Accepted(expectedIdentity))
+	assert.Equal(t, []string{ProblemRevoked}, report.IdentityVerdict(expectedIdentity))
+}
+
+func TestCheckKeyWeakRSA(t *testing.T) {
+	report := checkKeyTest(t, "../test/keys/test-gpg-validation@weak.local (0x661A15E5) pub.asc")
+	assert.Equal(t, []string{"RSA < 2048", ProblemNoEncryptionKey}, report.Problems)
+
+	report = KeyPolicy{MinRSABits: 1024}.Check(
+		readEntityFromFile("../test/keys/test-gpg-validation@weak.local (0x661A15E5) pub.asc", true), time.Now())
+	assert.Empty(t, report.Problems)
+}
+
+func TestCheckKeyDSA(t *testing.T) {
+	report := checkKeyTest(t, "../test/keys/test-gpg-validation@dsa.local (0xED123F46) pub.asc")
+	assert.Equal(t, []string{ProblemDSA}, report.Problems)
+}
+
+func TestCheckKeyExpired(t *testing.T) {
+	report := checkKeyTest(t, "../test/keys/test-gpg-validation@expired.local (0x61CB8D83) pub.asc")
+	assert.Equal(t, []string{ProblemExpired, ProblemNoEncryptionKey}, report.Problems)
+
+	entity := readEntityFromFile("../test/keys/test-gpg-validation@expired.local (0x61CB8D83) pub.asc", true)
+	report = DefaultKeyPolicy().Check(entity, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Empty(t, report.Problems, "Key was valid before its expiry")
+}
+
+func TestCheckKeyWithoutEncryptionKey(t *testing.T) {
+	report := checkKeyTest(t, "../test/keys/test-gpg-validation@signonly.local (0x9FD96B60) pub.asc")
+	assert.Equal(t, []string{ProblemNoEncryptionKey}, report.Problems)
+}
+
+func TestCheckKeyRevokedIdentity(t *testing.T) {
+	report := checkKeyTest(t, "../test/keys/test-gpg-validation@multi.local (0xC1B5BC0A) pub.asc")
+	assert.Empty(t, report.Problems)
+	assert.True(t, report.Accepted(expectedMultiIdentity))
+	assert.False(t, report.Accepted(expectedMultiRevokedIdentity))
+	assert.Equal(t, []string{ProblemRevokedIdentity}, report.IdentityVerdict(expectedMultiRevokedIdentity))
+}
+
+func TestCheckKeyExpiredIdentity(t *testing.T) {
+	entity := readEntityFromFile(asciiKeyFileClient, true)
+	setSelfSignatureExpiry(entity.Identities[expectedClientIdentity], time.Now().Add(-time.Hour))
+
+	report := DefaultKeyPolicy().Check(entity, time.Now())
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, []string{ProblemExpiredIdentity}, report.IdentityVerdict(expectedClientIdentity))
+}
+
+func TestGPGCheckKey(t *testing.T) {
+	gpg := setupGPG(t)
+	assert.Equal(t, DefaultKeyPolicy(), gpg.KeyPolicy)
+
+	report := gpg.CheckKey(readEntityFromFile(asciiKeyFileClient, true))
+	assert.True(t, report.Accepted(expectedClientIdentity))
+}
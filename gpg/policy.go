@@ -0,0 +1,156 @@
+package gpg
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// DefaultCertificationLifetime is the lifetime of certifications promised by POLICY-enc-email-click-draft.md.
+const DefaultCertificationLifetime = 396 * 24 * time.Hour
+
+// DefaultPolicyURI points to the published policy under which the server issues certifications.
+const DefaultPolicyURI = "https://github.com/TNG/openpgp-validation-server/blob/master/POLICY-enc-email-click-draft.md"
+
+// ErrInvalidCertificationType is returned when a certification type is not one of the user ID certification types.
+var ErrInvalidCertificationType = errors.New("gpg: Certification type must be generic, persona, casual or positive")
+
+// certificationTypes maps the names of the certification types to the signature types (RFC 4880, section 5.2.1).
+var certificationTypes = map[string]packet.SignatureType{
+	"generic":  packet.SigTypeGenericCert,
+	"persona":  packet.SigTypePersonaCert,
+	"casual":   packet.SigTypeCasualCert,
+	"positive": packet.SigTypePositiveCert,
+}
+
+// ParseCertificationType returns the signature type with the given name, i.e. generic (0x10), persona (0x11),
+// casual (0x12) or positive (0x13).
+func ParseCertificationType(name string) (packet.SignatureType, error) {
+	sigType, ok := certificationTypes[strings.ToLower(name)]
+	if !ok {
+		return 0, ErrInvalidCertificationType
+	}
+	return sigType, nil
+}
+
+// ErrInvalidNotation is returned when a notation cannot be parsed.
+var ErrInvalidNotation = errors.New("gpg: Notation must be of the form name@domain=value")
+
+// Notation is a human-readable notation added to certifications (RFC 4880, section 5.2.3.16).
+type Notation struct {
+	Name  string
+	Value string
+}
+
+// ParseNotation parses a notation given as "name@domain=value".
+func ParseNotation(s string) (Notation, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !strings.Contains(parts[0], "@") {
+		return Notation{}, ErrInvalidNotation
+	}
+	return Notation{Name: parts[0], Value: parts[1]}, nil
+}
+
+// CertificationPolicy describes the properties of the certifications issued by the server.
+type CertificationPolicy struct {
+	// Lifetime is the maximum validity period of a certification. A value of zero means, that certifications
+	// only expire together with the signed key or the server key.
+	Lifetime time.Duration
+
+	// PolicyURI is added as policy URI subpacket to certifications, unless it is empty.
+	PolicyURI string
+
+	// Notations are added as notation data subpackets to certifications.
+	Notations []Notation
+
+	// Type is the signature type of certifications, i.e. the level of checking done before certifying. The zero
+	// value means generic certifications (0x10).
+	Type packet.SignatureType
+
+	// Local marks certifications as non-exportable, so that they are not published by the recipients. Other
+	// OpenPGP implementations, including go-crypto, drop them when importing keys, so that they are not added to
+	// the certified key and get lost when it is stored.
+	Local bool
+}
+
+// DefaultCertificationPolicy returns the certification policy described in POLICY-enc-email-click-draft.md.
+func DefaultCertificationPolicy() CertificationPolicy {
+	return CertificationPolicy{
+		Lifetime:  DefaultCertificationLifetime,
+		PolicyURI: DefaultPolicyURI,
+		Type:      packet.SigTypeGenericCert,
+	}
+}
+
+// certificationType returns the signature type of certifications made under the policy.
+func (policy CertificationPolicy) certificationType() (packet.SignatureType, error) {
+	switch policy.Type {
+	case 0:
+		return packet.SigTypeGenericCert, nil
+	case packet.SigTypeGenericCert, packet.SigTypePersonaCert, packet.SigTypeCasualCert, packet.SigTypePositiveCert:
+		return policy.Type, nil
+	}
+	return 0, ErrInvalidCertificationType
+}
+
+// certificationLifetime returns the lifetime in seconds of a certification of the given identity of e made by
+// signer at the given time. The certification will neither outlive the primary keys of e and signer, nor the
+// self-signature of the certified identity. A lifetime of zero means that the certification does not expire.
+func (policy CertificationPolicy) certificationLifetime(now time.Time, e *openpgp.Entity, identity *openpgp.Identity,
+	signer *openpgp.Entity) (uint32, error) {
+	var expiry time.Time
+	if policy.Lifetime > 0 {
+		expiry = now.Add(policy.Lifetime)
+	}
+
+	for _, limit := range []func() (time.Time, bool){
+		func() (time.Time, bool) { return keyExpiry(e) },
+		func() (time.Time, bool) { return signatureExpiry(identity.SelfSignature) },
+		func() (time.Time, bool) { return keyExpiry(signer) },
+	} {
+		limitExpiry, expires := limit()
+		if expires && (expiry.IsZero() || limitExpiry.Before(expiry)) {
+			expiry = limitExpiry
+		}
+	}
+
+	if expiry.IsZero() {
+		return 0, nil
+	}
+
+	lifetime := expiry.Sub(now) / time.Second
+	if lifetime <= 0 {
+		return 0, ErrKeyExpired
+	}
+	if lifetime > math.MaxUint32 {
+		lifetime = math.MaxUint32
+	}
+	return uint32(lifetime), nil
+}
+
+// keyExpiry returns the expiration time of the primary key of an entity as stated by its primary self-signature.
+// The second return value is false, if the key does not expire.
+func keyExpiry(entity *openpgp.Entity) (time.Time, bool) {
+	identity := primaryIdentity(entity)
+	if identity == nil || identity.SelfSignature == nil {
+		return time.Time{}, false
+	}
+	lifetime := identity.SelfSignature.KeyLifetimeSecs
+	if lifetime == nil || *lifetime == 0 {
+		return time.Time{}, false
+	}
+	return entity.PrimaryKey.CreationTime.Add(time.Duration(*lifetime) * time.Second), true
+}
+
+// signatureExpiry returns the expiration time of a signature. The second return value is false, if the signature
+// does not expire.
+func signatureExpiry(sig *packet.Signature) (time.Time, bool) {
+	if sig == nil || sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+		return time.Time{}, false
+	}
+	return sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second), true
+}
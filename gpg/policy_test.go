@@ -0,0 +1,312 @@
+package gpg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setKeyExpiry lets the primary key of entity expire at the given time by modifying its self-signatures in-place.
+func setKeyExpiry(entity *openpgp.Entity, expiry time.Time) {
+	lifetime := uint32(expiry.Sub(entity.PrimaryKey.CreationTime) / time.Second)
+	for _, identity := range entity.Identities {
+		identity.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+}
+
+// setSelfSignatureExpiry lets the self-signature of the given identity expire at the given time.
+func setSelfSignatureExpiry(identity *openpgp.Identity, expiry time.Time) {
+	lifetime := uint32(expiry.Sub(identity.SelfSignature.CreationTime) / time.Second)
+	identity.SelfSignature.SigLifetimeSecs = &lifetime
+}
+
+func certificationLifetimeTest(t *testing.T, policy CertificationPolicy, modify func(client, server *openpgp.Entity)) (uint32, error) {
+	now := time.Now()
+	serverEntity := readEntityFromFile(asciiKeyFilePublic, true)
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+	if modify != nil {
+		modify(clientEntity, serverEntity)
+	}
+	return policy.certificationLifetime(now, clientEntity, clientEntity.Identities[expectedClientIdentity], serverEntity)
+}
+
+func TestCertificationLifetimeWithoutKeyExpiry(t *testing.T) {
+	lifetime, err := certificationLifetimeTest(t, DefaultCertificationPolicy(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, expectedLifetime, lifetime)
+
+	lifetime, err = certificationLifetimeTest(t, CertificationPolicy{Lifetime: 0}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), lifetime, "Certification should not expire")
+}
+
+func TestCertificationLifetimeCappedByClientKeyExpiry(t *testing.T) {
+	lifetime, err := certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setKeyExpiry(client, time.Now().Add(30*24*time.Hour))
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 30*24*3600, lifetime, 5)
+
+	lifetime, err = certificationLifetimeTest(t, CertificationPolicy{Lifetime: 0}, func(client, server *openpgp.Entity) {
+		setKeyExpiry(client, time.Now().Add(30*24*time.Hour))
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 30*24*3600, lifetime, 5)
+}
+
+func TestCertificationLifetimeNotCappedByLaterKeyExpiry(t *testing.T) {
+	lifetime, err := certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setKeyExpiry(client, time.Now().Add(1000*24*time.Hour))
+		setKeyExpiry(server, time.Now().Add(1000*24*time.Hour))
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expectedLifetime, lifetime)
+}
+
+func TestCertificationLifetimeCappedBySelfSignatureExpiry(t *testing.T) {
+	lifetime, err := certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setKeyExpiry(client, time.Now().Add(30*24*time.Hour))
+		setSelfSignatureExpiry(client.Identities[expectedClientIdentity], time.Now().Add(10*24*time.Hour))
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 10*24*3600, lifetime, 5)
+}
+
+func TestCertificationLifetimeCappedByServerKeyExpiry(t *testing.T) {
+	lifetime, err := certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setKeyExpiry(client, time.Now().Add(30*24*time.Hour))
+		setKeyExpiry(server, time.Now().Add(20*24*time.Hour))
+	})
+	require.NoError(t, err)
+	assert.InDelta(t, 20*24*3600, lifetime, 5)
+}
+
+func TestCertificationLifetimeOfExpiredKeys(t *testing.T) {
+	_, err := certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setKeyExpiry(client, time.Now().Add(-time.Hour))
+	})
+	assert.Equal(t, ErrKeyExpired, err)
+
+	_, err = certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setSelfSignatureExpiry(client.Identities[expectedClientIdentity], time.Now().Add(-time.Hour))
+	})
+	assert.Equal(t, ErrKeyExpired, err)
+
+	_, err = certificationLifetimeTest(t, DefaultCertificationPolicy(), func(client, server *openpgp.Entity) {
+		setKeyExpiry(server, time.Now().Add(-time.Hour))
+	})
+	assert.Equal(t, ErrKeyExpired, err)
+}
+
+func TestGPGSignUserIDWithExpiringKey(t *testing.T) {
+	gpg := setupGPG(t)
+
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+	keyExpiry := time.Now().Add(30 * 24 * time.Hour)
+	setKeyExpiry(clientEntity, keyExpiry)
+
+	buffer := new(bytes.Buffer)
+	_, err := gpg.SignUserID("test-gpg-validation@client.local", clientEntity, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	signatures := certifications(signedClientEntity, expectedClientIdentity)
+	require.Len(t, signatures, 1)
+
+	expiry, expires := signatureExpiry(signatures[0])
+	assert.True(t, expires, "Certification must expire")
+	assert.WithinDuration(t, keyExpiry, expiry, 5*time.Second, "Certification must not outlive the signed key")
+}
+
+func TestGPGSignUserIDWithExpiredKey(t *testing.T) {
+	gpg := setupGPG(t)
+
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+	setKeyExpiry(clientEntity, time.Now().Add(-time.Hour))
+
+	_, err := gpg.SignUserID("test-gpg-validation@client.local", clientEntity, new(bytes.Buffer))
+	assert.Equal(t, ErrKeyExpired, err)
+}
+
+func TestSignatureExpiry(t *testing.T) {
+	_, expires := signatureExpiry(&packet.Signature{})
+	assert.False(t, expires)
+
+	creationTime := time.Unix(1461328122, 0)
+	lifetime := uint32(3600)
+	expiry, expires := signatureExpiry(&packet.Signature{CreationTime: creationTime, SigLifetimeSecs: &lifetime})
+	assert.True(t, expires)
+	assert.Equal(t, creationTime.Add(time.Hour), expiry)
+}
+
+func TestParseCertificationType(t *testing.T) {
+	sigType, err := ParseCertificationType("casual")
+	require.NoError(t, err)
+	assert.Equal(t, packet.SigTypeCasualCert, sigType)
+
+	sigType, err = ParseCertificationType("Generic")
+	require.NoError(t, err)
+	assert.Equal(t, packet.SigTypeGenericCert, sigType)
+
+	_, err = ParseCertificationType("binary")
+	assert.Equal(t, ErrInvalidCertificationType, err)
+}
+
+func TestGPGSignUserIDCertificationTypes(t *testing.T) {
+	serverPublicEntity := readEntityFromFile(asciiKeyFilePublic, true)
+	for _, sigType := range []packet.SignatureType{packet.SigTypeGenericCert, packet.SigTypeCasualCert} {
+		gpg := setupGPG(t)
+		gpg.Policy.Type = sigType
+
+		buffer := new(bytes.Buffer)
+		_, err := gpg.SignUserID("test-gpg-validation@client.local", readEntityFromFile(asciiKeyFileClient, true), buffer)
+		require.NoError(t, err, "Failed to sign user id")
+
+		signedClientEntity, err := readEntity(buffer, true)
+		require.NoError(t, err)
+		signatures := certifications(signedClientEntity, expectedClientIdentity)
+		require.Len(t, signatures, 1)
+		assert.Equal(t, sigType, signatures[0].SigType)
+		assert.NoError(t, serverPublicEntity.PrimaryKey.VerifyUserIdSignature(expectedClientIdentity,
+			signedClientEntity.PrimaryKey, signatures[0]))
+	}
+}
+
+func TestGPGSignUserIDInvalidCertificationType(t *testing.T) {
+	gpg := setupGPG(t)
+	gpg.Policy.Type = packet.SigTypeText
+
+	_, err := gpg.SignUserID("test-gpg-validation@client.local", readEntityFromFile(asciiKeyFileClient, true),
+		new(bytes.Buffer))
+	assert.Equal(t, ErrInvalidCertificationType, err)
+}
+
+// rawSignature is a version 4 signature packet parsed without go-crypto, which rejects non-exportable
+// certifications.
+type rawSignature struct {
+	sigType          packet.SignatureType
+	hashedFields     []byte
+	hashedSubpackets map[byte][]byte
+	value            []byte   // The first MPI of the signature.
+	values           [][]byte // All MPIs of the signature.
+}
+
+// parseRawSignature parses the contents of a version 4 signature packet with MPI values (RFC 4880, section 5.2.3).
+func parseRawSignature(t *testing.T, contents []byte) rawSignature {
+	require.Equal(t, byte(4), contents[0], "Signature must be a version 4 signature")
+	hashedLength := int(binary.BigEndian.Uint16(contents[4:6]))
+	sig := rawSignature{
+		sigType:          packet.SignatureType(contents[1]),
+		hashedFields:     contents[:6+hashedLength],
+		hashedSubpackets: map[byte][]byte{},
+	}
+
+	subpackets := contents[6 : 6+hashedLength]
+	for len(subpackets) > 0 {
+		length, offset := int(subpackets[0]), 1
+		switch {
+		case subpackets[0] >= 255:
+			length, offset = int(binary.BigEndian.Uint32(subpackets[1:5])), 5
+		case subpackets[0] >= 192:
+			length, offset = (int(subpackets[0])-192)<<8+int(subpackets[1])+192, 2
+		}
+		sig.hashedSubpackets[subpackets[offset]&0x7f] = subpackets[offset+1 : offset+length]
+		subpackets = subpackets[offset+length:]
+	}
+
+	rest := contents[6+hashedLength:]
+	unhashedLength := int(binary.BigEndian.Uint16(rest[:2]))
+	rest = rest[2+unhashedLength+2:] // Skip the unhashed subpackets and the hash tag.
+	for len(rest) > 0 {
+		length := (int(binary.BigEndian.Uint16(rest[:2])) + 7) / 8
+		sig.values = append(sig.values, rest[2:2+length])
+		rest = rest[2+length:]
+	}
+	sig.value = sig.values[0]
+	return sig
+}
+
+// certificationDigest returns the digest of the certification sig of the identity id of pub (RFC 4880, section 5.2.4).
+func certificationDigest(t *testing.T, hashFunction crypto.Hash, pub *packet.PublicKey, id string,
+	sig rawSignature) []byte {
+	hash := hashFunction.New()
+	require.NoError(t, pub.SerializeForHash(hash))
+	identityHeader := []byte{0xb4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(identityHeader[1:], uint32(len(id)))
+	hash.Write(identityHeader)
+	hash.Write([]byte(id))
+	hash.Write(sig.hashedFields)
+	trailer := []byte{4, 0xff, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(sig.hashedFields)))
+	hash.Write(trailer)
+	return hash.Sum(nil)
+}
+
+// identitySignatures returns the raw signature packets following the user ID packet of the given identity.
+func identitySignatures(t *testing.T, armored []byte, identity string) []rawSignature {
+	block, err := armor.Decode(bytes.NewReader(armored))
+	require.NoError(t, err)
+
+	var signatures []rawSignature
+	inIdentity := false
+	reader := packet.NewOpaqueReader(block.Body)
+	for {
+		opaque, err := reader.Next()
+		if err != nil {
+			break
+		}
+		switch opaque.Tag {
+		case 13: // User ID packet
+			inIdentity = string(opaque.Contents) == identity
+		case 2: // Signature packet
+			if inIdentity {
+				signatures = append(signatures, parseRawSignature(t, opaque.Contents))
+			}
+		default:
+			inIdentity = false
+		}
+	}
+	return signatures
+}
+
+func TestGPGSignUserIDLocalCertification(t *testing.T) {
+	gpg := setupGPG(t)
+	gpg.Policy.Type = packet.SigTypeCasualCert
+	gpg.Policy.Local = true
+
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+	buffer := new(bytes.Buffer)
+	_, err := gpg.SignUserID("test-gpg-validation@client.local", clientEntity, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+
+	var local []rawSignature
+	for _, sig := range identitySignatures(t, buffer.Bytes(), expectedClientIdentity) {
+		if _, ok := sig.hashedSubpackets[exportableCertSubpacket]; ok {
+			local = append(local, sig)
+		}
+	}
+	require.Len(t, local, 1, "Expected exactly one non-exportable certification")
+	sig := local[0]
+	assert.Equal(t, packet.SigTypeCasualCert, sig.sigType)
+	assert.Equal(t, []byte{0}, sig.hashedSubpackets[exportableCertSubpacket])
+	assert.Equal(t, []byte(DefaultPolicyURI), sig.hashedSubpackets[26])
+
+	serverPublicKey := readEntityFromFile(asciiKeyFilePublic, true).PrimaryKey.PublicKey.(*rsa.PublicKey)
+	digest := certificationDigest(t, crypto.SHA256, clientEntity.PrimaryKey, expectedClientIdentity, sig)
+	assert.NoError(t, rsa.VerifyPKCS1v15(serverPublicKey, crypto.SHA256, digest, sig.value),
+		"Non-exportable certification must be valid")
+
+	signedClientEntity, err := readEntity(bytes.NewReader(buffer.Bytes()), true)
+	require.NoError(t, err, "Keys with non-exportable certifications must remain readable")
+	assert.Empty(t, certifications(signedClientEntity, expectedClientIdentity))
+}
@@ -0,0 +1,110 @@
+package gpg
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// RevocationReason is the reason code of a certification revocation (RFC 4880, section 5.2.3.23).
+type RevocationReason uint8
+
+// Reason codes applicable to certification revocations.
+const (
+	RevocationNoReason      RevocationReason = RevocationReason(packet.NoReason)
+	RevocationUserIDInvalid RevocationReason = RevocationReason(packet.UserIDNotValid)
+)
+
+// ErrInvalidRevocationReason is returned when a reason code does not apply to certification revocations.
+var ErrInvalidRevocationReason = errors.New("gpg: Certifications can only be revoked with reason 0 or 32")
+
+// RevokeCertification revokes the certifications of all identities of the given key with the given email and writes
+// the public key including the revocations to w. Each certification is revoked by the server key, which made it, as a
+// revocation only applies to the certifications of its issuer. The names of the revoked identities are returned in
+// lexical order. ErrUnknownIdentity is returned, if no server key has certified any of the identities.
+func (gpg *GPG) RevokeCertification(email string, key Key, reason RevocationReason, reasonText string,
+	w io.Writer) ([]string, error) {
+	if reason != RevocationNoReason && reason != RevocationUserIDInvalid {
+		return nil, ErrInvalidRevocationReason
+	}
+
+	now := time.Now()
+	revocations := map[string][]*packet.Signature{}
+	var revokedIdentities []string
+	for name, identity := range key.Identities {
+		if identity.UserId.Email != email {
+			continue
+		}
+		for _, serverEntity := range gpg.serverEntities {
+			if !isCertifiedBy(name, identity.Signatures, key, serverEntity, now) {
+				continue
+			}
+			sig, err := revokeIdentity(name, key, serverEntity, packet.ReasonForRevocation(reason), reasonText, nil)
+			if err != nil {
+				return nil, err
+			}
+			revocations[name] = append(revocations[name], sig)
+		}
+		if len(revocations[name]) > 0 {
+			revokedIdentities = append(revokedIdentities, name)
+		}
+	}
+	sort.Strings(revokedIdentities)
+
+	if len(revokedIdentities) == 0 {
+		return nil, ErrUnknownIdentity
+	}
+
+	exported := key
+	if gpg.MinimalExport {
+		exported = minimalKey(key, revocations, now)
+	}
+	if err := exportArmoredPublicKey(exported, nil, w); err != nil {
+		return nil, err
+	}
+	return revokedIdentities, nil
+}
+
+// CertifiedIdentities returns the names of the identities of key carrying a valid certification by one of the loaded
+// server keys, which has neither expired nor been revoked since. The names are returned in lexical order.
+func (gpg *GPG) CertifiedIdentities(key Key) []string {
+	now := time.Now()
+	var names []string
+	for name, identity := range key.Identities {
+		for _, serverEntity := range gpg.serverEntities {
+			if isCertifiedBy(name, identity.Signatures, key, serverEntity, now) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isCertifiedBy returns true, if the latest valid certification or revocation of the given identity made by signer is
+// an unexpired certification.
+func isCertifiedBy(identity string, signatures []*packet.Signature, key Key, signer *openpgp.Entity, now time.Time) bool {
+	var latest *packet.Signature
+	for _, sig := range signatures {
+		if !sig.CheckKeyIdOrFingerprint(signer.PrimaryKey) {
+			continue
+		}
+		// Of signatures made at the same time, the later one in the key wins.
+		if latest != nil && sig.CreationTime.Before(latest.CreationTime) {
+			continue
+		}
+		if signer.PrimaryKey.VerifyUserIdSignature(identity, key.PrimaryKey, sig) == nil {
+			latest = sig
+		}
+	}
+	if latest == nil || latest.SigType == packet.SigTypeCertificationRevocation {
+		return false
+	}
+	expiry, expires := signatureExpiry(latest)
+	return !expires || expiry.After(now)
+}
@@ -0,0 +1,149 @@
+package gpg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// certifiedEntity returns the key read from the given file after certifying its identities with the given email.
+func certifiedEntity(t *testing.T, gpg *GPG, path, email string) *openpgp.Entity {
+	signed := new(bytes.Buffer)
+	_, err := gpg.SignUserID(email, readEntityFromFile(path, true), signed)
+	require.NoError(t, err)
+	entity, err := readEntity(signed, true)
+	require.NoError(t, err)
+	return entity
+}
+
+func TestGPGRevokeCertification(t *testing.T) {
+	gpg := setupGPG(t)
+	clientKey := certifiedEntity(t, gpg, asciiKeyFileClient, "test-gpg-validation@client.local")
+
+	buffer := new(bytes.Buffer)
+	identities, err := gpg.RevokeCertification("test-gpg-validation@client.local", clientKey,
+		RevocationUserIDInvalid, "Left the company", buffer)
+	require.NoError(t, err, "Failed to revoke certification")
+	assert.Equal(t, []string{expectedClientIdentity}, identities)
+
+	revokedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	serverPublicEntity := readEntityFromFile(asciiKeyFilePublic, true)
+
+	signatures := certifications(revokedClientEntity, expectedClientIdentity)
+	require.Len(t, signatures, 2, "Expected the certification and its revocation")
+	revocation := signatures[1]
+	assert.Equal(t, packet.SigTypeCertificationRevocation, revocation.SigType)
+	if assert.NotNil(t, revocation.RevocationReason) {
+		assert.Equal(t, packet.UserIDNotValid, *revocation.RevocationReason)
+	}
+	assert.Equal(t, "Left the company", revocation.RevocationReasonText)
+	assert.Empty(t, revocation.PolicyURI)
+	assert.Nil(t, revocation.SigLifetimeSecs, "Revocations must not expire")
+	assert.NoError(t, serverPublicEntity.PrimaryKey.VerifyUserIdSignature(expectedClientIdentity,
+		revokedClientEntity.PrimaryKey, revocation))
+}
+
+func TestGPGRevokeCertificationMinimalExport(t *testing.T) {
+	gpg := setupGPG(t)
+	gpg.MinimalExport = true
+
+	buffer := new(bytes.Buffer)
+	identities, err := gpg.RevokeCertification("test-gpg-validation@multi.local",
+		certifiedEntity(t, gpg, "../test/keys/test-gpg-validation@multi.local (0xC1B5BC0A) pub.asc",
+			"test-gpg-validation@multi.local"),
+		RevocationNoReason, "", buffer)
+	require.NoError(t, err, "Failed to revoke certification")
+	assert.Equal(t, []string{expectedMultiIdentity}, identities)
+
+	revokedEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	assert.Len(t, revokedEntity.Identities, 1, "Other identities must not be exported")
+	assert.Len(t, certifications(revokedEntity, expectedMultiIdentity), 1)
+}
+
+func TestGPGRevokeCertificationErrorCases(t *testing.T) {
+	gpg := setupGPG(t)
+	clientKey := readEntityFromFile(asciiKeyFileClient, true)
+
+	_, err := gpg.RevokeCertification("impostor@faux.fake", clientKey, RevocationNoReason, "", new(bytes.Buffer))
+	assert.Equal(t, ErrUnknownIdentity, err)
+
+	_, err = gpg.RevokeCertification("test-gpg-validation@client.local", clientKey, RevocationNoReason, "",
+		new(bytes.Buffer))
+	assert.Equal(t, ErrUnknownIdentity, err, "Identities not certified by the server cannot be revoked")
+	assert.Empty(t, certifications(clientKey, expectedClientIdentity), "No revocation must be added")
+
+	_, err = gpg.RevokeCertification("test-gpg-validation@client.local", clientKey, RevocationReason(packet.KeyCompromised),
+		"", new(bytes.Buffer))
+	assert.Equal(t, ErrInvalidRevocationReason, err)
+	assert.Empty(t, certifications(clientKey, expectedClientIdentity), "No revocation must be added")
+}
+
+func TestGPGRevokeCertificationOfOldKey(t *testing.T) {
+	clientKey := certifiedEntity(t, setupGPG(t), asciiKeyFileClient, "test-gpg-validation@client.local")
+	gpg := setupECCGPG(t)
+	_, err := gpg.RevokeCertification("test-gpg-validation@client.local", clientKey, RevocationNoReason, "",
+		new(bytes.Buffer))
+	assert.Equal(t, ErrUnknownIdentity, err, "The active key has not certified the identity")
+
+	file, cleanup := utils.Open(t, asciiKeyFileSecret)
+	defer cleanup()
+	require.NoError(t, gpg.AddServerKeys(file, passphrase))
+	buffer := new(bytes.Buffer)
+	identities, err := gpg.RevokeCertification("test-gpg-validation@client.local", clientKey, RevocationNoReason, "",
+		buffer)
+	require.NoError(t, err)
+	assert.Equal(t, []string{expectedClientIdentity}, identities)
+
+	revokedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	signatures := certifications(revokedClientEntity, expectedClientIdentity)
+	require.Len(t, signatures, 2)
+	revocation := signatures[1]
+	assert.Equal(t, packet.SigTypeCertificationRevocation, revocation.SigType)
+	assert.Equal(t, uint64(0x5AE5111887144E5E), *revocation.IssuerKeyId, "The certifying key must revoke")
+	assert.NoError(t, readEntityFromFile(asciiKeyFilePublic, true).PrimaryKey.VerifyUserIdSignature(
+		expectedClientIdentity, revokedClientEntity.PrimaryKey, revocation))
+	assert.Empty(t, gpg.CertifiedIdentities(revokedClientEntity))
+}
+
+func TestFindKey(t *testing.T) {
+	keyRing := new(bytes.Buffer)
+	for _, path := range []string{asciiKeyFileOther, asciiKeyFileClient} {
+		require.NoError(t, readEntityFromFile(path, true).Serialize(keyRing))
+	}
+
+	key, err := FindKey(bytes.NewReader(keyRing.Bytes()), "0x42744CC1E93B112A")
+	require.NoError(t, err)
+	assert.Contains(t, key.Identities, expectedClientIdentity)
+
+	_, err = FindKey(bytes.NewReader(keyRing.Bytes()), "0x5AE5111887144E5E")
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestGPGCertifiedIdentities(t *testing.T) {
+	gpg := setupGPG(t)
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+	assert.Empty(t, gpg.CertifiedIdentities(clientEntity), "Key has not been certified yet")
+
+	signed := new(bytes.Buffer)
+	_, err := gpg.SignUserID("test-gpg-validation@client.local", clientEntity, signed)
+	require.NoError(t, err)
+	signedClientEntity, err := readEntity(signed, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{expectedClientIdentity}, gpg.CertifiedIdentities(signedClientEntity))
+
+	revoked := new(bytes.Buffer)
+	_, err = gpg.RevokeCertification("test-gpg-validation@client.local", signedClientEntity, RevocationUserIDInvalid, "",
+		revoked)
+	require.NoError(t, err)
+	revokedClientEntity, err := readEntity(revoked, true)
+	require.NoError(t, err)
+	assert.Empty(t, gpg.CertifiedIdentities(revokedClientEntity), "Certification has been revoked")
+}
@@ -0,0 +1,313 @@
+package gpg
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	openpgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Signature subpacket types (RFC 4880, section 5.2.3.1, and RFC 9580, section 5.2.3.35).
+const (
+	creationTimeSubpacket      = 2
+	expirationTimeSubpacket    = 3
+	exportableCertSubpacket    = 4
+	issuerSubpacket            = 16
+	notationDataSubpacket      = 20
+	policyURISubpacket         = 26
+	issuerFingerprintSubpacket = 33
+)
+
+// errLocalCertificationVersion is returned when a non-exportable certification is requested from a key, which is not
+// a version 4 key.
+var errLocalCertificationVersion = errors.New("gpg: Non-exportable certifications require a version 4 key")
+
+// certification returns the unsigned certification made by signer at the given time, including the policy URI and
+// notations of the policy. See RFC 4880, section 5.2.3.
+func (policy CertificationPolicy) certification(sigType packet.SignatureType, now time.Time, lifetime uint32,
+	signer *packet.PrivateKey, config *packet.Config) *packet.Signature {
+	sig := &packet.Signature{
+		Version:      signer.PublicKey.Version,
+		SigType:      sigType,
+		PubKeyAlgo:   signer.PubKeyAlgo,
+		Hash:         config.Hash(),
+		CreationTime: now,
+		IssuerKeyId:  &signer.KeyId,
+		PolicyURI:    policy.PolicyURI,
+	}
+	if lifetime != 0 {
+		sig.SigLifetimeSecs = &lifetime
+	}
+	for _, notation := range policy.Notations {
+		sig.Notations = append(sig.Notations, &packet.Notation{
+			Name:            notation.Name,
+			Value:           []byte(notation.Value),
+			IsHumanReadable: true,
+		})
+	}
+	return sig
+}
+
+// signUserID signs the certification sig with priv, asserting that pub is a valid key for the identity id.
+func signUserID(sig *packet.Signature, id string, pub *packet.PublicKey, priv *packet.PrivateKey,
+	config *packet.Config) error {
+	return sig.SignUserId(id, pub, priv, certificationConfig(config))
+}
+
+// writeLocalCertification signs the certification sig with priv like signUserID, but marks it as non-exportable and
+// writes it to w as a version 4 signature packet (RFC 4880, sections 5.2.3 and 5.2.4).
+//
+// go-crypto v1.3.0 can neither create nor read the exportable certification subpacket, so the packet is assembled
+// here. The hashed area holds the creation time, expiration time, exportable certification (with the value zero),
+// notation data, policy URI and issuer fingerprint subpackets, the unhashed area holds the issuer subpacket. Only
+// the fields of sig used by certification are written. go-crypto skips the packet when reading keys, so that the
+// certification is lost, when a written key is read again.
+func writeLocalCertification(w io.Writer, sig *packet.Signature, id string, pub *packet.PublicKey,
+	priv *packet.PrivateKey, config *packet.Config) error {
+	if priv.PublicKey.Version != 4 {
+		return errLocalCertificationVersion
+	}
+	if priv.Dummy() {
+		return openpgpErrors.ErrDummyPrivateKey("dummy key found")
+	}
+	hashID, ok := openpgp.HashToHashId(sig.Hash)
+	if !ok || !sig.Hash.Available() {
+		return openpgpErrors.UnsupportedError("hash function " + strconv.Itoa(int(sig.Hash)))
+	}
+
+	hashed := new(bytes.Buffer)
+	writeSubpacket(hashed, creationTimeSubpacket, uint32Bytes(uint32(sig.CreationTime.Unix())))
+	if sig.SigLifetimeSecs != nil {
+		writeSubpacket(hashed, expirationTimeSubpacket, uint32Bytes(*sig.SigLifetimeSecs))
+	}
+	writeSubpacket(hashed, exportableCertSubpacket, []byte{0})
+	for _, notation := range sig.Notations {
+		writeSubpacket(hashed, notationDataSubpacket, notationData(notation))
+	}
+	if sig.PolicyURI != "" {
+		writeSubpacket(hashed, policyURISubpacket, []byte(sig.PolicyURI))
+	}
+	writeSubpacket(hashed, issuerFingerprintSubpacket, append([]byte{4}, priv.PublicKey.Fingerprint...))
+
+	// The hashed fields are the signature version, type, public key and hash algorithms and the hashed subpackets.
+	fields := append([]byte{4, byte(sig.SigType), byte(priv.PubKeyAlgo), hashID}, uint16Bytes(hashed.Len())...)
+	fields = append(fields, hashed.Bytes()...)
+
+	h := sig.Hash.New()
+	if err := pub.SerializeForHash(h); err != nil {
+		return err
+	}
+	h.Write(append([]byte{0xb4}, uint32Bytes(uint32(len(id)))...))
+	h.Write([]byte(id))
+	h.Write(fields)
+	h.Write(append([]byte{4, 0xff}, uint32Bytes(uint32(len(fields)))...))
+	digest := h.Sum(nil)
+
+	value, err := signDigest(priv, sig.Hash, digest, config)
+	if err != nil {
+		return err
+	}
+
+	unhashed := new(bytes.Buffer)
+	writeSubpacket(unhashed, issuerSubpacket, uint64Bytes(priv.KeyId))
+
+	body := bytes.NewBuffer(fields)
+	body.Write(uint16Bytes(unhashed.Len()))
+	body.Write(unhashed.Bytes())
+	body.Write(digest[:2])
+	body.Write(value)
+	if _, err = w.Write(signaturePacketHeader(body.Len())); err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+// signDigest signs digest with priv and returns the algorithm specific fields of a version 4 signature packet
+// (RFC 4880, section 5.2.2, and RFC 9580, section 5.2.3).
+func signDigest(priv *packet.PrivateKey, hash crypto.Hash, digest []byte, config *packet.Config) ([]byte, error) {
+	switch priv.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		signer, ok := priv.PrivateKey.(crypto.Signer)
+		if !ok {
+			break
+		}
+		value, err := signer.Sign(config.Random(), digest, hash)
+		if err != nil {
+			return nil, err
+		}
+		return mpi(value), nil
+	case packet.PubKeyAlgoECDSA:
+		var r, s *big.Int
+		var err error
+		switch key := priv.PrivateKey.(type) {
+		case *ecdsa.PrivateKey:
+			r, s, err = ecdsa.Sign(config.Random(), key, digest)
+		case crypto.Signer:
+			var value []byte
+			if value, err = key.Sign(config.Random(), digest, hash); err == nil {
+				var ecdsaSignature struct{ R, S *big.Int }
+				_, err = asn1.Unmarshal(value, &ecdsaSignature)
+				r, s = ecdsaSignature.R, ecdsaSignature.S
+			}
+		default:
+			return nil, openpgpErrors.UnsupportedError("ECDSA private key type")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(mpi(r.Bytes()), mpi(s.Bytes())...), nil
+	case packet.PubKeyAlgoEdDSA:
+		key, ok := priv.PrivateKey.(*eddsa.PrivateKey)
+		if !ok {
+			break
+		}
+		r, s, err := eddsa.Sign(key, digest)
+		if err != nil {
+			return nil, err
+		}
+		return append(mpi(r), mpi(s)...), nil
+	case packet.PubKeyAlgoEd25519:
+		key, ok := priv.PrivateKey.(*ed25519.PrivateKey)
+		if !ok {
+			break
+		}
+		return ed25519.Sign(key, digest)
+	}
+	return nil, openpgpErrors.UnsupportedError("public key algorithm " + strconv.Itoa(int(priv.PubKeyAlgo)) +
+		" for non-exportable certifications")
+}
+
+// notationData returns the body of a notation data subpacket (RFC 4880, section 5.2.3.16).
+func notationData(notation *packet.Notation) []byte {
+	flags := []byte{0, 0, 0, 0}
+	if notation.IsHumanReadable {
+		flags[0] = 0x80
+	}
+	data := append(flags, uint16Bytes(len(notation.Name))...)
+	data = append(data, uint16Bytes(len(notation.Value))...)
+	data = append(data, notation.Name...)
+	return append(data, notation.Value...)
+}
+
+// writeSubpacket writes a non-critical signature subpacket of the given type to w (RFC 4880, section 5.2.3.1).
+func writeSubpacket(w *bytes.Buffer, subpacketType byte, data []byte) {
+	length := len(data) + 1
+	switch {
+	case length < 192:
+		w.WriteByte(byte(length))
+	case length < 8384:
+		length -= 192
+		w.Write([]byte{byte(length>>8) + 192, byte(length)})
+	default:
+		w.WriteByte(0xff)
+		w.Write(uint32Bytes(uint32(length)))
+	}
+	w.WriteByte(subpacketType)
+	w.Write(data)
+}
+
+// signaturePacketHeader returns the new format header of a signature packet of the given length (RFC 4880,
+// section 4.2.2).
+func signaturePacketHeader(length int) []byte {
+	const tag = 0xc0 | 2
+	switch {
+	case length < 192:
+		return []byte{tag, byte(length)}
+	case length < 8384:
+		length -= 192
+		return []byte{tag, byte(length>>8) + 192, byte(length)}
+	}
+	return append([]byte{tag, 0xff}, uint32Bytes(uint32(length))...)
+}
+
+// mpi encodes the big-endian integer value as multiprecision integer (RFC 4880, section 3.2).
+func mpi(value []byte) []byte {
+	value = bytes.TrimLeft(value, "\x00")
+	bitLength := 0
+	if len(value) > 0 {
+		bitLength = 8*(len(value)-1) + new(big.Int).SetBytes(value[:1]).BitLen()
+	}
+	return append(uint16Bytes(bitLength), value...)
+}
+
+func uint16Bytes(value int) []byte {
+	return []byte{byte(value >> 8), byte(value)}
+}
+
+func uint32Bytes(value uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return data
+}
+
+func uint64Bytes(value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return data
+}
+
+// serializeEntity writes the public parts of entity to w like entity.Serialize, followed by the serialized local
+// certifications of each identity after its signatures.
+func serializeEntity(entity *openpgp.Entity, local map[string][]byte, w io.Writer) error {
+	if err := entity.PrimaryKey.Serialize(w); err != nil {
+		return err
+	}
+	signatures := append(append([]*packet.Signature{}, entity.Revocations...), entity.Signatures...)
+	if err := serializeSignatures(signatures, w); err != nil {
+		return err
+	}
+	for name, identity := range entity.Identities {
+		if err := identity.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err := serializeSignatures(identity.Signatures, w); err != nil {
+			return err
+		}
+		if _, err := w.Write(local[name]); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if err := subkey.PublicKey.Serialize(w); err != nil {
+			return err
+		}
+		if err := serializeSignatures(append(append([]*packet.Signature{}, subkey.Revocations...), subkey.Sig), w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serializeSignatures(signatures []*packet.Signature, w io.Writer) error {
+	for _, sig := range signatures {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certificationConfig returns a copy of config, which keeps go-crypto from adding a random salt notation to version 4
+// signatures. Certifications shall only carry the notations of the certification policy.
+func certificationConfig(config *packet.Config) *packet.Config {
+	result := packet.Config{}
+	if config != nil {
+		result = *config
+	}
+	randomize := false
+	result.NonDeterministicSignaturesViaNotation = &randomize
+	return &result
+}
@@ -0,0 +1,173 @@
+package gpg
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	openpgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signIdentityTest(t *testing.T, policy CertificationPolicy) *packet.Signature {
+	serverEntity := readEntityFromFile(binaryKeyFileSecret, false)
+	require.NoError(t, decryptPrivateKeys(serverEntity, []byte(passphrase)))
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+
+	buffer := new(bytes.Buffer)
+	require.NoError(t, signClientPublicKey(clientEntity, []string{expectedClientIdentity}, serverEntity, policy, false, buffer))
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	verifySignatureTest(t, expectedClientIdentity, signedClientEntity)
+
+	signatures := certifications(signedClientEntity, expectedClientIdentity)
+	require.Len(t, signatures, 1)
+	return signatures[0]
+}
+
+func TestSignIdentityWithPolicyURIAndNotations(t *testing.T) {
+	policy := DefaultCertificationPolicy()
+	policy.Notations = []Notation{
+		{"validation-method@server.local", "enc-email-click"},
+		{"requested-by@server.local", "test"},
+	}
+	sig := signIdentityTest(t, policy)
+
+	assert.Equal(t, packet.SigTypeGenericCert, sig.SigType)
+	assert.Equal(t, uint64(0x5AE5111887144E5E), *sig.IssuerKeyId)
+	assert.Equal(t, DefaultPolicyURI, sig.PolicyURI)
+
+	require.Len(t, sig.Notations, 2)
+	assert.Equal(t, &packet.Notation{Name: "validation-method@server.local", Value: []byte("enc-email-click"),
+		IsHumanReadable: true}, sig.Notations[0])
+	assert.Equal(t, &packet.Notation{Name: "requested-by@server.local", Value: []byte("test"),
+		IsHumanReadable: true}, sig.Notations[1])
+}
+
+func TestSignIdentityWithoutPolicyURI(t *testing.T) {
+	sig := signIdentityTest(t, CertificationPolicy{Lifetime: DefaultCertificationLifetime})
+
+	assert.Empty(t, sig.PolicyURI)
+	assert.Empty(t, sig.Notations)
+	assert.Equal(t, uint64(0x5AE5111887144E5E), *sig.IssuerKeyId)
+}
+
+func TestParseNotation(t *testing.T) {
+	notation, err := ParseNotation("validation-method@server.local=enc-email-click")
+	assert.NoError(t, err)
+	assert.Equal(t, Notation{"validation-method@server.local", "enc-email-click"}, notation)
+
+	notation, err = ParseNotation("empty@server.local=")
+	assert.NoError(t, err)
+	assert.Equal(t, Notation{"empty@server.local", ""}, notation)
+
+	_, err = ParseNotation("validation-method=enc-email-click")
+	assert.Equal(t, ErrInvalidNotation, err)
+
+	_, err = ParseNotation("validation-method@server.local")
+	assert.Equal(t, ErrInvalidNotation, err)
+}
+
+// signedEntityTest certifies the identity of the client key read from clientPath with the server key read from
+// serverPath and returns the resulting client entity.
+func signedEntityTest(t *testing.T, serverPath, clientPath string, policy CertificationPolicy) *openpgp.Entity {
+	serverEntity := readEntityFromFile(serverPath, true)
+	require.NoError(t, decryptPrivateKeys(serverEntity, []byte(passphrase)))
+	clientEntity := readEntityFromFile(clientPath, true)
+	identities := make([]string, 0, len(clientEntity.Identities))
+	for name := range clientEntity.Identities {
+		identities = append(identities, name)
+	}
+
+	buffer := new(bytes.Buffer)
+	require.NoError(t, signClientPublicKey(clientEntity, identities, serverEntity, policy, false, buffer))
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	return signedClientEntity
+}
+
+func TestSerializeEntityMatchesStockSerialize(t *testing.T) {
+	for _, keys := range [][3]string{
+		{asciiKeyFileSecret, asciiKeyFileClient, expectedClientIdentity},
+		{asciiKeyFileECCSecret, asciiKeyFileECCClient, expectedECCClientIdentity},
+	} {
+		entity := signedEntityTest(t, keys[0], keys[1], DefaultCertificationPolicy())
+
+		expected := new(bytes.Buffer)
+		require.NoError(t, entity.Serialize(expected))
+		actual := new(bytes.Buffer)
+		require.NoError(t, serializeEntity(entity, nil, actual))
+		assert.Equal(t, expected.Bytes(), actual.Bytes(), "serializeEntity must write keys like entity.Serialize")
+
+		roundTrip, err := openpgp.ReadEntity(packet.NewReader(actual))
+		require.NoError(t, err)
+		assert.Equal(t, entity.PrimaryKey.Fingerprint, roundTrip.PrimaryKey.Fingerprint)
+		assert.Len(t, certifications(roundTrip, keys[2]), 1)
+	}
+}
+
+func TestWriteLocalCertification(t *testing.T) {
+	for _, keys := range [][3]string{
+		{asciiKeyFileSecret, asciiKeyFileClient, expectedClientIdentity},
+		{asciiKeyFileECCSecret, asciiKeyFileECCClient, expectedECCClientIdentity},
+	} {
+		serverEntity := readEntityFromFile(keys[0], true)
+		require.NoError(t, decryptPrivateKeys(serverEntity, []byte(passphrase)))
+		clientEntity := readEntityFromFile(keys[1], true)
+
+		policy := DefaultCertificationPolicy()
+		policy.Notations = []Notation{{"validation-method@server.local", "enc-email-click"}}
+		sig := policy.certification(packet.SigTypeGenericCert, time.Now(), 3600, serverEntity.PrivateKey, nil)
+		buffer := new(bytes.Buffer)
+		require.NoError(t, writeLocalCertification(buffer, sig, keys[2], clientEntity.PrimaryKey,
+			serverEntity.PrivateKey, nil))
+
+		opaque, err := packet.NewOpaqueReader(bytes.NewReader(buffer.Bytes())).Next()
+		require.NoError(t, err)
+		require.Equal(t, uint8(2), opaque.Tag)
+		raw := parseRawSignature(t, opaque.Contents)
+		assert.Equal(t, packet.SigTypeGenericCert, raw.sigType)
+		assert.Equal(t, []byte{0}, raw.hashedSubpackets[exportableCertSubpacket])
+		assert.Equal(t, uint32Bytes(3600), raw.hashedSubpackets[expirationTimeSubpacket])
+		assert.Equal(t, []byte(DefaultPolicyURI), raw.hashedSubpackets[policyURISubpacket])
+		assert.Equal(t, notationData(sig.Notations[0]), raw.hashedSubpackets[notationDataSubpacket])
+		assert.Equal(t, append([]byte{4}, serverEntity.PrimaryKey.Fingerprint...),
+			raw.hashedSubpackets[issuerFingerprintSubpacket])
+
+		digest := certificationDigest(t, sig.Hash, clientEntity.PrimaryKey, keys[2], raw)
+		switch key := serverEntity.PrimaryKey.PublicKey.(type) {
+		case *rsa.PublicKey:
+			assert.NoError(t, rsa.VerifyPKCS1v15(key, sig.Hash, digest, raw.value))
+		case *eddsa.PublicKey:
+			require.Len(t, raw.values, 2)
+			assert.True(t, eddsa.Verify(key, digest, raw.values[0], raw.values[1]))
+		default:
+			t.Fatalf("Unexpected server key type %T", key)
+		}
+
+		// go-crypto v1.3.0 skips non-exportable certifications when reading keys, so that they are lost in stores.
+		// Once it reads them, --local-certifications can be allowed together with --storage file.
+		_, err = packet.Read(bytes.NewReader(buffer.Bytes()))
+		assert.IsType(t, openpgpErrors.UnsupportedError(""), err,
+			"go-crypto reads non-exportable certifications now, keep them in stores")
+	}
+}
+
+func TestWriteLocalCertificationRequiresVersion4Key(t *testing.T) {
+	serverEntity := readEntityFromFile(asciiKeyFileSecret, true)
+	require.NoError(t, decryptPrivateKeys(serverEntity, []byte(passphrase)))
+	clientEntity := readEntityFromFile(asciiKeyFileClient, true)
+
+	privateKey := *serverEntity.PrivateKey
+	privateKey.PublicKey.Version = 6
+	sig := DefaultCertificationPolicy().certification(packet.SigTypeGenericCert, time.Now(), 0, &privateKey, nil)
+	err := writeLocalCertification(new(bytes.Buffer), sig, expectedClientIdentity, clientEntity.PrimaryKey,
+		&privateKey, nil)
+	assert.Equal(t, errLocalCertificationVersion, err)
+}
@@ -0,0 +1,119 @@
+package gpg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	openpgpECDSA "github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ErrUnsupportedSigner is returned when the algorithm of a server key cannot be used with an external signer.
+// Only RSA and ECDSA (NIST curves) server keys are supported, because go-crypto signs EdDSA only with private keys held
+// in memory. Ed25519 server keys can be separated from the frontends by the signer daemon instead (package signer).
+var ErrUnsupportedSigner = errors.New("gpg: Server key algorithm not supported by external signers")
+
+// ErrSignerMismatch is returned when the public key of a signer does not match the server key.
+var ErrSignerMismatch = errors.New("gpg: Signer does not hold the server key")
+
+// NewGPGWithSigner initializes a GPG object, whose certifications and message signatures are made by the given signer
+// instead of a private key held in memory, e.g. by a gpg-agent or a hardware token (see package agent).
+// serverKey contains the server key, which may be a public key only. Private subkeys contained in it are decrypted
+// with passphrase and used to decrypt messages.
+func NewGPGWithSigner(serverKey io.Reader, passphrase string, signer crypto.Signer) (*GPG, error) {
+	entity, err := readEntityMaybeArmored(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = setSigner(entity, signer); err != nil {
+		return nil, err
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey == nil {
+			continue
+		}
+		if err = subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &GPG{
+		serverEntity:   entity,
+		serverEntities: openpgp.EntityList{entity},
+		Policy:         DefaultCertificationPolicy(),
+		KeyPolicy:      DefaultKeyPolicy(),
+	}, nil
+}
+
+// NewSoftwareSigner returns a signer holding the decrypted primary key of the first server key in the given buffer
+// in memory. It behaves like NewGPG, but lets the key be handled like any other external signer.
+func NewSoftwareSigner(serverPrivateKey io.Reader, passphrase string) (crypto.Signer, error) {
+	entity, err := readEntityMaybeArmored(serverPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if entity.PrivateKey == nil {
+		return nil, ErrNoPrivateKey
+	}
+	if err = entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+		return nil, err
+	}
+
+	switch key := entity.PrivateKey.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *openpgpECDSA.PrivateKey:
+		public, err := PublicSigningKey(entity)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PrivateKey{PublicKey: *public.(*ecdsa.PublicKey), D: key.D}, nil
+	}
+	return nil, ErrUnsupportedSigner
+}
+
+// PublicSigningKey returns the primary public key of the given key in the form used by crypto.Signer, i.e.
+// *rsa.PublicKey or *ecdsa.PublicKey.
+func PublicSigningKey(key Key) (crypto.PublicKey, error) {
+	switch public := key.PrimaryKey.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return public, nil
+	case *openpgpECDSA.PublicKey:
+		curve, err := key.PrimaryKey.Curve()
+		if err != nil {
+			return nil, err
+		}
+		ellipticCurve, ok := ellipticCurves[curve]
+		if !ok {
+			return nil, ErrUnsupportedSigner
+		}
+		return &ecdsa.PublicKey{Curve: ellipticCurve, X: public.X, Y: public.Y}, nil
+	}
+	return nil, ErrUnsupportedSigner
+}
+
+var ellipticCurves = map[packet.Curve]elliptic.Curve{
+	packet.CurveNistP256: elliptic.P256(),
+	packet.CurveNistP384: elliptic.P384(),
+	packet.CurveNistP521: elliptic.P521(),
+}
+
+// setSigner replaces the primary private key of entity by signer after checking that it holds the same key.
+func setSigner(entity *openpgp.Entity, signer crypto.Signer) error {
+	public, err := PublicSigningKey(entity)
+	if err != nil {
+		return err
+	}
+	equal, ok := public.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !equal.Equal(signer.Public()) {
+		return ErrSignerMismatch
+	}
+
+	entity.PrivateKey = &packet.PrivateKey{PublicKey: *entity.PrimaryKey, PrivateKey: signer}
+	return nil
+}
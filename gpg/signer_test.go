@@ -0,0 +1,112 @@
+package gpg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func softwareSignerTest(t *testing.T, path string) crypto.Signer {
+	file, cleanup := utils.Open(t, path)
+	defer cleanup()
+	signer, err := NewSoftwareSigner(file, passphrase)
+	require.NoError(t, err, "Failed to create software signer")
+	return signer
+}
+
+func setupGPGWithSigner(t *testing.T, signer crypto.Signer) *GPG {
+	file, cleanup := utils.Open(t, asciiKeyFilePublic)
+	defer cleanup()
+	gpg, err := NewGPGWithSigner(file, passphrase, signer)
+	require.NoError(t, err, "Failed to create GPG object")
+	return gpg
+}
+
+func TestGPGWithSignerSignUserID(t *testing.T) {
+	gpg := setupGPGWithSigner(t, softwareSignerTest(t, asciiKeyFileSecret))
+	assert.Equal(t, expectedIdentity, gpg.ServerIdentity())
+
+	clientPublicKey := readEntityFromFile(asciiKeyFileClient, true)
+	buffer := new(bytes.Buffer)
+	_, err := gpg.SignUserID("test-gpg-validation@client.local", clientPublicKey, buffer)
+	require.NoError(t, err, "Failed to sign user id")
+
+	signedClientEntity, err := readEntity(buffer, true)
+	require.NoError(t, err)
+	verifySignatureTest(t, expectedClientIdentity, signedClientEntity)
+}
+
+func TestGPGWithSignerSignMessage(t *testing.T) {
+	gpg := setupGPGWithSigner(t, softwareSignerTest(t, asciiKeyFileSecret))
+
+	signature := new(bytes.Buffer)
+	require.NoError(t, gpg.SignMessage(bytes.NewReader(testMessageBytes), signature))
+
+	serverKey := readEntityFromFile(asciiKeyFilePublic, true)
+	err := CheckMessageSignature(bytes.NewReader(testMessageBytes), signature, serverKey)
+	assert.NoError(t, err, "Signature made by software signer not valid")
+}
+
+func TestGPGWithSignerDecryptsWithSubkeys(t *testing.T) {
+	file, cleanup := utils.Open(t, asciiKeyFileSecret)
+	defer cleanup()
+	gpg, err := NewGPGWithSigner(file, passphrase, softwareSignerTest(t, asciiKeyFileSecret))
+	require.NoError(t, err, "Failed to create GPG object")
+
+	cipherText := new(bytes.Buffer)
+	plaintext, err := gpg.EncryptMessage(cipherText, readEntityFromFile(asciiKeyFilePublic, true))
+	require.NoError(t, err)
+	_, err = plaintext.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+
+	decrypted := new(bytes.Buffer)
+	err = gpg.DecryptSignedMessage(cipherText, decrypted, readEntityFromFile(asciiKeyFilePublic, true))
+	require.NoError(t, err, "Failed to decrypt message")
+	assert.Equal(t, testMessageBytes, decrypted.Bytes())
+}
+
+func TestGPGWithSignerMismatch(t *testing.T) {
+	file, cleanup := utils.Open(t, asciiKeyFilePublic)
+	defer cleanup()
+	_, err := NewGPGWithSigner(file, passphrase, softwareSignerTest(t, asciiKeyFileClientSecret))
+	assert.Equal(t, ErrSignerMismatch, err)
+}
+
+func TestGPGWithSignerUnsupportedAlgorithm(t *testing.T) {
+	file, cleanup := utils.Open(t, asciiKeyFileECCSecret)
+	defer cleanup()
+	_, err := NewSoftwareSigner(file, passphrase)
+	assert.Equal(t, ErrUnsupportedSigner, err, "Ed25519 keys cannot be used by external signers")
+
+	file, cleanup = utils.Open(t, asciiKeyFileECCPublic)
+	defer cleanup()
+	_, err = NewGPGWithSigner(file, passphrase, softwareSignerTest(t, asciiKeyFileSecret))
+	assert.Equal(t, ErrUnsupportedSigner, err)
+}
+
+func TestSoftwareSignerECDSA(t *testing.T) {
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoECDSA, Curve: packet.CurveNistP256}
+	entity, err := openpgp.NewEntity("TEST-ecdsa", "", "test-gpg-validation@ecdsa.local", config)
+	require.NoError(t, err)
+	serverKey := new(bytes.Buffer)
+	require.NoError(t, entity.SerializePrivate(serverKey, nil))
+
+	signer, err := NewSoftwareSigner(bytes.NewReader(serverKey.Bytes()), "")
+	require.NoError(t, err, "Failed to create software signer")
+	assert.IsType(t, &ecdsa.PrivateKey{}, signer)
+
+	gpg, err := NewGPGWithSigner(bytes.NewReader(serverKey.Bytes()), "", signer)
+	require.NoError(t, err, "Failed to create GPG object")
+	signature := new(bytes.Buffer)
+	require.NoError(t, gpg.SignMessage(bytes.NewReader(testMessageBytes), signature))
+	err = CheckMessageSignature(bytes.NewReader(testMessageBytes), signature, entity)
+	assert.NoError(t, err, "ECDSA signature made by software signer not valid")
+}
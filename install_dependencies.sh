@@ -5,4 +5,4 @@ set -e
 go get -u github.com/alecthomas/gometalinter
 gometalinter --install
 
-go get -t -v ./...
+go mod download
@@ -0,0 +1,31 @@
+// Package socket creates the Unix domain sockets of the signer daemon and the gpg-agent stand-in.
+package socket
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMutex serializes the changes of the process-wide umask by ListenPrivate.
+var umaskMutex sync.Mutex
+
+// ListenPrivate creates a Unix domain socket at the given path, which is only accessible by the current user. The
+// umask is restricted while the socket is created, so that no other user can connect before its mode is set.
+func ListenPrivate(socketPath string) (net.Listener, error) {
+	umaskMutex.Lock()
+	oldUmask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldUmask)
+	umaskMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
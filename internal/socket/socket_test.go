@@ -0,0 +1,42 @@
+package socket
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenPrivateConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	umask := syscall.Umask(0022)
+	defer syscall.Umask(umask)
+
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			listener, err := ListenPrivate(path)
+			if assert.NoError(t, err) {
+				defer func() { _ = listener.Close() }()
+			}
+			info, err := os.Stat(path)
+			if assert.NoError(t, err) {
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Socket must only be accessible by the owner")
+			}
+		}(paths[i])
+	}
+	wg.Wait()
+	assert.Equal(t, 0022, syscall.Umask(0022), "Umask must be restored after creating the sockets")
+}
@@ -16,13 +16,22 @@ type MessageEncrypter interface {
 	ServerIdentity() string
 }
 
+// defaultSubject is the subject of outgoing mails, which do not set one.
+const defaultSubject = "OpenPGP Key Validation"
+
+// obscuredSubject replaces the subject in the unencrypted header of outgoing mails.
+const obscuredSubject = "..."
+
 // OutgoingMail describes the contents of the mail to be sent
 type OutgoingMail struct {
 	Message        string
+	Subject        string
 	RecipientEmail string
 	RecipientKey   gpg.Key
 	Attachment     []byte
 	GPG            MessageEncrypter
+	// InReplyTo is the Message-ID of the mail, which is automatically answered by this mail, if any.
+	InReplyTo string
 }
 
 // From returns the sender of the mail.
@@ -30,21 +39,42 @@ func (m OutgoingMail) From() string {
 	return m.GPG.ServerIdentity()
 }
 
-// Bytes returns the given message as an OpenPGP/MIME encrypted and signed message (RFC 2440 and 3156)
+// Bytes returns the given message as an OpenPGP/MIME encrypted and signed message (RFC 2440 and 3156). The headers
+// describing the message are protected by putting them into the encrypted part, while the outer header only carries an
+// obscured subject. Without recipient key, the message is returned unencrypted.
 func (m OutgoingMail) Bytes() ([]byte, error) {
 	w := bytes.Buffer{}
 	now := time.Now()
 	identityParts := strings.FieldsFunc(m.GPG.ServerIdentity(), func(r rune) bool { return strings.ContainsRune("><@", r) })
 	serverDomain := identityParts[len(identityParts)-1]
-	empw := NewEncodingMultipartWriter(&w, "encrypted", "application/pgp-encrypted", map[string]string{
-		"Date":                now.Format(time.RFC1123Z),
-		"From":                m.From(),
-		"To":                  m.RecipientEmail,
-		"Message-ID":          "<" + now.Format(time.RFC3339Nano) + "@" + serverDomain + ">",
-		"Subject":             "OpenPGP Key Validation",
+	protectedHeaders := map[string]string{
+		"Date":       now.Format(time.RFC1123Z),
+		"From":       m.From(),
+		"To":         m.RecipientEmail,
+		"Message-ID": "<" + now.Format(time.RFC3339Nano) + "@" + serverDomain + ">",
+		"Subject":    m.subject(),
+	}
+	outerHeaders := map[string]string{
+		"Subject":             obscuredSubject,
 		"X-Mailer":            "github.com/TNG/openpgp-validation-server",
 		"Content-Description": "OpenPGP encrypted message",
-	})
+		// All mails are sent automatically, so that well-behaved responders do not answer them (RFC 3834).
+		"Auto-Submitted": "auto-generated",
+	}
+	if m.InReplyTo != "" {
+		outerHeaders["Auto-Submitted"] = "auto-replied"
+		outerHeaders["In-Reply-To"] = m.InReplyTo
+		outerHeaders["References"] = m.InReplyTo
+	}
+	if m.RecipientKey == nil {
+		return m.plainBytes(protectedHeaders, outerHeaders)
+	}
+	for key, value := range protectedHeaders {
+		if _, ok := outerHeaders[key]; !ok {
+			outerHeaders[key] = value
+		}
+	}
+	empw := NewEncodingMultipartWriter(&w, "encrypted", "application/pgp-encrypted", outerHeaders)
 
 	if err := empw.WritePGPMIMEVersion(); err != nil {
 		return nil, err
@@ -61,6 +91,7 @@ func (m OutgoingMail) Bytes() ([]byte, error) {
 	}
 
 	encryptedMultipartWriter := NewEncodingMultipartWriter(plaintext, "mixed", "", nil)
+	encryptedMultipartWriter.ProtectHeaders(protectedHeaders)
 
 	if err = encryptedMultipartWriter.WritePlainText(m.Message); err != nil {
 		return nil, err
@@ -84,6 +115,37 @@ func (m OutgoingMail) Bytes() ([]byte, error) {
 	return w.Bytes(), nil
 }
 
+// plainBytes returns the message as unencrypted mail with the given headers. The headers to be protected in encrypted
+// mails replace the outer headers. The attachment holds the key of the recipient, so it is left out.
+func (m OutgoingMail) plainBytes(protectedHeaders, outerHeaders map[string]string) ([]byte, error) {
+	headers := map[string]string{}
+	for key, value := range outerHeaders {
+		if key != "Content-Description" {
+			headers[key] = value
+		}
+	}
+	for key, value := range protectedHeaders {
+		headers[key] = value
+	}
+
+	w := bytes.Buffer{}
+	mpw := NewEncodingMultipartWriter(&w, "mixed", "", headers)
+	if err := mpw.WritePlainText(m.Message); err != nil {
+		return nil, err
+	}
+	if err := mpw.Close(); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (m OutgoingMail) subject() string {
+	if m.Subject == "" {
+		return defaultSubject
+	}
+	return m.Subject
+}
+
 func (m OutgoingMail) handleAttachment(w *EncodingMultipartWriter) error {
 	if m.Attachment == nil {
 		return nil
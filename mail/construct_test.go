@@ -1,11 +1,14 @@
 package mail
 
 import (
+	"bytes"
+	"net/mail"
 	"testing"
 
 	"github.com/TNG/openpgp-validation-server/gpg"
 	"github.com/TNG/openpgp-validation-server/test/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const prefix = "../test/keys/test-gpg-validation@server.local (0x87144E5E) "
@@ -27,8 +30,51 @@ func TestConstructCryptSignEmail(t *testing.T) {
 	clientKey, err := gpg.ReadKey(clientPublicKeyFile)
 	assert.NoError(t, err)
 
-	m := OutgoingMail{"It works!", "test-gpg-validation@client.local", clientKey, []byte{}, gpg}
+	m := OutgoingMail{"It works!", "", "test-gpg-validation@client.local", clientKey, []byte{}, gpg, ""}
 	b, err := m.Bytes()
 	assert.NoError(t, err)
+	assert.Contains(t, string(b), "Subject: ...")
+	assert.NotContains(t, string(b), "OpenPGP Key Validation")
 	t.Log(string(b))
 }
+
+func TestConstructProtectedHeaders(t *testing.T) {
+	server := serverGPG(t)
+	serverKey, err := gpg.UnmarshalKey([]byte(readTestFile(t, asciiKeyFilePublic)))
+	require.NoError(t, err)
+
+	// The mail is sent to the server itself, so that it can be decrypted and the attached key verifies the signature.
+	m := OutgoingMail{"It works!", "OpenPGP Key Validation Revoked", "test-gpg-validation@server.local", serverKey,
+		[]byte(readTestFile(t, asciiKeyFilePublic)), server, ""}
+	b, err := m.Bytes()
+	require.NoError(t, err)
+	outer, err := mail.ReadMessage(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, "...", outer.Header.Get("Subject"), "Subject must be obscured")
+	assert.Equal(t, "auto-generated", outer.Header.Get("Auto-Submitted"))
+
+	parser := Parser{Gpg: server}
+	entity, err := parser.ParseMail(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.NotNil(t, entity.SignedBy)
+	assert.Equal(t, "OpenPGP Key Validation Revoked", entity.GetSubject())
+	assert.Equal(t, m.From(), entity.GetSender())
+	assert.Equal(t, outer.Header.Get("Message-Id"), entity.Header.Get("Message-Id"))
+	assert.Equal(t, "v1", getMimeMediaType(entity.Header, "Content-Type").Params["protected-headers"])
+	assert.Equal(t, "It works!", string(entity.Parts[0].Content))
+}
+
+func TestConstructPlainReply(t *testing.T) {
+	m := OutgoingMail{Message: "Your request has been rejected.", Subject: "Rejected",
+		RecipientEmail: "test-gpg-validation@client.local", GPG: serverGPG(t), InReplyTo: "<request@client.local>"}
+	b, err := m.Bytes()
+	require.NoError(t, err)
+
+	reply, err := mail.ReadMessage(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, "Rejected", reply.Header.Get("Subject"), "Unencrypted mails need not obscure the subject")
+	assert.Equal(t, "auto-replied", reply.Header.Get("Auto-Submitted"))
+	assert.Equal(t, "<request@client.local>", reply.Header.Get("In-Reply-To"))
+	assert.NotContains(t, string(b), "-----BEGIN PGP MESSAGE-----")
+	assert.Contains(t, string(b), "Your request has been rejected.")
+}
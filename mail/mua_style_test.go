@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientFingerprint is the fingerprint of the client test key, which made all reconstructed MUA-style requests.
+const clientFingerprint = "794FFD8896C89322DEE24CDB42744CC1E93B112A"
+
+// muaVerdict is the expected result of parsing one of the reconstructed MUA-style requests in test/mails/mua. The
+// requests are written after the MIME structure of the clients, not captured from them, see test/mails/mua/README.md.
+type muaVerdict struct {
+	file string
+	// signer is the fingerprint of the key, which must be found to have signed the request, or empty if the request
+	// cannot be verified.
+	signer string
+	// keySource is where the key of the signer must be found.
+	keySource KeySource
+	// attachments are the content types of all attachments of the parsed request in order of appearance.
+	attachments []string
+	// parseError is set if the request cannot be parsed at all.
+	parseError bool
+}
+
+var (
+	signedAttachments   = []string{"application/pgp-keys", "application/pgp-signature"}
+	keyAttachment       = []string{"application/pgp-keys"}
+	signatureAttachment = []string{"application/pgp-signature"}
+)
+
+var muaStyleRequests = []muaVerdict{
+	{"evolution_encrypted.eml", clientFingerprint, KeySourceAttached, signedAttachments, false},
+	{"evolution_signed.eml", clientFingerprint, KeySourceAttached, signedAttachments, false},
+	{"gpgol_encrypted.eml", clientFingerprint, KeySourceAttached, keyAttachment, false},
+	{"gpgol_signed.eml", clientFingerprint, KeySourceAttached, signedAttachments, false},
+	// K-9 Mail sends the key in the Autocrypt header only.
+	{"k9_encrypted.eml", clientFingerprint, KeySourceAutocrypt, nil, false},
+	{"k9_signed.eml", clientFingerprint, KeySourceAutocrypt, signatureAttachment, false},
+	{"mailvelope_encrypted.eml", clientFingerprint, KeySourceAttached, keyAttachment, false},
+	{"mailvelope_signed.eml", clientFingerprint, KeySourceAttached, keyAttachment, false},
+	{"mutt_encrypted.eml", clientFingerprint, KeySourceAttached, keyAttachment, false},
+	{"mutt_signed.eml", clientFingerprint, KeySourceAttached, signedAttachments, false},
+	{"thunderbird_encrypted.eml", clientFingerprint, KeySourceAttached, keyAttachment, false},
+	{"thunderbird_signed.eml", clientFingerprint, KeySourceAttached, signedAttachments, false},
+}
+
+// attachmentTypes returns the content types of all attachments of the entity.
+func attachmentTypes(entity *MimeEntity) []string {
+	if entity.IsAttachment {
+		return []string{getMimeMediaType(entity.Header, "Content-Type").Value}
+	}
+	var types []string
+	for i := range entity.Parts {
+		types = append(types, attachmentTypes(&entity.Parts[i])...)
+	}
+	return types
+}
+
+// plainText returns the content of the first text/plain part of the entity.
+func plainText(entity *MimeEntity) string {
+	if entity.Parts == nil {
+		if !entity.IsAttachment && isPlainText(getMimeMediaType(entity.Header, "Content-Type")) {
+			return string(entity.Content)
+		}
+		return ""
+	}
+	for i := range entity.Parts {
+		if text := plainText(&entity.Parts[i]); text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+func TestMUAStyleRequests(t *testing.T) {
+	parser := Parser{Gpg: serverGPG(t), Keys: keyLookup{}}
+	for _, verdict := range muaStyleRequests {
+		t.Run(verdict.file, func(t *testing.T) {
+			entity, err := parser.ParseMail(bytes.NewReader(loadTestMail(t, "mua/"+verdict.file)))
+			if verdict.parseError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if verdict.signer == "" {
+				assert.Nil(t, entity.SignedBy)
+			} else if assert.NotNil(t, entity.SignedBy) {
+				assert.Equal(t, verdict.signer, fmt.Sprintf("%X", entity.SignedBy.PrimaryKey.Fingerprint))
+			}
+			assert.Equal(t, verdict.keySource, entity.KeySource)
+			assert.Equal(t, verdict.attachments, attachmentTypes(entity))
+			assert.Contains(t, plainText(entity), "Please sign this key.")
+		})
+	}
+}
+
+func TestMUAStyleRequestsComplete(t *testing.T) {
+	paths, err := filepath.Glob("../test/mails/mua/*.eml")
+	require.NoError(t, err)
+	files := make([]string, len(paths))
+	for i, path := range paths {
+		files[i] = filepath.Base(path)
+	}
+	verdicts := make([]string, len(muaStyleRequests))
+	for i, verdict := range muaStyleRequests {
+		verdicts[i] = verdict.file
+	}
+	assert.Equal(t, files, verdicts, "Every MUA-style request needs a verdict")
+}
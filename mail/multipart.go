@@ -6,6 +6,7 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/textproto"
+	"strings"
 	"unicode"
 )
 
@@ -55,6 +56,16 @@ func NewEncodingMultipartWriter(w io.Writer, multitype, protocol string, extraHe
 	return &EncodingMultipartWriter{w, headers, false, multipartWriter}
 }
 
+// ProtectHeaders adds the given headers to the multipart and declares them as protected headers, as proposed in the RFC
+// draft for protected headers in cryptographic e-mail. It must be called before anything is written.
+func (w *EncodingMultipartWriter) ProtectHeaders(headers map[string]string) {
+	w.headers["Content-Type"] = strings.TrimSuffix(w.headers["Content-Type"], ";") + ";" + newline +
+		" protected-headers=\"v1\""
+	for key, value := range headers {
+		w.headers[key] = value
+	}
+}
+
 func (w *EncodingMultipartWriter) checkWriteHeaders() error {
 	if w.headersWritten {
 		return nil
@@ -6,7 +6,7 @@ import (
 	"testing"
 )
 
-var parser = Parser{nil}
+var parser = Parser{Gpg: nil}
 
 func TestEmptyMultipartWriter(t *testing.T) {
 	assert := assert.New(t)
@@ -2,6 +2,8 @@ package mail
 
 import (
 	"bytes"
+	"crypto"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/TNG/openpgp-validation-server/gpg"
@@ -11,13 +13,48 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/mail"
 	"net/textproto"
-	"reflect"
 	"regexp"
 	"strings"
 )
 
+// ErrMissingBoundary is returned when a multipart does not specify its boundary.
+var ErrMissingBoundary = errors.New("mail: Multipart has no boundary")
+
+// ErrMalformedSignedPart is returned when the signed part of a multipart/signed mail cannot be delimited.
+var ErrMalformedSignedPart = errors.New("mail: Malformed signed part")
+
+// ErrMicAlgMismatch is returned when the micalg parameter of a multipart/signed mail does not name the hash algorithm
+// of its signature.
+var ErrMicAlgMismatch = errors.New("mail: micalg does not match signature hash algorithm")
+
+// ErrNoSignerKey is returned when the key of the signer of a mail has neither been sent with the mail nor certified
+// before.
+var ErrNoSignerKey = errors.New("mail: No key attached, advertised in an Autocrypt header or pasted")
+
+// ErrWeakHash is returned when a signature uses a hash algorithm, which is not accepted for requests.
+var ErrWeakHash = errors.New("mail: Weak signature hash algorithm")
+
+// micAlgHashes maps the micalg parameter values of RFC 3156 to hash algorithms.
+var micAlgHashes = map[string]crypto.Hash{
+	"pgp-md5":       crypto.MD5,
+	"pgp-sha1":      crypto.SHA1,
+	"pgp-ripemd160": crypto.RIPEMD160,
+	"pgp-sha224":    crypto.SHA224,
+	"pgp-sha256":    crypto.SHA256,
+	"pgp-sha384":    crypto.SHA384,
+	"pgp-sha512":    crypto.SHA512,
+}
+
+// weakHashes are the hash algorithms rejected in request signatures.
+var weakHashes = map[crypto.Hash]bool{
+	crypto.MD5:       true,
+	crypto.SHA1:      true,
+	crypto.RIPEMD160: true,
+}
+
 // MimeEntity describes a multipart MIME encoded message
 type MimeEntity struct {
 	Header       textproto.MIMEHeader
@@ -25,6 +62,35 @@ type MimeEntity struct {
 	Parts        []MimeEntity
 	IsAttachment bool
 	SignedBy     gpg.Key
+
+	// KeySource tells where the key of the signer has been found, if the entity is signed.
+	KeySource KeySource
+
+	// Signature describes the verification of the signature of a multipart/signed entity, or is nil for other
+	// entities and if the signature could not be read.
+	Signature *SignatureDetails
+}
+
+// KeySource names where the key of the signer of an entity has been found.
+type KeySource string
+
+// The sources of signer keys.
+const (
+	KeySourceNone      KeySource = ""
+	KeySourceAttached  KeySource = "attached"
+	KeySourceAutocrypt KeySource = "autocrypt"
+	KeySourcePasted    KeySource = "pasted"
+	KeySourceCertified KeySource = "certified"
+)
+
+// SignatureDetails describes the verification of the signature of a multipart/signed entity.
+type SignatureDetails struct {
+	// MicAlg is the micalg parameter of the multipart.
+	MicAlg string
+	// Hash is the hash algorithm used by the signature.
+	Hash crypto.Hash
+	// Err is the reason why the signature has been rejected, or nil if it is valid.
+	Err error
 }
 
 // MimeMediaType describes a Media Type with associated parameters
@@ -62,36 +128,54 @@ func (entity *MimeEntity) GetSender() string {
 type GpgUtility interface {
 	CheckMessageSignature(message io.Reader, signature io.Reader, checkedSignerKey gpg.Key) error
 	ReadKey(r io.Reader) (gpg.Key, error)
+	ReadKeyRing(r io.Reader) ([]gpg.Key, error)
+	FindSigner(keys []gpg.Key, signature io.Reader) (gpg.Key, error)
+	VerifyInlineMessage(message io.Reader, keys []gpg.Key) (gpg.Key, []byte, error)
+	CheckKey(key gpg.Key) gpg.KeyReport
 	EncryptMessage(output io.Writer, recipient gpg.Key) (plaintext io.WriteCloser, err error)
-	DecryptMessage(message io.Reader) (result io.Reader, err error)
-	DecryptSignedMessage(message io.Reader, output io.Writer, signerKey gpg.Key) error
+	DecryptPackets(message io.Reader) ([]byte, error)
+	ReadDecryptedMessage(packets []byte, keys []gpg.Key) (*gpg.DecryptedMessage, error)
 	ServerIdentity() string
 }
 
+// KeyLookup provides the keys certified by the server by the IDs of their primary keys and subkeys.
+type KeyLookup interface {
+	GetKey(keyID uint64) gpg.Key
+}
+
 // Parser parses MIME mails.
 type Parser struct {
 	Gpg GpgUtility
+
+	// Keys is used to find the signer key of signed mails without attached key, unless it is nil.
+	Keys KeyLookup
+
+	// header is the header of the mail being parsed, which may advertise the key of the sender in an Autocrypt header.
+	header textproto.MIMEHeader
 }
 
 // ParseMail returns a MimeEntity containing the parsed form of the input email
 func (parser *Parser) ParseMail(mailReader io.Reader) (*MimeEntity, error) {
 	mailInput, err := ioutil.ReadAll(mailReader)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read mail input: %s", err)
+		return nil, fmt.Errorf("cannot read mail input: %w", err)
 	}
 	mailInput = parser.normalizeNewLines(mailInput)
 
 	message, err := mail.ReadMessage(bytes.NewReader(mailInput))
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse mail input: %s", err)
+		return nil, fmt.Errorf("cannot parse mail input: %w", err)
 	}
-	entity, err := parser.parseEntity(textproto.MIMEHeader(message.Header), message.Body)
+	mailParser := *parser
+	mailParser.header = textproto.MIMEHeader(message.Header)
+	entity, err := mailParser.parseEntity(mailParser.header, message.Body)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse entity: %s", err)
+		return nil, fmt.Errorf("cannot parse entity: %w", err)
 	}
 	if entity == nil {
 		return nil, errors.New("cannot parse entity, mail format not supported")
 	}
+	mailParser.verifyInlineSignatures(entity)
 	return entity, nil
 }
 
@@ -114,22 +198,52 @@ func getMimeMediaType(header textproto.MIMEHeader, key string) MimeMediaType {
 }
 
 func (parser *Parser) parseEntity(header textproto.MIMEHeader, body io.Reader) (*MimeEntity, error) {
+	body, err := decodeTransferEncoding(header, body)
+	if err != nil {
+		return nil, err
+	}
 	contentType := getMimeMediaType(header, "Content-Type")
 	contentDisposition := getMimeMediaType(header, "Content-Disposition")
 	switch true {
-	case contentDisposition.Value == "attachment" || contentDisposition.Value == "inline":
-		return parser.createAttachment(contentDisposition, header, body)
 	case contentType.Value == "multipart/signed":
 		return parser.parseMultipartSigned(contentType, header, body)
 	case contentType.Value == "multipart/encrypted":
 		return parser.parseMultipartEncrypted(contentType, header, body)
 	case strings.HasPrefix(contentType.Value, "multipart/"):
 		return parser.parseMultipart(contentType, header, body)
+	case isAttachment(contentType, contentDisposition):
+		return parser.createAttachment(contentDisposition, header, body)
 	default:
 		return parser.parseText(contentType, header, body)
 	}
 }
 
+// isAttachment returns true for parts disposed as attachment and for parts, which are no text. Some clients send
+// signatures and keys without disposition, others mark every part including texts and multiparts as inline.
+func isAttachment(contentType, contentDisposition MimeMediaType) bool {
+	if contentDisposition.Value == "attachment" {
+		return true
+	}
+	return contentType.Value != "" && !strings.HasPrefix(contentType.Value, "text/")
+}
+
+// decodeTransferEncoding returns a reader decoding the body according to its Content-Transfer-Encoding header. Parts
+// of multiparts, whose quoted-printable encoding has already been decoded by the multipart reader, no longer carry the
+// header.
+func decodeTransferEncoding(header textproto.MIMEHeader, body io.Reader) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	switch encoding {
+	case "", "7bit", "8bit", "binary":
+		return body, nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(body), nil
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Transfer-Encoding %s", encoding)
+	}
+}
+
 func (parser *Parser) parseText(contentType MimeMediaType, header textproto.MIMEHeader,
 	body io.Reader) (*MimeEntity, error) {
 	var err error
@@ -137,20 +251,243 @@ func (parser *Parser) parseText(contentType MimeMediaType, header textproto.MIME
 	if ok {
 		body, err = charset.NewReaderLabel(charsetLabel, body)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot read content %s %s: %s", contentType.Value, charsetLabel, err)
+			return nil, fmt.Errorf("Cannot read content %s %s: %w", contentType.Value, charsetLabel, err)
 		}
 	}
 	content, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read content body %s %s: %s", contentType.Value, charsetLabel, err)
+		return nil, fmt.Errorf("Cannot read content body %s %s: %w", contentType.Value, charsetLabel, err)
 	}
 
-	return &MimeEntity{
+	entity := &MimeEntity{
 		Header:       header,
 		Content:      content,
 		Parts:        nil,
 		IsAttachment: false,
-		SignedBy:     nil}, nil
+		SignedBy:     nil}
+	// Inline signatures are checked by verifyInlineSignatures, once the keys sent with the whole mail are known.
+	return entity, nil
+}
+
+// Markers of inline PGP messages and of public keys pasted into texts.
+const (
+	clearSignedHeader    = "-----BEGIN PGP SIGNED MESSAGE-----"
+	armoredMessageHeader = "-----BEGIN PGP MESSAGE-----"
+	publicKeyHeader      = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	publicKeyFooter      = "-----END PGP PUBLIC KEY BLOCK-----"
+)
+
+// dashEscape matches the dash-escaping of lines in clear-signed texts (RFC 4880, section 7.1).
+var dashEscape = regexp.MustCompile("(?m)^- ")
+
+// isPlainText returns true for text/plain parts and for parts without content type, which default to it.
+func isPlainText(contentType MimeMediaType) bool {
+	return contentType.Value == "" || contentType.Value == "text/plain"
+}
+
+// hasInlineSignature returns true if the content contains a clear-signed or an armored PGP message.
+func hasInlineSignature(content []byte) bool {
+	return bytes.Contains(content, []byte(clearSignedHeader)) || bytes.Contains(content, []byte(armoredMessageHeader))
+}
+
+// inlineKeys returns the armored public keys pasted into the content, including keys dash-escaped within clear-signed
+// text.
+func inlineKeys(content []byte) []byte {
+	content = dashEscape.ReplaceAll(content, nil)
+	keys := new(bytes.Buffer)
+	for {
+		start := bytes.Index(content, []byte(publicKeyHeader))
+		if start == -1 {
+			return keys.Bytes()
+		}
+		end := bytes.Index(content[start:], []byte(publicKeyFooter))
+		if end == -1 {
+			return keys.Bytes()
+		}
+		end += start + len(publicKeyFooter)
+		keys.Write(content[start:end])
+		keys.WriteString("\r\n")
+		content = content[end:]
+	}
+}
+
+// verifyInlineSignatures checks the inline signatures of the text parts of entity, which are not signed yet, with the
+// keys sent with the entity as returned by findKeys, or if there are none, with the certified key of the issuer. A
+// multipart is only marked as signed if all of its text parts are signed by the same key.
+func (parser *Parser) verifyInlineSignatures(entity *MimeEntity) {
+	keyData, source := parser.findKeys(entity)
+	var keys []gpg.Key
+	if keyData != nil {
+		var err error
+		if keys, err = parser.Gpg.ReadKeyRing(bytes.NewReader(keyData)); err != nil {
+			log.Printf("Cannot read %s keys of inline signed text: %s\n", source, err)
+			return
+		}
+	}
+	parser.verifyInlineParts(entity, keys, source)
+}
+
+func (parser *Parser) verifyInlineParts(entity *MimeEntity, keys []gpg.Key, source KeySource) {
+	if entity.SignedBy != nil || entity.IsAttachment {
+		return
+	}
+	if entity.Parts == nil {
+		if !isPlainText(getMimeMediaType(entity.Header, "Content-Type")) || !hasInlineSignature(entity.Content) {
+			return
+		}
+		if keys == nil {
+			parser.verifyCertifiedInlineSignature(entity)
+		} else {
+			parser.verifyInlineSignature(entity, keys, source)
+		}
+		return
+	}
+
+	var signedBy gpg.Key
+	var signedBySource KeySource
+	allSigned := true
+	for i := range entity.Parts {
+		part := &entity.Parts[i]
+		parser.verifyInlineParts(part, keys, source)
+		if part.SignedBy == nil {
+			allSigned = allSigned && !part.containsText()
+		} else if signedBy == nil {
+			signedBy, signedBySource = part.SignedBy, part.KeySource
+		} else if !bytes.Equal(signedBy.PrimaryKey.Fingerprint, part.SignedBy.PrimaryKey.Fingerprint) {
+			allSigned = false
+		}
+	}
+	if allSigned && signedBy != nil {
+		entity.SignedBy = signedBy
+		entity.KeySource = signedBySource
+	}
+}
+
+// verifyCertifiedInlineSignature checks the inline signature of the text entity with the certified key of its issuer,
+// unless the parser has no certified keys.
+func (parser *Parser) verifyCertifiedInlineSignature(entity *MimeEntity) {
+	if parser.Keys == nil {
+		return
+	}
+	keyID, err := gpg.InlineSignatureIssuer(bytes.NewReader(entity.Content))
+	if err != nil {
+		log.Printf("Cannot read issuer of inline signed text: %s\n", err)
+		return
+	}
+	signerKey, err := parser.certifiedKey(keyID)
+	if err != nil {
+		log.Printf("Inline signed text has no valid signature, because: %s\n", err)
+		return
+	}
+	parser.verifyInlineSignature(entity, []gpg.Key{signerKey}, KeySourceCertified)
+}
+
+// verifyInlineSignature checks the inline signature of the text entity with the given keys, which have been found in
+// source. If the signature is valid, the entity is marked as signed and its content is replaced by the signed text.
+func (parser *Parser) verifyInlineSignature(entity *MimeEntity, keys []gpg.Key, source KeySource) {
+	signerKey, content, err := parser.Gpg.VerifyInlineMessage(bytes.NewReader(entity.Content), keys)
+	if err != nil {
+		log.Printf("Inline signed text has no valid signature with %s keys, because: %s\n", source, err)
+		return
+	}
+	entity.Content = content
+	entity.SignedBy = signerKey
+	entity.KeySource = source
+}
+
+// containsText returns true if the entity is or contains a text/plain part, which is not an attachment.
+func (entity *MimeEntity) containsText() bool {
+	if entity.IsAttachment {
+		return false
+	}
+	if entity.Parts == nil {
+		return isPlainText(getMimeMediaType(entity.Header, "Content-Type"))
+	}
+	for i := range entity.Parts {
+		if entity.Parts[i].containsText() {
+			return true
+		}
+	}
+	return false
+}
+
+// findKeys returns the armored or binary keys sent with the entity together with their source. These are the keys
+// attached to the entity, or else the key advertised for the sender in the Autocrypt header of the mail, or else the
+// keys pasted into the texts of the entity.
+func (parser *Parser) findKeys(entity *MimeEntity) ([]byte, KeySource) {
+	if keys := entity.findAttachmentOrNil("application/pgp-keys"); keys != nil {
+		return keys, KeySourceAttached
+	}
+	if keys := parser.autocryptKey(); keys != nil {
+		return keys, KeySourceAutocrypt
+	}
+	if keys := entity.pastedKeys(); len(keys) > 0 {
+		return keys, KeySourcePasted
+	}
+	return nil, KeySourceNone
+}
+
+// autocryptKey returns the key data of the Autocrypt header of the mail, whose addr matches the sender address, or nil
+// if there is no such header.
+func (parser *Parser) autocryptKey() []byte {
+	from, err := mail.ParseAddress(parser.header.Get("From"))
+	if err != nil {
+		return nil
+	}
+	for _, value := range parser.header["Autocrypt"] {
+		attributes := parseAutocryptHeader(value)
+		if attributes == nil || !strings.EqualFold(attributes["addr"], from.Address) {
+			continue
+		}
+		keyData, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(attributes["keydata"]), ""))
+		if err != nil || len(keyData) == 0 {
+			log.Printf("Ignoring Autocrypt header of %s with invalid keydata: %v\n", from.Address, err)
+			continue
+		}
+		return keyData
+	}
+	return nil
+}
+
+// parseAutocryptHeader returns the attributes of an Autocrypt header. As required by the Autocrypt specification, it
+// returns nil if the header has an unknown attribute, whose name does not start with an underscore.
+func parseAutocryptHeader(value string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(value, ";") {
+		if strings.TrimSpace(attribute) == "" {
+			continue
+		}
+		nameAndValue := strings.SplitN(attribute, "=", 2)
+		if len(nameAndValue) != 2 {
+			return nil
+		}
+		name := strings.TrimSpace(nameAndValue[0])
+		switch {
+		case name == "addr" || name == "keydata" || name == "prefer-encrypt" || strings.HasPrefix(name, "_"):
+			attributes[name] = strings.TrimSpace(nameAndValue[1])
+		default:
+			return nil
+		}
+	}
+	return attributes
+}
+
+// pastedKeys returns the armored keys pasted into the texts of the entity.
+func (entity *MimeEntity) pastedKeys() []byte {
+	if entity.IsAttachment {
+		return nil
+	}
+	if entity.Parts == nil {
+		if !isPlainText(getMimeMediaType(entity.Header, "Content-Type")) {
+			return nil
+		}
+		return inlineKeys(entity.Content)
+	}
+	var keys []byte
+	for i := range entity.Parts {
+		keys = append(keys, entity.Parts[i].pastedKeys()...)
+	}
+	return keys
 }
 
 func (parser *Parser) parseMultipart(contentType MimeMediaType, header textproto.MIMEHeader,
@@ -158,7 +495,8 @@ func (parser *Parser) parseMultipart(contentType MimeMediaType, header textproto
 	// TODO #9 Error handling.
 	boundary, ok := contentType.Params["boundary"]
 	if !ok {
-		return nil, fmt.Errorf("multipart mail with type %s has no boundary specified", contentType.Value)
+		return nil, fmt.Errorf("%w: multipart mail with type %s has no boundary specified", ErrMissingBoundary,
+			contentType.Value)
 	}
 	result := MimeEntity{
 		Header:       header,
@@ -172,13 +510,13 @@ func (parser *Parser) parseMultipart(contentType MimeMediaType, header textproto
 		part, err := reader.NextPart()
 		if err != nil {
 			if err != io.EOF {
-				return nil, fmt.Errorf("Cannot read %s %s: %s", contentType.Value, boundary, err)
+				return nil, fmt.Errorf("Cannot read %s %s: %w", contentType.Value, boundary, err)
 			}
 			return &result, nil
 		}
 		entity, err := parser.parseEntity(part.Header, part)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot parse entity from \"%s\" \"%s\": %s", contentType.Value, boundary, err)
+			return nil, fmt.Errorf("Cannot parse entity from \"%s\" \"%s\": %w", contentType.Value, boundary, err)
 		}
 		if entity != nil {
 			result.Parts = append(result.Parts, *entity)
@@ -189,53 +527,50 @@ func (parser *Parser) parseMultipart(contentType MimeMediaType, header textproto
 func (parser *Parser) parseMultipartSigned(contentType MimeMediaType, header textproto.MIMEHeader,
 	body io.Reader) (*MimeEntity, error) {
 	entity, signerKey, err := parser.parseMultipartSignedWithError(contentType, header, body)
-
-	if entity != nil {
-		if err != nil {
-			log.Printf("Entity has no valid signature, because: %s\n", err)
-		} else {
-			entity.SignedBy = signerKey
-		}
-
-		return entity, nil
+	if entity == nil {
+		return nil, fmt.Errorf("Multipart could not be parsed: %w", err)
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("Multipart could not be parsed: %s", err)
+		log.Printf("Entity has no valid signature, because: %s\n", err)
+		if entity.Signature != nil {
+			entity.Signature.Err = err
+		}
+	} else {
+		entity.SignedBy = signerKey
 	}
 
-	panic("Unreachable")
+	return entity, nil
 }
 
 // Check and parse a signed multipart message according to RFC 3156:
-// """
-//  The multipart/signed body MUST consist of exactly two parts.  The
-//  first part contains the signed data in MIME canonical format,
-//  including a set of appropriate content headers describing the data.
 //
-//  The second body MUST contain the OpenPGP digital signature.  It MUST
-//  be labeled with a content type of "application/pgp-signature".
-// """
+//	The multipart/signed body MUST consist of exactly two parts.  The
+//	first part contains the signed data in MIME canonical format,
+//	including a set of appropriate content headers describing the data.
+//
+//	The second body MUST contain the OpenPGP digital signature.  It MUST
+//	be labeled with a content type of "application/pgp-signature".
 //
 // Returns no error, if the signature could be verified.
 //
 // If an error is returned, the returned entity might either be:
 //   - ´nil´: if the multipart could not be parsed at all. // TODO #9 Is this a practical criterion?
 //   - inconsistent: In this case, the caller is responsible to discard or correct the returned entity.
-//
 func (parser *Parser) parseMultipartSignedWithError(contentType MimeMediaType, header textproto.MIMEHeader,
 	body io.Reader) (*MimeEntity, gpg.Key, error) {
 
-	_, ok := contentType.Params["micalg"] // TODO #9 How to validate mic algorithm?
+	micAlg, ok := contentType.Params["micalg"]
 	if !ok {
 		return nil, nil, errors.New("multipart/signed mail must specify micalg parameter")
 	}
 
+	// The signed part is taken from the raw body, as the signature covers it before any transfer decoding of its parts.
 	buffer := new(bytes.Buffer)
 	teeReader := io.TeeReader(body, buffer)
 	result, err := parser.parseMultipart(contentType, header, teeReader)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Cannot parse multipart: %s", err)
+		return nil, nil, fmt.Errorf("Cannot parse multipart: %w", err)
 	}
 
 	if len(result.Parts) != 2 {
@@ -244,45 +579,122 @@ func (parser *Parser) parseMultipartSignedWithError(contentType MimeMediaType, h
 
 	boundary, ok := contentType.Params["boundary"]
 	if !ok {
-		panic("Unreachable, because missing boundary parameter has to be checked before")
+		return result, nil, ErrMissingBoundary
 	}
 
-	signedPart := parser.findSignedPart(buffer.Bytes(), boundary)
+	signedPart, err := parser.findSignedPart(buffer.Bytes(), boundary)
+	if err != nil {
+		return result, nil, err
+	}
 
 	signature, err := parser.parseMultipartSignature(result)
 	if err != nil {
-		return result, nil, fmt.Errorf("Cannot parse signature: %s", err)
+		return result, nil, fmt.Errorf("Cannot parse signature: %w", err)
+	}
+
+	hash, err := gpg.SignatureHash(bytes.NewReader(signature))
+	if err != nil {
+		return result, nil, fmt.Errorf("Cannot read signature hash algorithm: %w", err)
+	}
+	result.Signature = &SignatureDetails{MicAlg: micAlg, Hash: hash}
+	err = checkMicAlg(micAlg, hash)
+	if err != nil {
+		return result, nil, err
 	}
 
-	signerKey, err := parser.parseMultipartSignerKey(result)
+	signerKey, keySource, err := parser.parseMultipartSignerKey(result, signature)
 	if err != nil {
-		return result, nil, fmt.Errorf("Cannot parse signer key: %s", err)
+		return result, nil, fmt.Errorf("Cannot parse signer key: %w", err)
 	}
 
 	err = parser.Gpg.CheckMessageSignature(bytes.NewReader(signedPart), bytes.NewReader(signature), signerKey)
 	if err != nil {
-		log.Printf("DEBUG: Error in CheckMessageSignature for primary key with ID %s and identities %+v\n",
-			signerKey.PrimaryKey.KeyIdString(), reflect.ValueOf(signerKey.Identities).MapKeys())
-		return result, nil, fmt.Errorf("Cannot verify message signature: %s", err)
+		return result, nil, fmt.Errorf("Cannot verify message signature of %s key %s: %w", keySource,
+			signerKey.PrimaryKey.KeyIdString(), err)
 	}
 
+	result.KeySource = keySource
 	return result, signerKey, nil
 }
 
-func (parser *Parser) parseMultipartSignerKey(multipart *MimeEntity) (gpg.Key, error) {
-	signerKeyAttachment, err := multipart.FindAttachment("application/pgp-keys")
+// checkMicAlg returns ErrWeakHash if the signature hash algorithm is not accepted and ErrMicAlgMismatch if the micalg
+// parameter names another algorithm.
+func checkMicAlg(micAlg string, hash crypto.Hash) error {
+	if weakHashes[hash] {
+		return fmt.Errorf("%w: %s", ErrWeakHash, hash)
+	}
+	expected, ok := micAlgHashes[strings.ToLower(micAlg)]
+	if !ok || expected != hash {
+		return fmt.Errorf("%w: micalg is %s, but the signature uses %s", ErrMicAlgMismatch, micAlg, hash)
+	}
+	return nil
+}
+
+// parseMultipartSignerKey returns the key, which made the signature, and its source. The key is searched among the keys
+// sent with the multipart, or if there are none, among the keys certified before.
+func (parser *Parser) parseMultipartSignerKey(multipart *MimeEntity, signature []byte) (gpg.Key, KeySource, error) {
+	keyData, source := parser.findKeys(multipart)
+	if keyData == nil && parser.Keys != nil {
+		signerKey, err := parser.lookupSignerKey(signature)
+		return signerKey, KeySourceCertified, err
+	}
+
+	keys, err := parser.readKeys(keyData, source)
+	if err != nil {
+		return nil, source, err
+	}
+
+	signerKey, err := parser.Gpg.FindSigner(keys, bytes.NewReader(signature))
 	if err != nil {
-		return nil, fmt.Errorf("Cannot find attachment: %s", err)
+		return nil, source, fmt.Errorf("Cannot find signer among %s keys %s: %w", source, keyIDs(keys), err)
 	}
 
-	signerKey, err := parser.Gpg.ReadKey(bytes.NewReader(signerKeyAttachment))
+	return signerKey, source, nil
+}
+
+// lookupSignerKey returns the certified key, which issued the signature.
+func (parser *Parser) lookupSignerKey(signature []byte) (gpg.Key, error) {
+	keyID, err := gpg.SignatureIssuer(bytes.NewReader(signature))
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read key: %s", err)
+		return nil, fmt.Errorf("Cannot read signature issuer: %w", err)
+	}
+
+	return parser.certifiedKey(keyID)
+}
+
+// certifiedKey returns the certified key with the given key ID.
+func (parser *Parser) certifiedKey(keyID uint64) (gpg.Key, error) {
+	signerKey := parser.Keys.GetKey(keyID)
+	if signerKey == nil {
+		return nil, fmt.Errorf("%w and key %016X not certified before", ErrNoSignerKey, keyID)
 	}
 
 	return signerKey, nil
 }
 
+// readKeys reads the keys found in source.
+func (parser *Parser) readKeys(keyData []byte, source KeySource) ([]gpg.Key, error) {
+	if keyData == nil {
+		return nil, ErrNoSignerKey
+	}
+
+	keys, err := parser.Gpg.ReadKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %s key: %w", source, err)
+	}
+
+	return keys, nil
+}
+
+// keyIDs returns the comma-separated key IDs of the given keys.
+func keyIDs(keys []gpg.Key) string {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.PrimaryKey.KeyIdString()
+	}
+	return strings.Join(ids, ", ")
+}
+
 func (parser *Parser) parseMultipartSignature(multipart *MimeEntity) ([]byte, error) {
 	signatureContentType := getMimeMediaType(multipart.Parts[1].Header, "Content-Type")
 	if signatureContentType.Value != "application/pgp-signature" {
@@ -291,24 +703,26 @@ func (parser *Parser) parseMultipartSignature(multipart *MimeEntity) ([]byte, er
 
 	signature, err := multipart.FindAttachment("application/pgp-signature")
 	if err != nil {
-		return nil, fmt.Errorf("cannot find attachment: %s", err)
+		return nil, fmt.Errorf("cannot find attachment: %w", err)
 	}
 
 	return signature, err
 }
 
-func (parser *Parser) findSignedPart(data []byte, boundary string) []byte { // TODO #9 error handling
+// findSignedPart returns the first part of the raw multipart/signed body in canonical form. It returns
+// ErrMalformedSignedPart if the part is not delimited by the boundary.
+func (parser *Parser) findSignedPart(data []byte, boundary string) ([]byte, error) {
 	delimiter := []byte("--" + boundary + "\r\n")
 	startOfSignedPart := bytes.Index(data, delimiter)
 	if startOfSignedPart == -1 {
-		panic("Did not find start of signed part")
+		return nil, fmt.Errorf("%w: did not find start of signed part", ErrMalformedSignedPart)
 	}
 	startOfSignedPart += len(delimiter)
 
 	delimiter = []byte("\r\n--" + boundary)
 	endOfSignedPart := bytes.Index(data[startOfSignedPart:], delimiter)
 	if endOfSignedPart == -1 {
-		panic("Did not find end of signed part")
+		return nil, fmt.Errorf("%w: did not find end of signed part", ErrMalformedSignedPart)
 	}
 	endOfSignedPart += startOfSignedPart // add correct offset
 
@@ -316,14 +730,14 @@ func (parser *Parser) findSignedPart(data []byte, boundary string) []byte { // T
 	index := regex.FindIndex(data[startOfSignedPart:endOfSignedPart]) // don't include trailing \r\n
 	endOfSignedPart = startOfSignedPart + index[0]
 
-	return append(data[startOfSignedPart:endOfSignedPart], []byte("\r\n")...)
+	return append(data[startOfSignedPart:endOfSignedPart], []byte("\r\n")...), nil
 }
 
 func (parser *Parser) createAttachment(contentDisposition MimeMediaType, header textproto.MIMEHeader,
 	body io.Reader) (*MimeEntity, error) {
 	data, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read body: %s", err)
+		return nil, fmt.Errorf("cannot read body: %w", err)
 	}
 	return &MimeEntity{
 		Header:       header,
@@ -362,45 +776,124 @@ func (entity *MimeEntity) findAttachmentOrNil(mimeType string) []byte {
 
 func (parser *Parser) parseMultipartEncrypted(contentType MimeMediaType, header textproto.MIMEHeader,
 	bodyReader io.Reader) (*MimeEntity, error) {
-	bodyBytes, err := ioutil.ReadAll(bodyReader)
+	encrypted, err := parser.encryptedPayload(contentType, header, bodyReader)
 	if err != nil {
-		return nil, fmt.Errorf("%s", err)
+		return nil, fmt.Errorf("could not decrypt message: %w", err)
 	}
-	decryptedMessage, err := parser.parseMultipartEncryptedWithError(contentType, header, bytes.NewReader(bodyBytes), nil)
+	packets, err := parser.Gpg.DecryptPackets(bytes.NewReader(encrypted))
 	if err != nil {
-		return nil, fmt.Errorf("could not decrypt message: %s", err)
+		return nil, fmt.Errorf("could not decrypt message: cannot decrypt message: %w", err)
 	}
-	message, err := mail.ReadMessage(bytes.NewReader(decryptedMessage))
+	decrypted, err := parser.Gpg.ReadDecryptedMessage(packets, nil)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse mail input: %s", err)
+		return nil, fmt.Errorf("could not decrypt message: cannot read decrypted message: %w", err)
 	}
-	entity, err := parser.parseEntity(textproto.MIMEHeader(message.Header), message.Body)
+	message, err := mail.ReadMessage(bytes.NewReader(decrypted.Body))
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse entity: %s", err)
+		return nil, fmt.Errorf("cannot parse mail input: %w", err)
 	}
-	signerKey, err := parser.parseMultipartSignerKey(entity)
+	entity, err := parser.parseEntity(textproto.MIMEHeader(message.Header), message.Body)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse signer key: %s", err)
+		return nil, fmt.Errorf("cannot parse entity: %w", err)
 	}
-	_, err = parser.parseMultipartEncryptedWithError(contentType, header, bytes.NewReader(bodyBytes), signerKey)
+	entity.Header = protectedHeader(header, entity)
+	parser.verifyInlineSignatures(entity)
+	// An encrypted message, which is not signed itself, may contain a signed part, e.g. a multipart/signed. The
+	// signature of the encrypted message takes precedence, so that a signed part cannot make up for an invalid one.
+	signerKey, keySource, err := parser.verifyEncryptedSignature(packets, decrypted, entity)
 	if err != nil {
-		return nil, fmt.Errorf("could not verify message: %s", err)
+		if !decrypted.IsSigned && entity.SignedBy != nil {
+			return entity, nil
+		}
+		return nil, err
 	}
 	entity.SignedBy = signerKey
+	entity.KeySource = keySource
 	return entity, nil
 }
 
-// Check and parse an encrypted multipart message according to RFC 3156
-func (parser *Parser) parseMultipartEncryptedWithError(contentType MimeMediaType, header textproto.MIMEHeader,
-	body io.Reader, signerKey gpg.Key) ([]byte, error) {
+// protectedHeader returns the header of the decrypted entity of an encrypted mail with the given outer header. If the
+// root part of the decrypted payload declares protected headers as proposed in the RFC draft for protected headers,
+// its header fields replace those of the outer header. The content header fields are those of the decrypted entity.
+func protectedHeader(outer textproto.MIMEHeader, decrypted *MimeEntity) textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+	for name, values := range outer {
+		if !isContentHeader(name) {
+			header[name] = values
+		}
+	}
+
+	// The payload of a signed and encrypted mail may be a multipart/signed, whose signed part carries the headers.
+	payload := decrypted
+	if getMimeMediaType(decrypted.Header, "Content-Type").Value == "multipart/signed" && len(decrypted.Parts) > 0 {
+		payload = &decrypted.Parts[0]
+	}
+	if getMimeMediaType(payload.Header, "Content-Type").Params["protected-headers"] == "v1" {
+		for name, values := range payload.Header {
+			if !isContentHeader(name) {
+				header[name] = values
+			}
+		}
+	}
+
+	for name, values := range decrypted.Header {
+		if isContentHeader(name) {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+// isContentHeader returns true for the header fields describing the content of a MIME entity.
+func isContentHeader(name string) bool {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	return strings.HasPrefix(name, "Content-") || name == "Mime-Version"
+}
+
+// verifyEncryptedSignature returns the key among the keys sent with the decrypted entity, or if there are none, among
+// the keys certified before, which made the signature embedded in the encrypted message, and the source of the key.
+// The packets of the message are only read again, once the keys are known, so that the message is decrypted only once.
+func (parser *Parser) verifyEncryptedSignature(packets []byte, decrypted *gpg.DecryptedMessage,
+	entity *MimeEntity) (gpg.Key, KeySource, error) {
+	keyData, source := parser.findKeys(entity)
+	if !decrypted.IsSigned {
+		return nil, source, fmt.Errorf("could not verify message: %w", gpg.ErrMessageNotSigned)
+	}
+	var keys []gpg.Key
+	var err error
+	if keyData == nil && parser.Keys != nil {
+		source = KeySourceCertified
+		var signerKey gpg.Key
+		if signerKey, err = parser.certifiedKey(decrypted.SignedByKeyID); err == nil {
+			keys = []gpg.Key{signerKey}
+		}
+	} else {
+		keys, err = parser.readKeys(keyData, source)
+	}
+	if err != nil {
+		return nil, source, fmt.Errorf("cannot parse signer key: %w", err)
+	}
+	verified, err := parser.Gpg.ReadDecryptedMessage(packets, keys)
+	if err == nil && verified.SignedBy == nil {
+		err = fmt.Errorf("signer %016X not found: %w", decrypted.SignedByKeyID, gpg.ErrUnknownIssuer)
+	}
+	if err != nil {
+		return nil, source, fmt.Errorf("could not verify message with %s keys %s: %w", source, keyIDs(keys), err)
+	}
+	return verified.SignedBy, source, nil
+}
 
+// encryptedPayload checks the structure of an encrypted multipart message according to RFC 3156 and returns the
+// armored encrypted message of its second part.
+func (parser *Parser) encryptedPayload(contentType MimeMediaType, header textproto.MIMEHeader,
+	body io.Reader) ([]byte, error) {
 	if contentType.Params["protocol"] != "application/pgp-encrypted" {
 		return nil, errors.New("multipart/encrypted mail protocol must be application/pgp-encrypted")
 	}
 
 	result, err := parser.parseMultipart(contentType, header, body)
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse multipart: %s", err)
+		return nil, fmt.Errorf("cannot parse multipart: %w", err)
 	}
 
 	if len(result.Parts) != 2 {
@@ -419,34 +912,5 @@ func (parser *Parser) parseMultipartEncryptedWithError(contentType MimeMediaType
 		return nil, errors.New("content of second multipart/encrypted part must be an attachment")
 	}
 
-	v := []byte(strings.TrimSpace(string(result.Parts[1].Content)))
-	if signerKey == nil {
-		return parser.onlyDecryptMessage(v)
-	}
-	return parser.decryptAndVerifyMessage(v, signerKey)
-}
-
-func (parser *Parser) onlyDecryptMessage(crypted []byte) ([]byte, error) {
-	decryptedReader, err := parser.Gpg.DecryptMessage(bytes.NewReader(crypted))
-	if err != nil {
-		return nil, fmt.Errorf("cannot decrypt message: %s", err)
-	}
-
-	message, err := ioutil.ReadAll(decryptedReader)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read decrypted message: %s", err)
-	}
-
-	return message, nil
-}
-
-func (parser *Parser) decryptAndVerifyMessage(crypted []byte, signerKey gpg.Key) ([]byte, error) {
-	// Verify crypted insteaed if senderKey is present
-	buf := new(bytes.Buffer)
-	err := parser.Gpg.DecryptSignedMessage(bytes.NewReader(crypted), buf, signerKey)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot decrypt message: %s", err)
-	}
-	return buf.Bytes(), nil
-
+	return []byte(strings.TrimSpace(string(result.Parts[1].Content))), nil
 }
@@ -2,15 +2,20 @@ package mail
 
 import (
 	"bytes"
+	"crypto"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/TNG/openpgp-validation-server/gpg"
 	"github.com/TNG/openpgp-validation-server/test/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/crypto/openpgp"
 	"io"
 	"io/ioutil"
 	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -20,7 +25,7 @@ func parseMailFromString(t *testing.T, source string) *MimeEntity {
 }
 
 func parseMailFromStringWithGpg(t *testing.T, source string, gpg GpgUtility) *MimeEntity {
-	parser := Parser{gpg}
+	parser := Parser{Gpg: gpg}
 	reader := strings.NewReader(source)
 	entity, err := parser.ParseMail(reader)
 	assert.NoError(t, err, "Unexpected error in ParseMail!")
@@ -41,7 +46,7 @@ func parseMailFromFile(t *testing.T, fileName string) *MimeEntity {
 
 func parseMailFromFileWithGpg(t *testing.T, fileName string, gpg GpgUtility) *MimeEntity {
 	data := loadTestMail(t, fileName)
-	parser := Parser{gpg}
+	parser := Parser{Gpg: gpg}
 	entity, err := parser.ParseMail(bytes.NewReader(data))
 	require.NoError(t, err, "Unexpected error in ParseMail!")
 	return entity
@@ -162,7 +167,7 @@ func TestParseMultipartWithoutBoundary(t *testing.T) {
 	header := textproto.MIMEHeader{}
 	text := createMultipart("frontier").withPart("text/plain", "Hello world!", nil).build()
 	entity, err := parser.parseMultipart(contentType, header, strings.NewReader(text))
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrMissingBoundary))
 	assert.Nil(t, entity)
 }
 
@@ -235,15 +240,32 @@ func (mockGpg *MockGpg) ReadKey(r io.Reader) (gpg.Key, error) {
 	return openpgp.NewEntity("mock", "", "mock@server.local", nil)
 }
 
+func (mockGpg *MockGpg) ReadKeyRing(r io.Reader) ([]gpg.Key, error) {
+	key, err := mockGpg.ReadKey(r)
+	return []gpg.Key{key}, err
+}
+
+func (mockGpg *MockGpg) FindSigner(keys []gpg.Key, signature io.Reader) (gpg.Key, error) {
+	return keys[0], nil
+}
+
+func (mockGpg *MockGpg) VerifyInlineMessage(message io.Reader, keys []gpg.Key) (gpg.Key, []byte, error) {
+	panic("Don't call me here!")
+}
+
+func (mockGpg *MockGpg) CheckKey(key gpg.Key) gpg.KeyReport {
+	return gpg.KeyReport{}
+}
+
 func (mockGpg *MockGpg) EncryptMessage(output io.Writer, recipientKey gpg.Key) (plaintext io.WriteCloser, err error) {
 	panic("Don't call me here!")
 }
 
-func (mockGpg *MockGpg) DecryptMessage(message io.Reader) (result io.Reader, err error) {
+func (mockGpg *MockGpg) DecryptPackets(message io.Reader) ([]byte, error) {
 	panic("Don't call me here!")
 }
 
-func (mockGpg *MockGpg) DecryptSignedMessage(message io.Reader, output io.Writer, signerKey gpg.Key) error {
+func (mockGpg *MockGpg) ReadDecryptedMessage(packets []byte, keys []gpg.Key) (*gpg.DecryptedMessage, error) {
 	panic("Don't call me here!")
 }
 
@@ -253,11 +275,6 @@ func TestParseMultipartSigned(t *testing.T) {
 		withAttachment("application/pgp-keys", "KEYS").
 		build()
 
-	text := createMultipart("frontier").
-		withPart("multipart/mixed; boundary=\"innerBoundary\"", innerText, nil).
-		withAttachment("application/pgp-signature", "SIGNATURE").
-		build()
-	t.Log(text)
 	expectedSignedPart := "Content-Type: multipart/mixed; boundary=\"innerBoundary\"\r\n" +
 		"\r\n" +
 		"--innerBoundary\r\n" +
@@ -270,15 +287,52 @@ func TestParseMultipartSigned(t *testing.T) {
 		"\r\n" +
 		"KEYS\r\n" +
 		"--innerBoundary--\r\n"
-	mockGpg := &MockGpg{t, expectedSignedPart, "SIGNATURE", false}
-	parser := Parser{mockGpg}
-	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha1"}}
+	signature := clientSignature(t, expectedSignedPart)
+	text := createMultipart("frontier").
+		withPart("multipart/mixed; boundary=\"innerBoundary\"", innerText, nil).
+		withAttachment("application/pgp-signature", signature).
+		build()
+	t.Log(text)
+	mockGpg := &MockGpg{t, expectedSignedPart, signature, false}
+	parser := Parser{Gpg: mockGpg}
+	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha256"}}
 	mail, err := parser.parseMultipartSigned(contentType, textproto.MIMEHeader{}, strings.NewReader(text))
 	assert.NoError(t, err)
 	require.NotNil(t, mail, "Mail can be parsed.")
 	assert.NotNil(t, mail.SignedBy)
 	assert.True(t, mockGpg.checked)
 	assert.Equal(t, 2, len(mail.Parts))
+	assert.Equal(t, &SignatureDetails{MicAlg: "pgp-sha256", Hash: crypto.SHA256}, mail.Signature)
+}
+
+func TestCheckMicAlg(t *testing.T) {
+	assert.NoError(t, checkMicAlg("pgp-sha256", crypto.SHA256))
+	assert.NoError(t, checkMicAlg("PGP-SHA512", crypto.SHA512), "micalg is case-insensitive")
+	assert.True(t, errors.Is(checkMicAlg("pgp-sha512", crypto.SHA256), ErrMicAlgMismatch))
+	assert.True(t, errors.Is(checkMicAlg("pgp-unknown", crypto.SHA256), ErrMicAlgMismatch))
+	assert.True(t, errors.Is(checkMicAlg("pgp-sha1", crypto.SHA1), ErrWeakHash))
+	assert.True(t, errors.Is(checkMicAlg("pgp-md5", crypto.MD5), ErrWeakHash))
+}
+
+func TestParseMultipartSignedWithMismatchingMicAlg(t *testing.T) {
+	text := signedMailWithKeys(t, readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc"))
+	parser := Parser{Gpg: serverGPG(t)}
+	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha512"}}
+
+	mail, err := parser.parseMultipartSigned(contentType, textproto.MIMEHeader{}, strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Nil(t, mail.SignedBy)
+	require.NotNil(t, mail.Signature)
+	assert.Equal(t, crypto.SHA256, mail.Signature.Hash)
+	assert.True(t, errors.Is(mail.Signature.Err, ErrMicAlgMismatch))
+}
+
+func TestParseSignedMailWithWeakHash(t *testing.T) {
+	mail := parseMailFromFileWithGpg(t, "signed_request_sha1.eml", serverGPG(t))
+	assert.Nil(t, mail.SignedBy, "SHA-1 signatures must be rejected")
+	require.NotNil(t, mail.Signature)
+	assert.Equal(t, crypto.SHA1, mail.Signature.Hash)
+	assert.True(t, errors.Is(mail.Signature.Err, ErrWeakHash))
 }
 
 func TestPlainText(t *testing.T) {
@@ -307,3 +361,478 @@ func TestFindAttachment(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, data)
 }
+
+const testKeyPrefix = "../test/keys/test-gpg-validation@"
+
+func readTestFile(t *testing.T, path string) string {
+	file, cleanup := utils.Open(t, path)
+	defer cleanup()
+	data, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	return strings.Replace(string(data), "\n", "\r\n", -1)
+}
+
+// signedMailWithKeys returns a multipart/signed mail signed by the client key, which has the given keys attached.
+func signedMailWithKeys(t *testing.T, keys string) string {
+	return signedMail(t, createMultipart("innerBoundary").
+		withPart("text/plain", "Please sign this key.", nil).
+		withAttachment("application/pgp-keys", keys).
+		build())
+}
+
+// signedMail returns a multipart/signed mail signed by the client key containing the given multipart/mixed body.
+func signedMail(t *testing.T, innerText string) string {
+	signedPart := "Content-Type: multipart/mixed; boundary=\"innerBoundary\"\r\n\r\n" + innerText
+
+	return createMultipart("frontier").
+		withPart("multipart/mixed; boundary=\"innerBoundary\"", innerText, nil).
+		withAttachment("application/pgp-signature", clientSignature(t, signedPart)).
+		build()
+}
+
+// clientSignature returns the armored SHA-256 signature of the client key for the given text.
+func clientSignature(t *testing.T, text string) string {
+	clientKeyFile, cleanup := utils.Open(t, testKeyPrefix+"client.local (0xE93B112A) sec.asc")
+	defer cleanup()
+	client, err := gpg.NewGPG(clientKeyFile, "validation")
+	require.NoError(t, err)
+	signature := new(bytes.Buffer)
+	require.NoError(t, client.SignMessage(strings.NewReader(text), signature))
+	return signature.String()
+}
+
+func serverGPG(t *testing.T) *gpg.GPG {
+	serverKeyFile, cleanup := utils.Open(t, testKeyPrefix+"server.local (0x87144E5E) sec.asc")
+	defer cleanup()
+	server, err := gpg.NewGPG(serverKeyFile, "validation")
+	require.NoError(t, err)
+	return server
+}
+
+func TestParseMultipartSignedKeyRing(t *testing.T) {
+	keys := readTestFile(t, testKeyPrefix+"other.local (0xF043F26E) pub.asc") +
+		readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")
+	parser := Parser{Gpg: serverGPG(t)}
+	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha256"}}
+
+	_, signerKey, err := parser.parseMultipartSignedWithError(contentType, textproto.MIMEHeader{},
+		strings.NewReader(signedMailWithKeys(t, keys)))
+	require.NoError(t, err)
+	assert.Equal(t, "42744CC1E93B112A", signerKey.PrimaryKey.KeyIdString(), "Signer must be picked from the keyring")
+}
+
+func TestParseMultipartSignedWithoutSignerKey(t *testing.T) {
+	keys := readTestFile(t, testKeyPrefix+"other.local (0xF043F26E) pub.asc")
+	parser := Parser{Gpg: serverGPG(t)}
+	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha256"}}
+
+	_, signerKey, err := parser.parseMultipartSignedWithError(contentType, textproto.MIMEHeader{},
+		strings.NewReader(signedMailWithKeys(t, keys)))
+	assert.Nil(t, signerKey)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Cannot find signer among attached keys")
+		assert.Contains(t, err.Error(), gpg.ErrUnknownSigner.Error())
+	}
+}
+
+type keyLookup map[uint64]gpg.Key
+
+func (keys keyLookup) GetKey(keyID uint64) gpg.Key {
+	return keys[keyID]
+}
+
+func TestParseMultipartSignedWithCertifiedKey(t *testing.T) {
+	clientKey, err := gpg.UnmarshalKey([]byte(readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")))
+	require.NoError(t, err)
+	text := signedMail(t, createMultipart("innerBoundary").withPart("text/plain", "Please renew.", nil).build())
+	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha256"}}
+
+	parser := Parser{Gpg: serverGPG(t), Keys: keyLookup{clientKey.PrimaryKey.KeyId: clientKey}}
+	entity, signerKey, err := parser.parseMultipartSignedWithError(contentType, textproto.MIMEHeader{},
+		strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Equal(t, clientKey, signerKey, "Signer must be looked up by the issuer key ID")
+	assert.Equal(t, KeySourceCertified, entity.KeySource)
+
+	parser.Keys = keyLookup{}
+	_, signerKey, err = parser.parseMultipartSignedWithError(contentType, textproto.MIMEHeader{}, strings.NewReader(text))
+	assert.Nil(t, signerKey)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "42744CC1E93B112A not certified before")
+	}
+}
+
+func TestParseInlineSignedText(t *testing.T) {
+	clientKeyID := "42744CC1E93B112A"
+	for _, fileName := range []string{"inline_signed_request.eml", "inline_armored_request.eml"} {
+		mail := parseMailFromFileWithGpg(t, fileName, serverGPG(t))
+		require.NotNil(t, mail.SignedBy, fileName)
+		assert.Equal(t, clientKeyID, mail.SignedBy.PrimaryKey.KeyIdString(), fileName)
+		assert.Equal(t, KeySourcePasted, mail.KeySource, fileName)
+		assert.True(t, strings.HasPrefix(string(mail.Content), "Please sign this key."), fileName)
+		assert.NotContains(t, string(mail.Content), "-----BEGIN PGP SIGNATURE-----", fileName)
+	}
+
+	mail := parseMailFromFileWithGpg(t, "inline_signed_attached_key.eml", serverGPG(t))
+	require.NotNil(t, mail.SignedBy, "Signer must be found among the attached keys")
+	assert.Equal(t, clientKeyID, mail.SignedBy.PrimaryKey.KeyIdString())
+	assert.Equal(t, mail.SignedBy, mail.Parts[0].SignedBy)
+	assert.Equal(t, KeySourceAttached, mail.KeySource)
+	assert.Equal(t, "Please sign this key.", strings.TrimSpace(string(mail.Parts[0].Content)))
+}
+
+func TestParseInlineSignedTextWithoutSignerKey(t *testing.T) {
+	text := strings.Replace(string(loadTestMail(t, "inline_signed_request.eml")), "Please sign", "Please revoke", 1)
+	parser := Parser{Gpg: serverGPG(t)}
+	mail, err := parser.ParseMail(strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Nil(t, mail.SignedBy, "Modified text must not be signed")
+
+	withKey := string(loadTestMail(t, "inline_signed_attached_key.eml"))
+	clearSigned := withKey[strings.Index(withKey, "-----BEGIN PGP SIGNED MESSAGE-----"):strings.Index(withKey,
+		"-----END PGP SIGNATURE-----")] + "-----END PGP SIGNATURE-----"
+	text = createMultipart("frontier").withPart("text/plain", clearSigned, nil).build()
+	entity, err := parser.parseMultipart(MimeMediaType{"multipart/mixed", map[string]string{"boundary": "frontier"}},
+		textproto.MIMEHeader{}, strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Nil(t, entity.SignedBy, "Text without key must not be signed")
+}
+
+func TestParseInlineSignedTextKeyPrecedence(t *testing.T) {
+	clientKey, err := gpg.UnmarshalKey([]byte(readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")))
+	require.NoError(t, err)
+	keyData := new(bytes.Buffer)
+	require.NoError(t, (*openpgp.Entity)(clientKey).Serialize(keyData))
+	text := "Autocrypt: addr=test-gpg-validation@client.local; prefer-encrypt=mutual; keydata=" +
+		base64.StdEncoding.EncodeToString(keyData.Bytes()) + "\n" +
+		string(loadTestMail(t, "inline_signed_attached_key.eml"))
+
+	parser := Parser{Gpg: serverGPG(t), Keys: keyLookup{clientKey.PrimaryKey.KeyId: clientKey}}
+	mail, err := parser.ParseMail(strings.NewReader(text))
+	require.NoError(t, err)
+	require.NotNil(t, mail.SignedBy)
+	assert.Equal(t, "42744CC1E93B112A", mail.SignedBy.PrimaryKey.KeyIdString())
+	assert.Equal(t, KeySourceAttached, mail.KeySource, "Attached keys take precedence over the Autocrypt header")
+	assert.Equal(t, KeySourceAttached, mail.Parts[0].KeySource)
+}
+
+func TestParseInlineSignedTextWithCertifiedKey(t *testing.T) {
+	clientKey, err := gpg.UnmarshalKey([]byte(readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")))
+	require.NoError(t, err)
+	withKey := string(loadTestMail(t, "inline_signed_attached_key.eml"))
+	clearSigned := withKey[strings.Index(withKey, "-----BEGIN PGP SIGNED MESSAGE-----"):strings.Index(withKey,
+		"-----END PGP SIGNATURE-----")] + "-----END PGP SIGNATURE-----"
+	text := "Content-Type: text/plain\r\n\r\n" + clearSigned
+
+	parser := Parser{Gpg: serverGPG(t), Keys: keyLookup{clientKey.PrimaryKey.KeyId: clientKey}}
+	mail, err := parser.ParseMail(strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Equal(t, clientKey, mail.SignedBy, "Signer must be looked up by the issuer key ID")
+	assert.Equal(t, KeySourceCertified, mail.KeySource)
+	assert.Equal(t, "Please sign this key.", strings.TrimSpace(string(mail.Content)))
+
+	parser.Keys = keyLookup{}
+	mail, err = parser.ParseMail(strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Nil(t, mail.SignedBy, "Keys not certified before must not be used")
+}
+
+func TestParseInlineSignedTextWithUnsignedPart(t *testing.T) {
+	withKey := string(loadTestMail(t, "inline_signed_attached_key.eml"))
+	keyPart := strings.LastIndex(withKey, "--Kj7319i9nmIyA2yE\n")
+	text := withKey[:keyPart] + "--Kj7319i9nmIyA2yE\nContent-Type: text/plain\n\nrevoke\n" + withKey[keyPart:]
+	parser := Parser{Gpg: serverGPG(t)}
+	mail, err := parser.ParseMail(strings.NewReader(text))
+	require.NoError(t, err)
+	require.Len(t, mail.Parts, 3)
+	assert.NotNil(t, mail.Parts[0].SignedBy)
+	assert.Nil(t, mail.Parts[1].SignedBy)
+	assert.Nil(t, mail.SignedBy, "Mails with unsigned text parts must not be signed")
+}
+
+func TestParseAutocryptHeader(t *testing.T) {
+	assert.Equal(t, map[string]string{"addr": "alice@example.org", "prefer-encrypt": "mutual", "keydata": "mQ EN"},
+		parseAutocryptHeader("addr=alice@example.org; prefer-encrypt=mutual; keydata=mQ EN;"))
+	assert.Equal(t, map[string]string{"addr": "alice@example.org", "_comment": "x"},
+		parseAutocryptHeader("addr=alice@example.org; _comment=x"), "Non-critical attributes are kept")
+	assert.Nil(t, parseAutocryptHeader("addr=alice@example.org; type=2; keydata=mQEN"),
+		"Headers with unknown critical attributes must be ignored")
+	assert.Nil(t, parseAutocryptHeader("addr"))
+}
+
+// autocryptMail returns a mail with the given signed body and an Autocrypt header, which advertises the client key for
+// addr.
+func autocryptMail(t *testing.T, addr, body string) string {
+	clientKey, err := gpg.UnmarshalKey([]byte(readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")))
+	require.NoError(t, err)
+	keyData := new(bytes.Buffer)
+	require.NoError(t, (*openpgp.Entity)(clientKey).Serialize(keyData))
+
+	return "From: GPG Client <test-gpg-validation@client.local>\r\n" +
+		"Autocrypt: addr=" + addr + "; prefer-encrypt=mutual; keydata=" +
+		base64.StdEncoding.EncodeToString(keyData.Bytes()) + "\r\n" +
+		"Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; " +
+		"boundary=\"frontier\"\r\n\r\n" + body
+}
+
+func TestParseSignedMailWithAutocryptKey(t *testing.T) {
+	body := signedMail(t, createMultipart("innerBoundary").withPart("text/plain", "Please sign this key.", nil).build())
+	parser := Parser{Gpg: serverGPG(t), Keys: keyLookup{}}
+
+	mail, err := parser.ParseMail(strings.NewReader(autocryptMail(t, "Test-GPG-Validation@client.local", body)))
+	require.NoError(t, err)
+	require.NotNil(t, mail.SignedBy, "Signer must be found in the Autocrypt header")
+	assert.Equal(t, "42744CC1E93B112A", mail.SignedBy.PrimaryKey.KeyIdString())
+	assert.Equal(t, KeySourceAutocrypt, mail.KeySource)
+
+	mail, err = parser.ParseMail(strings.NewReader(autocryptMail(t, "impostor@faux.fake", body)))
+	require.NoError(t, err)
+	assert.Nil(t, mail.SignedBy, "Autocrypt headers for other addresses must be ignored")
+	if assert.NotNil(t, mail.Signature) {
+		assert.Contains(t, mail.Signature.Err.Error(), "not certified before")
+	}
+}
+
+func TestParseSignedMailWithPastedKey(t *testing.T) {
+	key := readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")
+	body := signedMail(t, createMultipart("innerBoundary").
+		withPart("text/plain", "Please sign this key.\r\n\r\n"+key, nil).
+		build())
+	parser := Parser{Gpg: serverGPG(t)}
+
+	mail, err := parser.ParseMail(strings.NewReader(
+		"Content-Type: multipart/signed; micalg=pgp-sha256; boundary=\"frontier\"\r\n\r\n" + body))
+	require.NoError(t, err)
+	require.NotNil(t, mail.SignedBy, "Signer must be found among the pasted keys")
+	assert.Equal(t, "42744CC1E93B112A", mail.SignedBy.PrimaryKey.KeyIdString())
+	assert.Equal(t, KeySourcePasted, mail.KeySource)
+
+	mail, err = parser.ParseMail(strings.NewReader(autocryptMail(t, "test-gpg-validation@client.local", body)))
+	require.NoError(t, err)
+	assert.Equal(t, KeySourceAutocrypt, mail.KeySource, "The Autocrypt header takes precedence over pasted keys")
+
+	mail = parseMailFromStringWithGpg(t,
+		"Content-Type: multipart/signed; micalg=pgp-sha256; boundary=\"frontier\"\r\n\r\n"+signedMailWithKeys(t, key),
+		serverGPG(t))
+	assert.Equal(t, KeySourceAttached, mail.KeySource)
+}
+
+func TestParseTransferEncodings(t *testing.T) {
+	mail := parseMailFromFile(t, "transfer_encodings.eml")
+	require.Len(t, mail.Parts, 6)
+	assert.Equal(t, "Seven bit text.", string(mail.Parts[0].Content))
+	for i, encoding := range []string{"8bit", "binary", "quoted-printable", "base64"} {
+		assert.Equal(t, "Bärenfüße", string(mail.Parts[i+1].Content), encoding)
+	}
+	data, err := mail.FindAttachment("application/octet-stream")
+	require.NoError(t, err)
+	assert.Equal(t, "This is a PDF file.", string(data))
+
+	mail = parseMailFromFile(t, "plaintext_base64.eml")
+	assert.Equal(t, "This is some nice plain text!\r\n", string(mail.Content))
+	mail = parseMailFromFile(t, "plaintext_quoted_printable.eml")
+	assert.Equal(t, "This is some nice plain text with soft line breaks and Bärenfüße!\r\n", string(mail.Content))
+}
+
+func TestParseUnsupportedTransferEncoding(t *testing.T) {
+	parser := Parser{Gpg: nil}
+	_, err := parser.ParseMail(strings.NewReader("Content-Type: text/plain\r\nContent-Transfer-Encoding: x-uuencode\r\n\r\n"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported Content-Transfer-Encoding x-uuencode")
+	}
+}
+
+func TestParseSignedMailWithBase64Key(t *testing.T) {
+	mail := parseMailFromFileWithGpg(t, "signed_request_base64_key.eml", serverGPG(t))
+	require.NotNil(t, mail.SignedBy, "Signature must be verified on the raw signed part")
+	assert.Equal(t, "42744CC1E93B112A", mail.SignedBy.PrimaryKey.KeyIdString())
+
+	text := mail.Parts[0].Parts[0]
+	assert.Equal(t, "Please sign this key. Grüße!\r\n", string(text.Content))
+	key, err := mail.FindAttachment("application/pgp-keys")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(key), "-----BEGIN PGP PUBLIC KEY BLOCK-----"), "Key must be decoded")
+}
+
+func TestFindSignedPartMalformed(t *testing.T) {
+	parser := Parser{Gpg: nil}
+	_, err := parser.findSignedPart([]byte("--other\r\nText\r\n--other--\r\n"), "frontier")
+	assert.True(t, errors.Is(err, ErrMalformedSignedPart))
+
+	_, err = parser.findSignedPart([]byte("--frontier\r\nText"), "frontier")
+	assert.True(t, errors.Is(err, ErrMalformedSignedPart))
+}
+
+func TestParseMultipartSignedWithPaddedBoundary(t *testing.T) {
+	text := strings.Replace(signedMailWithKeys(t, readTestFile(t, testKeyPrefix+"client.local (0xE93B112A) pub.asc")),
+		"--frontier\r\n", "--frontier \r\n", -1)
+	parser := Parser{Gpg: serverGPG(t)}
+	contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": "frontier", "micalg": "pgp-sha256"}}
+
+	entity, signerKey, err := parser.parseMultipartSignedWithError(contentType, textproto.MIMEHeader{},
+		strings.NewReader(text))
+	assert.NotNil(t, entity, "Multipart reader accepts transport padding")
+	assert.Nil(t, signerKey)
+	assert.True(t, errors.Is(err, ErrMalformedSignedPart))
+
+	entity, err = parser.parseMultipartSigned(contentType, textproto.MIMEHeader{}, strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Nil(t, entity.SignedBy)
+
+	contentType.Params = map[string]string{"micalg": "pgp-sha256"}
+	_, err = parser.parseMultipartSigned(contentType, textproto.MIMEHeader{}, strings.NewReader(text))
+	assert.True(t, errors.Is(err, ErrMissingBoundary))
+}
+
+// fuzzSeeds adds the test mails as seeds to the fuzz corpus.
+func fuzzSeeds(f *testing.F) {
+	paths, err := filepath.Glob("../test/mails/*.eml")
+	require.NoError(f, err)
+	require.NotEmpty(f, paths)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		require.NoError(f, err)
+		f.Add(data)
+	}
+}
+
+// fuzzParser returns a parser using the server key, so that fuzzing reaches signature verification and decryption.
+func fuzzParser(f *testing.F) *Parser {
+	serverKeyFile, err := os.Open(testKeyPrefix + "server.local (0x87144E5E) sec.asc")
+	require.NoError(f, err)
+	defer serverKeyFile.Close()
+	server, err := gpg.NewGPG(serverKeyFile, "validation")
+	require.NoError(f, err)
+	return &Parser{Gpg: server, Keys: keyLookup{}}
+}
+
+func FuzzParseMail(f *testing.F) {
+	fuzzSeeds(f)
+	parser := fuzzParser(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entity, err := parser.ParseMail(bytes.NewReader(data))
+		if err == nil && entity == nil {
+			t.Error("ParseMail returned neither entity nor error")
+		}
+	})
+}
+
+func FuzzParseMultipartSigned(f *testing.F) {
+	f.Add("frontier", []byte(createMultipart("frontier").withPart("text/plain", "Hello world!", nil).
+		withAttachment("application/pgp-signature", "SIGNATURE").build()))
+	f.Add("frontier", []byte("--frontier\r\n\r\n--frontier--\r\n"))
+	parser := fuzzParser(f)
+	f.Fuzz(func(t *testing.T, boundary string, body []byte) {
+		contentType := MimeMediaType{"multipart/signed", map[string]string{"boundary": boundary, "micalg": "pgp-sha256"}}
+		entity, err := parser.parseMultipartSigned(contentType, textproto.MIMEHeader{}, bytes.NewReader(body))
+		if err == nil && entity == nil {
+			t.Error("parseMultipartSigned returned neither entity nor error")
+		}
+	})
+}
+
+func TestParseEncryptedRequests(t *testing.T) {
+	mail := parseMailFromFileWithGpg(t, "crypted_signed_request_enigmail.eml", serverGPG(t))
+	require.NotNil(t, mail.SignedBy, "Signature embedded in the encrypted message must be verified")
+	assert.Equal(t, "42744CC1E93B112A", mail.SignedBy.PrimaryKey.KeyIdString())
+	assert.Nil(t, mail.Signature)
+
+	mail = parseMailFromFileWithGpg(t, "encrypted_signed_part_request.eml", serverGPG(t))
+	require.NotNil(t, mail.SignedBy, "Signature of the encrypted multipart/signed must be verified")
+	assert.Equal(t, "42744CC1E93B112A", mail.SignedBy.PrimaryKey.KeyIdString())
+	assert.Equal(t, "multipart/signed", getMimeMediaType(mail.Header, "Content-Type").Value)
+	require.NotNil(t, mail.Signature)
+	assert.NoError(t, mail.Signature.Err)
+	key, err := mail.FindAttachment("application/pgp-keys")
+	require.NoError(t, err)
+	assert.Contains(t, string(key), "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+}
+
+func TestParseEncryptedRequestWithInvalidSignature(t *testing.T) {
+	parser := Parser{Gpg: serverGPG(t)}
+	_, err := parser.ParseMail(bytes.NewReader(loadTestMail(t, "encrypted_invalid_signature_signed_part_request.eml")))
+	if assert.Error(t, err, "A valid multipart/signed must not make up for an invalid signature of the encrypted message") {
+		assert.Contains(t, err.Error(), "could not verify message with attached keys 42744CC1E93B112A")
+	}
+}
+
+// encryptedMail returns a multipart/encrypted mail with the given outer header, whose payload has the given content
+// type and header and is signed by the server key and encrypted to it.
+func encryptedMail(t *testing.T, outerHeader, contentType, payloadHeader string) string {
+	server := serverGPG(t)
+	serverKeyData := readTestFile(t, asciiKeyFilePublic)
+	serverKey, err := gpg.UnmarshalKey([]byte(serverKeyData))
+	require.NoError(t, err)
+
+	payload := "Content-Type: " + contentType + "\r\n" + payloadHeader + "\r\n" + createMultipart("innerBoundary").
+		withPart("text/plain", "Please sign this key.", nil).
+		withAttachment("application/pgp-keys", serverKeyData).
+		build()
+	encrypted := new(bytes.Buffer)
+	plaintext, err := server.EncryptMessage(encrypted, serverKey)
+	require.NoError(t, err)
+	_, err = plaintext.Write([]byte(payload))
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+
+	return outerHeader + "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; " +
+		"boundary=\"frontier\"\r\n\r\n" + createMultipart("frontier").
+		withPart("application/pgp-encrypted", "Version: 1", nil).
+		withPart("application/octet-stream", encrypted.String(), textproto.MIMEHeader{
+			"Content-Disposition": {"inline; filename=\"encrypted.asc\""}}).
+		build()
+}
+
+func TestParseEncryptedRequestWithCertifiedKey(t *testing.T) {
+	server := serverGPG(t)
+	serverKey, err := gpg.UnmarshalKey([]byte(readTestFile(t, asciiKeyFilePublic)))
+	require.NoError(t, err)
+	encrypted := new(bytes.Buffer)
+	plaintext, err := server.EncryptMessage(encrypted, serverKey)
+	require.NoError(t, err)
+	_, err = plaintext.Write([]byte("Content-Type: text/plain\r\n\r\nPlease renew.\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+	text := "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"frontier\"\r\n\r\n" +
+		createMultipart("frontier").
+			withPart("application/pgp-encrypted", "Version: 1", nil).
+			withAttachment("application/octet-stream", encrypted.String()).
+			build()
+
+	parser := Parser{Gpg: server, Keys: keyLookup{serverKey.PrimaryKey.KeyId: serverKey}}
+	mail, err := parser.ParseMail(strings.NewReader(text))
+	require.NoError(t, err)
+	assert.Equal(t, serverKey, mail.SignedBy, "Signer must be looked up by the issuer key ID")
+	assert.Equal(t, KeySourceCertified, mail.KeySource)
+
+	parser.Keys = keyLookup{}
+	_, err = parser.ParseMail(strings.NewReader(text))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "5AE5111887144E5E not certified before")
+	}
+}
+
+func TestParseEncryptedProtectedHeaders(t *testing.T) {
+	mail := parseMailFromFileWithGpg(t, "mua/thunderbird_encrypted.eml", serverGPG(t))
+	assert.Equal(t, "Sign this key!", mail.GetSubject(), "Protected subject must replace the obscured subject")
+	assert.Equal(t, "GPG Client <test-gpg-validation@client.local>", mail.GetSender())
+
+	outerHeader := "From: Server <test-gpg-validation@server.local>\r\nSubject: ...\r\nX-Outer: kept\r\n" +
+		"Content-Description: OpenPGP encrypted message\r\n"
+	protected := encryptedMail(t, outerHeader,
+		"multipart/mixed; boundary=\"innerBoundary\"; protected-headers=\"v1\"",
+		"Subject: Revoke this key!\r\nFrom: Protected <test-gpg-validation@server.local>\r\n")
+	mail = parseMailFromStringWithGpg(t, protected, serverGPG(t))
+	require.NotNil(t, mail.SignedBy)
+	assert.Equal(t, "Revoke this key!", mail.GetSubject())
+	assert.Equal(t, "Protected <test-gpg-validation@server.local>", mail.GetSender())
+	assert.Equal(t, "kept", mail.Header.Get("X-Outer"), "Unprotected header fields must be kept")
+	assert.Empty(t, mail.Header.Get("Content-Description"), "Content header fields must describe the payload")
+	assert.Equal(t, "multipart/mixed", getMimeMediaType(mail.Header, "Content-Type").Value)
+
+	unprotected := encryptedMail(t, outerHeader, "multipart/mixed; boundary=\"innerBoundary\"",
+		"Subject: Revoke this key!\r\n")
+	mail = parseMailFromStringWithGpg(t, unprotected, serverGPG(t))
+	require.NotNil(t, mail.SignedBy)
+	assert.Equal(t, "...", mail.GetSubject(), "Payload header fields must only be used if declared as protected")
+}
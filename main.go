@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime/debug"
 	"strings"
+	"time"
 
+	"github.com/TNG/openpgp-validation-server/agent"
 	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/signer"
 	"github.com/TNG/openpgp-validation-server/smtp"
 	"github.com/TNG/openpgp-validation-server/storage"
 	"github.com/TNG/openpgp-validation-server/validator"
@@ -17,24 +24,78 @@ import (
 const (
 	okExitCode    = 0
 	errorExitCode = 1
+	// rejectedExitCode is returned by process-mail, if the mail has been processed, but no nonce mail is sent.
+	rejectedExitCode = 2
 )
 
+// Output formats of process-mail.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// gpgUtility contains the operations of the server key needed by the frontends. It is implemented by gpg.GPG holding
+// the key in-process and by signer.Client forwarding to a signer daemon.
+type gpgUtility interface {
+	validator.GpgUtility
+	validator.KeySigner
+}
+
 var (
-	gpgUtil    *gpg.GPG              // This service is mandatory.
-	store      storage.GetSetDeleter // This service is optional, when not available no data will be stored.
-	mailSender smtp.MailSender       // This service is optional, when not available no outgoing mail will be sent.
+	gpgUtil    gpgUtility      // This service is mandatory.
+	store      storage.Store   // This service is optional, when not available no data will be stored.
+	mailSender smtp.MailSender // This service is optional, when not available no outgoing mail will be sent.
 )
 
+// rejectionReplier composes replies to rejected mails, it is nil unless enabled with --rejection-replies.
+var rejectionReplier *validator.RejectionReplier
+
+// acknowledger decides on the acknowledgements of accepted requests, it is nil unless enabled with
+// --acknowledge-requests.
+var acknowledger *validator.Acknowledger
+
 var smtpMailFrom string
 
+// signerFlags configure the certifications, which are issued by the signer daemon. They are passed to serve-signer and
+// have no effect in a frontend using --signer-socket.
+var signerFlags = []string{"certification-lifetime", "policy-uri", "notation", "certification-type",
+	"local-certifications", "minimal-export"}
+
 func initGpgUtil(c *cli.Context) error {
+	if socketPath := c.String("signer-socket"); socketPath != "" {
+		for _, name := range signerFlags {
+			if c.IsSet(name) {
+				return fmt.Errorf("--%s is applied by the signer daemon, pass it to serve-signer instead", name)
+			}
+		}
+		client, err := signer.NewClient(socketPath)
+		if err != nil {
+			return fmt.Errorf("Cannot connect to signer at '%s': %s", socketPath, err)
+		}
+		client.KeyPolicy.MinRSABits = c.Int("min-rsa-bits")
+		log.Printf("Using signer at '%s' with server identity '%s'", socketPath, client.ServerIdentity())
+		gpgUtil = client
+		return nil
+	}
+
+	util, err := newLocalGpg(c)
+	if err != nil {
+		return err
+	}
+	util.KeyPolicy.MinRSABits = c.Int("min-rsa-bits")
+	gpgUtil = util
+	return nil
+}
+
+// newLocalGpg loads the private server keys given on the command line.
+func newLocalGpg(c *cli.Context) (*gpg.GPG, error) {
 	privateKeyPath := c.String("private-key")
 	if privateKeyPath == "" {
-		return fmt.Errorf("Invalid private key file path: %s", privateKeyPath)
+		return nil, fmt.Errorf("Invalid private key file path: %s", privateKeyPath)
 	}
 	privateKeyInput, err := os.Open(privateKeyPath)
 	if err != nil {
-		return fmt.Errorf("Cannot open private key file '%s': %s", privateKeyPath, err)
+		return nil, fmt.Errorf("Cannot open private key file '%s': %s", privateKeyPath, err)
 	}
 	defer func() {
 		err = privateKeyInput.Close()
@@ -43,12 +104,85 @@ func initGpgUtil(c *cli.Context) error {
 		}
 	}()
 
-	util, err := gpg.NewGPG(privateKeyInput, c.String("passphrase"))
+	var util *gpg.GPG
+	if agentSocket := c.String("agent-socket"); agentSocket != "" {
+		util, err = newAgentGpg(privateKeyInput, c.String("passphrase"), agentSocket, c.String("agent-keygrip"))
+	} else {
+		util, err = gpg.NewGPG(privateKeyInput, c.String("passphrase"))
+	}
 	if err != nil {
-		return fmt.Errorf("Cannot initialize GPG: %s", err)
+		return nil, fmt.Errorf("Cannot initialize GPG: %s", err)
 	}
-	gpgUtil = util
+	for _, oldKeyPath := range c.StringSlice("old-private-key") {
+		if err = addServerKeys(util, oldKeyPath, c.String("passphrase")); err != nil {
+			return nil, err
+		}
+	}
+	if activeKey := c.String("active-key"); activeKey != "" {
+		if err = util.SetActiveKey(activeKey); err != nil {
+			return nil, fmt.Errorf("Cannot activate server key '%s': %s", activeKey, err)
+		}
+	}
+	log.Printf("Using server keys %s", strings.Join(util.ServerKeyFingerprints(), ", "))
+
+	util.Policy.Lifetime = c.Duration("certification-lifetime")
+	util.Policy.PolicyURI = c.String("policy-uri")
+	for _, notationString := range c.StringSlice("notation") {
+		notation, err := gpg.ParseNotation(notationString)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid notation '%s': %s", notationString, err)
+		}
+		util.Policy.Notations = append(util.Policy.Notations, notation)
+	}
+	certificationType := c.String("certification-type")
+	if util.Policy.Type, err = gpg.ParseCertificationType(certificationType); err != nil {
+		return nil, fmt.Errorf("Invalid certification type '%s': %s", certificationType, err)
+	}
+	util.Policy.Local = c.Bool("local-certifications")
+	util.MinimalExport = c.Bool("minimal-export")
+
+	return util, nil
+}
+
+// newAgentGpg loads the server key, whose primary private key is held by the gpg-agent listening on agentSocket.
+func newAgentGpg(serverKey io.Reader, passphrase, agentSocket, keygrip string) (*gpg.GPG, error) {
+	data, err := ioutil.ReadAll(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := gpg.UnmarshalKey(data)
+	if err != nil {
+		return nil, err
+	}
+	public, err := gpg.PublicSigningKey(key)
+	if err == gpg.ErrUnsupportedSigner {
+		return nil, fmt.Errorf("--agent-socket only supports RSA and ECDSA server keys, " +
+			"run serve-signer and use --signer-socket for Ed25519 server keys")
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := agent.NewSigner(agentSocket, keygrip, public)
+	if err != nil {
+		return nil, err
+	}
+	if err = signer.Check(); err != nil {
+		return nil, fmt.Errorf("Cannot use gpg-agent at '%s': %s", agentSocket, err)
+	}
+	log.Printf("Using gpg-agent at '%s' for signing", agentSocket)
+	return gpg.NewGPGWithSigner(bytes.NewReader(data), passphrase, signer)
+}
+
+func addServerKeys(util *gpg.GPG, privateKeyPath, passphrase string) error {
+	privateKeyInput, err := os.Open(privateKeyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot open private key file '%s': %s", privateKeyPath, err)
+	}
+	defer func() { _ = privateKeyInput.Close() }()
 
+	if err = util.AddServerKeys(privateKeyInput, passphrase); err != nil {
+		return fmt.Errorf("Cannot load private key file '%s': %s", privateKeyPath, err)
+	}
 	return nil
 }
 
@@ -60,6 +194,10 @@ func initGlobalServices(c *cli.Context) (err error) {
 	if store, err = storage.NewStore(c.String("storage")); err != nil {
 		return err
 	}
+	if c.Bool("local-certifications") && c.String("storage") == "file" {
+		return fmt.Errorf("--local-certifications cannot be used with --storage file, since non-exportable " +
+			"certifications are dropped when certified keys are stored")
+	}
 
 	smtpMailFrom = c.String("mail-from")
 	log.Printf("Sending mail from '%s'", smtpMailFrom)
@@ -68,6 +206,36 @@ func initGlobalServices(c *cli.Context) (err error) {
 	log.Println("Using outgoing SMTP server at: ", smtpOutHost)
 	mailSender = smtp.NewSingleServerSendMailer(smtpOutHost)
 
+	validator.NonceLifetime = c.Duration("nonce-lifetime")
+
+	rejectionReplier = nil
+	acknowledger = nil
+	if !c.Bool("rejection-replies") && !c.Bool("acknowledge-requests") {
+		return nil
+	}
+	if store == nil {
+		return fmt.Errorf("--rejection-replies and --acknowledge-requests need a store to limit the replies per " +
+			"address, use --storage file")
+	}
+	interval := c.Duration("rejection-reply-interval")
+	log.Printf("Replying to mails at most every %v per address", interval)
+	// Rejection replies and acknowledgements share the limit, so that an address gets at most one reply per interval.
+	limiter := validator.NewRateLimiter(interval, store)
+	if c.Bool("rejection-replies") {
+		rejectionReplier = &validator.RejectionReplier{
+			GPG:          gpgUtil,
+			OwnAddresses: []string{smtpMailFrom},
+			Limiter:      limiter,
+		}
+	}
+	if c.Bool("acknowledge-requests") {
+		acknowledger = &validator.Acknowledger{
+			GPG:          gpgUtil,
+			OwnAddresses: []string{smtpMailFrom},
+			Limiter:      limiter,
+		}
+	}
+
 	return nil
 }
 
@@ -91,6 +259,11 @@ func runServers(c *cli.Context) error {
 func processMailAction(c *cli.Context) (err error) {
 	var inputMail *os.File
 
+	output := c.String("output")
+	if output != outputText && output != outputJSON {
+		return fmt.Errorf("Invalid output format '%s'", output)
+	}
+
 	inputFilePath := c.String("file")
 
 	if inputFilePath == "" {
@@ -106,9 +279,20 @@ func processMailAction(c *cli.Context) (err error) {
 	if err = initGlobalServices(c); err != nil {
 		return err
 	}
+	if (rejectionReplier != nil || acknowledger != nil) && c.String("storage") != "file" {
+		return fmt.Errorf("--rejection-replies and --acknowledge-requests need --storage file for process-mail, so " +
+			"that the replies per address are limited across invocations")
+	}
 
-	processMail := getIncomingMailHandler(c.String("external-http-host"))
-	processMail(inputMail)
+	result := handleIncomingMail(inputMail, c.String("external-http-host"), nil)
+	if output == outputJSON {
+		if err = json.NewEncoder(c.App.Writer).Encode(result); err != nil {
+			return fmt.Errorf("Cannot write result: %s", err)
+		}
+	}
+	if result.Rejected() {
+		return cli.NewExitError(fmt.Sprintf("Rejected: %s", strings.Join(result.Errors, "; ")), rejectedExitCode)
+	}
 
 	return nil
 }
@@ -129,6 +313,89 @@ func confirmNonceAction(c *cli.Context) error {
 	return nil
 }
 
+func crossSignKeyAction(c *cli.Context) (err error) {
+	util, err := newLocalGpg(c)
+	if err != nil {
+		return err
+	}
+
+	newKeyPath := c.String("new-key")
+	newKeyInput, err := os.Open(newKeyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot open key file '%s': %s", newKeyPath, err)
+	}
+	defer func() { _ = newKeyInput.Close() }()
+
+	newKey, err := util.ReadKey(newKeyInput)
+	if err != nil {
+		return fmt.Errorf("Cannot read key file '%s': %s", newKeyPath, err)
+	}
+
+	output := os.Stdout
+	if outputPath := c.String("output"); outputPath != "" {
+		output, err = os.Create(outputPath)
+		if err != nil {
+			return fmt.Errorf("Cannot create output file '%s': %s", outputPath, err)
+		}
+		defer func() {
+			if closeErr := output.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+
+	return util.CrossSignKey(newKey, output)
+}
+
+func revokeCertificationAction(c *cli.Context) error {
+	reason := c.Int("reason")
+	if reason < 0 || reason > 255 {
+		return fmt.Errorf("Invalid revocation reason %d", reason)
+	}
+
+	keyPath := c.String("key")
+	keyInput, err := os.Open(keyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot open key file '%s': %s", keyPath, err)
+	}
+	defer func() { _ = keyInput.Close() }()
+
+	fingerprint := c.String("fingerprint")
+	key, err := gpg.FindKey(keyInput, fingerprint)
+	if err != nil {
+		return fmt.Errorf("Cannot read key '%s' from '%s': %s", fingerprint, keyPath, err)
+	}
+
+	if err = initGlobalServices(c); err != nil {
+		return err
+	}
+
+	responseMail, err := validator.RevokeCertification(c.String("email"), key, gpg.RevocationReason(reason),
+		c.String("reason-text"), gpgUtil)
+	if err != nil {
+		return fmt.Errorf("Cannot revoke certification: %s", err)
+	}
+	if !sendOutgoingMail("revocation", responseMail) {
+		return fmt.Errorf("Cannot send revocation to '%s'", responseMail.RecipientEmail)
+	}
+	return nil
+}
+
+func signerAction(c *cli.Context) error {
+	util, err := newLocalGpg(c)
+	if err != nil {
+		return err
+	}
+
+	socketPath := c.String("socket")
+	server, err := signer.NewServer(socketPath, util)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on signer socket '%s': %s", socketPath, err)
+	}
+	log.Printf("Signer listening at '%s'", socketPath)
+	return server.Run()
+}
+
 func cliErrorHandler(action func(*cli.Context) error) func(*cli.Context) error {
 	return func(c *cli.Context) (e error) {
 		defer func() {
@@ -139,6 +406,9 @@ func cliErrorHandler(action func(*cli.Context) error) func(*cli.Context) error {
 		}()
 
 		if err := action(c); err != nil {
+			if exitErr, ok := err.(cli.ExitCoder); ok {
+				return exitErr
+			}
 			return cli.NewExitError(fmt.Sprintf("Error: %v", err), errorExitCode)
 		}
 
@@ -160,6 +430,11 @@ var subCommands = []cli.Command{
 					// TODO Handle missing value, use better default
 					Usage: "`FILE_PATH` of the mail file, omit to read from stdin",
 				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: outputText,
+					Usage: "`FORMAT` of the result, text to only log it or json to also print it to stdout",
+				},
 			},
 			commonFlags...,
 		),
@@ -179,9 +454,74 @@ var subCommands = []cli.Command{
 			commonFlags...,
 		),
 	},
+	{
+		Name:   "cross-sign-key",
+		Usage:  "certify a new server key with the active server key during a key rotation",
+		Action: cliErrorHandler(crossSignKeyAction),
+		Flags: append(
+			[]cli.Flag{
+				cli.StringFlag{
+					Name:  "new-key",
+					Usage: "`KEY_PATH` of the new server key",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "`FILE_PATH` to write the certified public key to, omit to write to stdout",
+				},
+			},
+			serverKeyFlags...,
+		),
+	},
+	{
+		Name:   "revoke-certification",
+		Usage:  "revoke the certifications of a key for an email address and mail the revoked key to it",
+		Action: cliErrorHandler(revokeCertificationAction),
+		Flags: append(
+			[]cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "`KEY_PATH` to the certified public key, may contain further keys",
+				},
+				cli.StringFlag{
+					Name:  "fingerprint",
+					Usage: "`FINGERPRINT` or 16 digit key ID of the certified key",
+				},
+				cli.StringFlag{
+					Name:  "email",
+					Usage: "`EMAIL` address, whose user IDs are no longer certified",
+				},
+				cli.IntFlag{
+					Name:  "reason",
+					Value: int(gpg.RevocationUserIDInvalid),
+					Usage: "`REASON` code of the revocation, 0 (no reason) or 32 (user ID no longer valid)",
+				},
+				cli.StringFlag{
+					Name:  "reason-text",
+					Usage: "Human-readable `TEXT` explaining the revocation",
+				},
+			},
+			commonFlags...,
+		),
+	},
+	{
+		Name:   "signer",
+		Usage:  "hold the server key and serve signing and decryption to the frontends via --signer-socket",
+		Action: cliErrorHandler(signerAction),
+		Flags: append(
+			[]cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Value: "./signer.sock",
+					Usage: "`SOCKET_PATH` of the Unix domain socket to listen on",
+				},
+			},
+			serverKeyFlags...,
+		),
+	},
 }
 
-var commonFlags = []cli.Flag{
+// serverKeyFlags configure the private server keys and the certifications made with them.
+var serverKeyFlags = []cli.Flag{
 	cli.StringFlag{
 		Name:  "private-key",
 		Value: "./test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc.gpg",
@@ -194,6 +534,64 @@ var commonFlags = []cli.Flag{
 		// TODO Handle missing value, use better default.
 		Usage: "`PASSPHRASE` of the private key",
 	},
+	cli.StringFlag{
+		Name:  "agent-socket",
+		Usage: "`SOCKET_PATH` of a gpg-agent holding the primary RSA or ECDSA server key, --private-key may then contain the public key only",
+	},
+	cli.StringFlag{
+		Name:  "agent-keygrip",
+		Usage: "`KEYGRIP` of the primary server key in the gpg-agent, may be omitted for RSA keys",
+	},
+	cli.StringSliceFlag{
+		Name:  "old-private-key",
+		Usage: "`PRIVATE_KEY_PATH` to a former private OpenPGP key of the server only used for decryption, can be given multiple times",
+	},
+	cli.StringFlag{
+		Name:  "active-key",
+		Usage: "`FINGERPRINT` or 16 digit key ID of the server key used for certifications, defaults to the first key of --private-key",
+	},
+	cli.DurationFlag{
+		Name:  "certification-lifetime",
+		Value: gpg.DefaultCertificationLifetime,
+		Usage: "Maximum `LIFETIME` of issued certifications, 0 to only expire with the signed key",
+	},
+	cli.StringFlag{
+		Name:  "policy-uri",
+		Value: gpg.DefaultPolicyURI,
+		Usage: "`URI` of the policy referenced by issued certifications, set to the blank value to omit it",
+	},
+	cli.StringSliceFlag{
+		Name:  "notation",
+		Usage: "`NAME@DOMAIN=VALUE` notation added to issued certifications, can be given multiple times",
+	},
+	cli.StringFlag{
+		Name:  "certification-type",
+		Value: "generic",
+		Usage: "`TYPE` of issued certifications, one of generic (0x10), persona (0x11), casual (0x12) or positive (0x13)",
+	},
+	cli.BoolFlag{
+		Name: "local-certifications",
+		Usage: "Issue non-exportable certifications, which are not published by other OpenPGP implementations. " +
+			"They are not kept in the store, so this cannot be combined with --storage file",
+	},
+	cli.BoolFlag{
+		Name:  "minimal-export",
+		Usage: "Send only the confirmed UID of a key with its certification, so that other UIDs are not disclosed",
+	},
+}
+
+// commonFlags configure the frontends.
+var commonFlags = append([]cli.Flag{
+	cli.StringFlag{
+		Name: "signer-socket",
+		Usage: "`SOCKET_PATH` of a signer daemon holding the server key, omit to load the server key in-process. " +
+			"The certification flags must then be given to serve-signer",
+	},
+	cli.IntFlag{
+		Name:  "min-rsa-bits",
+		Value: gpg.DefaultMinRSABits,
+		Usage: "Minimum size in `BITS` of RSA and ElGamal client keys",
+	},
 	cli.StringFlag{
 		Name:  "storage",
 		Value: "file",
@@ -209,12 +607,31 @@ var commonFlags = []cli.Flag{
 		Value: "localhost",
 		Usage: "`SMTP_HOST` of the SMTP server where outgoing mails will be sent to",
 	},
+	cli.DurationFlag{
+		Name:  "nonce-lifetime",
+		Usage: "`LIFETIME` of the confirmation links sent for new requests, expired links are deleted, 0 to never expire",
+	},
+	cli.BoolFlag{
+		Name: "acknowledge-requests",
+		Usage: "Send the requester an encrypted mail listing the addresses, to which confirmation links have been sent. " +
+			"Like rejection replies, it needs --storage file for process-mail",
+	},
+	cli.BoolFlag{
+		Name: "rejection-replies",
+		Usage: "Reply to unsigned, unverifiable or unparseable requests with a mail explaining the rejection. " +
+			"The times of the replies are kept in the store, so process-mail needs --storage file",
+	},
+	cli.DurationFlag{
+		Name:  "rejection-reply-interval",
+		Value: 24 * time.Hour,
+		Usage: "Minimum `INTERVAL` between two rejection replies or acknowledgements to the same address",
+	},
 	cli.StringFlag{
 		Name:  "mail-from",
 		Value: "openpgp-validation-server@server.local",
 		Usage: "`MAIL_FROM` of outgoing mails. This is NOT the FROM header of the mail.",
 	},
-}
+}, serverKeyFlags...)
 
 // RunApp starts the server with the provided arguments.
 func RunApp(args []string) {
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
+	"io/ioutil"
 	"testing"
 	"time"
 
 	"github.com/TNG/openpgp-validation-server/gpg"
 	"github.com/TNG/openpgp-validation-server/storage"
 	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/TNG/openpgp-validation-server/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConfirmNonce(t *testing.T) {
@@ -31,3 +36,116 @@ func TestConfirmNonce(t *testing.T) {
 		Timestamp: time.Now(),
 	})
 }
+
+func TestConfirmNonceListsSignedIdentities(t *testing.T) {
+	store := storage.NewMemoryStore()
+	var nonce [32]byte
+	copy(nonce[:], "signed-identities-nonce")
+
+	serverKeyFile, cleanup := utils.Open(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	defer cleanup()
+	util, err := gpg.NewGPG(serverKeyFile, "validation")
+	require.NoError(t, err)
+
+	keyFile, cleanup := utils.Open(t, "test/keys/test-gpg-validation@client.local (0xE93B112A) pub.asc")
+	defer cleanup()
+	entity, err := util.ReadKey(keyFile)
+	require.NoError(t, err)
+
+	store.Set(nonce, storage.RequestInfo{
+		Key:       entity,
+		Email:     "test-gpg-validation@client.local",
+		Timestamp: time.Now(),
+	})
+	outgoingMail, err := validator.ConfirmNonce(nonce, store, util)
+	require.NoError(t, err)
+	assert.Contains(t, outgoingMail.Message,
+		"signed:\n  TEST-client gpg-validation-server (For Testing Only) <test-gpg-validation@client.local>\n")
+}
+
+func TestRenewalRequestWithoutKey(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+
+	request := signedRequest(t, "Sign this key!", "Please sign this key.", nil)
+	responses := validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	assert.Empty(t, responses, "Keys not certified before must be attached")
+
+	keyFile, cleanup := utils.Open(t, clientKeyPrefix+"pub.asc")
+	defer cleanup()
+	entity, err := util.ReadKey(keyFile)
+	require.NoError(t, err)
+	var nonce [32]byte
+	copy(nonce[:], "renewal-nonce")
+	store.Set(nonce, storage.RequestInfo{
+		Key:       entity,
+		Email:     "test-gpg-validation@client.local",
+		Timestamp: time.Now(),
+	})
+	_, err = validator.ConfirmNonce(nonce, store, util)
+	require.NoError(t, err)
+	require.NotNil(t, store.GetKey(entity.PrimaryKey.KeyId), "Confirmed keys must be stored")
+
+	responses = validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	require.Len(t, responses, 1, "Certified keys need not be attached")
+	assert.Equal(t, "test-gpg-validation@client.local", responses[0].RecipientEmail)
+}
+
+func TestConfirmExpiredNonce(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	keyFile, cleanup := utils.Open(t, clientKeyPrefix+"pub.asc")
+	defer cleanup()
+	entity, err := util.ReadKey(keyFile)
+	require.NoError(t, err)
+
+	var nonce [32]byte
+	copy(nonce[:], "expired-nonce")
+	store.Set(nonce, storage.RequestInfo{
+		Key:       entity,
+		Email:     "test-gpg-validation@client.local",
+		Timestamp: time.Now().Add(-time.Hour),
+		Expires:   time.Now().Add(-time.Minute),
+	})
+	_, err = validator.ConfirmNonce(nonce, store, util)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "expired")
+	}
+	assert.Nil(t, store.GetKey(entity.PrimaryKey.KeyId), "Keys of expired nonces must not be certified")
+	assert.Nil(t, store.Get(nonce), "Expired nonces must be deleted")
+}
+
+func TestConfirmNoncesOfTwoIdentities(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile("test/keys/test-gpg-validation@dual.local (0x7DC44FF8) pub.asc")
+	require.NoError(t, err)
+
+	var keyID uint64
+	emails := []string{"test-gpg-validation@dual.local", "test-gpg-validation-second@dual.local"}
+	for _, email := range emails {
+		entity, err := gpg.UnmarshalKey(key)
+		require.NoError(t, err)
+		keyID = entity.PrimaryKey.KeyId
+		var nonce [32]byte
+		copy(nonce[:], email)
+		store.Set(nonce, storage.RequestInfo{Key: entity, Email: email, Timestamp: time.Now()})
+		_, err = validator.ConfirmNonce(nonce, store, util)
+		require.NoError(t, err, "Confirmation of %v failed", email)
+	}
+
+	storedKey := store.GetKey(keyID)
+	require.NotNil(t, storedKey)
+	for _, email := range emails {
+		certified := false
+		for _, identity := range storedKey.Identities {
+			if identity.UserId.Email != email {
+				continue
+			}
+			for _, sig := range identity.Signatures {
+				certified = certified || (sig.IssuerKeyId != nil && *sig.IssuerKeyId == 0x5AE5111887144E5E)
+			}
+		}
+		assert.True(t, certified, "Certification of %v must be kept", email)
+	}
+}
@@ -24,24 +24,33 @@ func getIncomingMailEnvelopeHandler(httpHost string) func(*smtp.MailEnvelope) {
 	}
 }
 
-func getIncomingMailHandler(httpHost string) func(io.Reader) {
-	return func(incomingMail io.Reader) {
-		handleIncomingMail(incomingMail, httpHost)
-	}
-}
-
 func handleIncomingMailEnvelope(incomingMail *smtp.MailEnvelope, httpHost string) {
-	handleIncomingMail(bytes.NewReader(incomingMail.Content), httpHost)
+	handleIncomingMail(bytes.NewReader(incomingMail.Content), httpHost, incomingMail)
 }
 
-func handleIncomingMail(incomingMail io.Reader, httpHost string) {
+// handleIncomingMail processes an incoming mail, sends the resulting nonce mails and returns the result. If enabled, an
+// acknowledgement is sent for accepted mails, and a rejection reply is sent for rejected mails to the sender of the
+// envelope, or to the From address if envelope is nil.
+func handleIncomingMail(incomingMail io.Reader, httpHost string, envelope *smtp.MailEnvelope) *validator.Result {
 	if gpgUtil == nil {
 		log.Panicf("Missing gpg init!")
 	}
 
-	for _, responseMail := range validator.HandleMail(incomingMail, gpgUtil, store, httpHost) {
+	result := validator.HandleMail(incomingMail, gpgUtil, store, httpHost)
+	for _, responseMail := range result.Responses {
 		sendOutgoingMail("nonce", &responseMail)
 	}
+	if acknowledger != nil {
+		if acknowledgement := acknowledger.Acknowledge(result); acknowledgement != nil {
+			sendOutgoingMail("acknowledgement", acknowledgement)
+		}
+	}
+	if rejectionReplier != nil {
+		if reply := rejectionReplier.Reply(result, envelope); reply != nil {
+			sendOutgoingMail("rejection", reply)
+		}
+	}
+	return result
 }
 
 // sendOutgoingMail sends a mail via SMTP if configured. A corresponding mail file is written for debugging purposes.
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TNG/openpgp-validation-server/mail"
+	"github.com/TNG/openpgp-validation-server/smtp"
+	"github.com/TNG/openpgp-validation-server/storage"
+	"github.com/TNG/openpgp-validation-server/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const clientFingerprint = "794FFD8896C89322DEE24CDB42744CC1E93B112A"
+
+func TestHandleMailResult(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+
+	result := validator.HandleMail(bytes.NewReader(signedRequest(t, "Sign this key!", "Please sign this key.", key)),
+		util, storage.NewMemoryStore(), "localhost")
+	assert.False(t, result.Rejected())
+	assert.True(t, result.Parsed)
+	assert.Equal(t, "GPG Client <test-gpg-validation@client.local>", result.Sender)
+	assert.Equal(t, clientFingerprint, result.Signer)
+	assert.Equal(t, mail.KeySourceAttached, result.KeySource)
+	assert.False(t, result.Revoke)
+	assert.Equal(t, []validator.UIDResult{{
+		UserID:    "TEST-client gpg-validation-server (For Testing Only) <test-gpg-validation@client.local>",
+		Email:     "test-gpg-validation@client.local",
+		NonceSent: true,
+	}}, result.UIDs)
+	assert.Empty(t, result.Errors)
+	assert.Len(t, result.Responses, 1)
+
+	result = validator.HandleMail(bytes.NewReader(signedRequest(t, "Revoke", "", key)), util,
+		storage.NewMemoryStore(), "localhost")
+	assert.True(t, result.Rejected())
+	assert.True(t, result.Revoke)
+	require.Len(t, result.UIDs, 1)
+	assert.False(t, result.UIDs[0].NonceSent)
+	assert.Equal(t, "not certified", result.UIDs[0].SkipReason)
+	assert.Equal(t, []string{"Key 42744CC1E93B112A has no certified identities to revoke"}, result.Errors)
+}
+
+func TestHandleMailResultRejected(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	request, err := ioutil.ReadFile("test/mails/plaintext.eml")
+	require.NoError(t, err)
+
+	result := validator.HandleMail(bytes.NewReader(request), util, nil, "localhost")
+	assert.True(t, result.Rejected())
+	assert.True(t, result.Parsed)
+	assert.Empty(t, result.Signer)
+	require.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0], "missing valid signature")
+
+	result = validator.HandleMail(strings.NewReader("Content-Type: multipart/mixed\n\nNo boundary"), util, nil,
+		"localhost")
+	assert.True(t, result.Rejected())
+	assert.False(t, result.Parsed)
+	require.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0], "Cannot parse mail")
+
+	output, err := json.Marshal(result)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(output, &fields))
+	assert.Equal(t, false, fields["parsed"])
+	assert.Equal(t, []interface{}{}, fields["uids"])
+	assert.Len(t, fields["errors"], 1)
+	assert.NotContains(t, fields, "Responses", "Outgoing mails must not be printed")
+}
+
+func TestRejectionReply(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	store := storage.NewMemoryStore()
+	replier := validator.RejectionReplier{GPG: util, OwnAddresses: []string{"openpgp-validation-server@server.local"},
+		Limiter: validator.NewRateLimiter(time.Hour, store)}
+	request, err := ioutil.ReadFile("test/mails/plaintext.eml")
+	require.NoError(t, err)
+
+	result := validator.HandleMail(bytes.NewReader(request), util, nil, "localhost")
+	assert.Equal(t, validator.ReasonUnsigned, result.Reason)
+	reply := replier.Reply(result, nil)
+	require.NotNil(t, reply, "Reply must be sent to the From address")
+	assert.Equal(t, "server@server.local", reply.RecipientEmail)
+	assert.Nil(t, reply.RecipientKey, "Replies are not encrypted")
+	assert.Contains(t, reply.Message, "The mail is not signed.")
+	assert.Nil(t, replier.Reply(result, nil), "Replies to the same address must be rate limited")
+	restarted := validator.RejectionReplier{GPG: util, Limiter: validator.NewRateLimiter(time.Hour, store)}
+	assert.Nil(t, restarted.Reply(result, nil), "Rate limit must be kept in the store")
+
+	reply = replier.Reply(result, &smtp.MailEnvelope{From: "Envelope@client.local"})
+	require.NotNil(t, reply, "Reply must be sent to the envelope sender")
+	assert.Equal(t, "Envelope@client.local", reply.RecipientEmail)
+	assert.Nil(t, replier.Reply(result, &smtp.MailEnvelope{From: "envelope@client.local"}),
+		"Rate limit must ignore the case of addresses")
+
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+	accepted := validator.HandleMail(bytes.NewReader(signedRequest(t, "Sign this key!", "", key)), util, nil, "localhost")
+	assert.Nil(t, replier.Reply(accepted, &smtp.MailEnvelope{From: "accepted@client.local"}))
+}
+
+func TestRejectionReplyReasons(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	replier := validator.RejectionReplier{GPG: util}
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+	otherKey, err := ioutil.ReadFile("test/keys/test-gpg-validation@other.local (0xF043F26E) pub.asc")
+	require.NoError(t, err)
+	sha1Request, err := ioutil.ReadFile("test/mails/signed_request_sha1.eml")
+	require.NoError(t, err)
+	tampered := bytes.Replace(signedRequest(t, "Sign this key!", "Please sign this key.", key),
+		[]byte("Please sign"), []byte("Please sigh"), 1)
+
+	for _, test := range []struct {
+		request []byte
+		reason  validator.RejectReason
+		message string
+	}{
+		{[]byte("Content-Type: multipart/mixed\n\nNo boundary"), validator.ReasonUnparseable, "could not be read"},
+		{signedRequest(t, "Sign this key!", "", nil), validator.ReasonNoKey, "No key attached"},
+		{signedRequest(t, "Sign this key!", "", otherKey), validator.ReasonNoKey, "No key attached"},
+		{tampered, validator.ReasonInvalidSignature, "The signature is invalid"},
+		{sha1Request, validator.ReasonWeakHash, "weak hash algorithm"},
+		{signedRequest(t, "Revoke", "", key), validator.ReasonNotCertified, "nothing to revoke"},
+	} {
+		result := validator.HandleMail(bytes.NewReader(test.request), util, nil, "localhost")
+		assert.Equal(t, test.reason, result.Reason)
+		reply := replier.Reply(result, &smtp.MailEnvelope{From: "test-gpg-validation@client.local"})
+		if assert.NotNil(t, reply, string(test.reason)) {
+			assert.Contains(t, reply.Message, test.message)
+		}
+	}
+}
+
+func TestRejectionReplyLoopProtection(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	replier := validator.RejectionReplier{GPG: util, OwnAddresses: []string{"openpgp-validation-server@server.local"}}
+	request := "From: Client <test-gpg-validation@client.local>\nSubject: Sign this key!\n"
+
+	for _, test := range []struct {
+		header string
+		sender string
+	}{
+		{"", ""},
+		{"Auto-Submitted: auto-replied\n", "test-gpg-validation@client.local"},
+		{"Precedence: bulk\n", "test-gpg-validation@client.local"},
+		{"List-Id: <requests.client.local>\n", "test-gpg-validation@client.local"},
+		{"Content-Type: multipart/report; report-type=delivery-status; boundary=x\n", "test-gpg-validation@client.local"},
+		{"", "MAILER-DAEMON@client.local"},
+		{"", "openpgp-validation-server@server.local"},
+		{"", "test-gpg-validation@server.local"},
+	} {
+		result := validator.HandleMail(strings.NewReader(request+test.header+"\nPlease sign this key."), util, nil,
+			"localhost")
+		require.True(t, result.Rejected())
+		assert.Nil(t, replier.Reply(result, &smtp.MailEnvelope{From: test.sender}), test.header+test.sender)
+	}
+
+	result := validator.HandleMail(strings.NewReader(request+"Auto-Submitted: no\n\nPlease sign this key."), util, nil,
+		"localhost")
+	assert.NotNil(t, replier.Reply(result, &smtp.MailEnvelope{From: "test-gpg-validation@client.local"}))
+}
+
+func TestAcknowledgement(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+
+	request := signedRequest(t, "Sign this key!", "Please sign this key.", key)
+	result := validator.HandleMail(bytes.NewReader(request), util, nil, "localhost")
+	acknowledgement := result.Acknowledgement
+	require.NotNil(t, acknowledgement)
+	assert.Equal(t, "test-gpg-validation@client.local", acknowledgement.RecipientEmail)
+	require.NotNil(t, acknowledgement.RecipientKey, "Acknowledgements must be encrypted to the requester")
+	assert.Equal(t, result.Responses[0].RecipientKey, acknowledgement.RecipientKey)
+	assert.Contains(t, acknowledgement.Message, "validate the OpenPGP Key with the\nfingerprint \""+clientFingerprint)
+	assert.Contains(t, acknowledgement.Message, "to each of these addresses:\n\n  test-gpg-validation@client.local\n")
+	assert.NotContains(t, acknowledgement.Message, "confirmed until", "Nonces do not expire by default")
+	assert.NotContains(t, acknowledgement.Message, "We did not send", "No user ID has been skipped")
+
+	content, err := acknowledgement.Bytes()
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "-----BEGIN PGP MESSAGE-----")
+
+	rejected := validator.HandleMail(bytes.NewReader(signedRequest(t, "Revoke", "", key)), util, nil,
+		"localhost")
+	assert.Nil(t, rejected.Acknowledgement, "Rejected requests are not acknowledged")
+
+	forged := bytes.Replace(request, []byte("From: GPG Client <test-gpg-validation@client.local>"),
+		[]byte("From: Someone Else <someone@client.local>"), 1)
+	result = validator.HandleMail(bytes.NewReader(forged), util, nil, "localhost")
+	require.Len(t, result.Responses, 1)
+	assert.Nil(t, result.Acknowledgement, "Only addresses of user IDs of the key get acknowledgements")
+}
+
+func TestAcknowledger(t *testing.T) {
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+	request := signedRequest(t, "Sign this key!", "Please sign this key.", key)
+	acknowledger := validator.Acknowledger{GPG: util, Limiter: validator.NewRateLimiter(time.Hour,
+		storage.NewMemoryStore())}
+
+	automatic := append([]byte("Auto-Submitted: auto-replied\n"), request...)
+	result := validator.HandleMail(bytes.NewReader(automatic), util, nil, "localhost")
+	require.NotNil(t, result.Acknowledgement)
+	assert.Nil(t, acknowledger.Acknowledge(result), "Automatic mails must not be acknowledged")
+
+	result = validator.HandleMail(bytes.NewReader(request), util, nil, "localhost")
+	acknowledgement := acknowledger.Acknowledge(result)
+	require.NotNil(t, acknowledgement)
+	assert.Equal(t, "test-gpg-validation@client.local", acknowledgement.RecipientEmail)
+	assert.Nil(t, acknowledger.Acknowledge(result), "Acknowledgements to the same address must be rate limited")
+}
+
+func TestNonceLifetime(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+
+	validator.NonceLifetime = 7 * 24 * time.Hour
+	defer func() { validator.NonceLifetime = 0 }()
+	var expired [validator.NonceLength]byte
+	copy(expired[:], "expired-nonce")
+	store.Set(expired, storage.RequestInfo{Email: "test-gpg-validation@client.local",
+		Timestamp: time.Now().Add(-8 * 24 * time.Hour), Expires: time.Now().Add(-24 * time.Hour)})
+
+	before := time.Now()
+	result := validator.HandleMail(bytes.NewReader(signedRequest(t, "Sign this key!", "Please sign this key.", key)),
+		util, store, "localhost")
+	require.Len(t, result.Responses, 1)
+	require.NotNil(t, result.Acknowledgement)
+	expiry := before.Add(validator.NonceLifetime).Format(time.RFC1123Z)[:len("Mon, 02 Jan 2006")]
+	assert.Contains(t, result.Responses[0].Message, "The link can be confirmed until "+expiry)
+	assert.Contains(t, result.Acknowledgement.Message, "The links can be confirmed until "+expiry)
+
+	requestInfo := store.Get(nonceFromMessage(t, result.Responses[0].Message))
+	require.NotNil(t, requestInfo)
+	assert.Equal(t, requestInfo.Timestamp.Add(validator.NonceLifetime), requestInfo.Expires)
+	assert.Nil(t, store.Get(expired), "Expired nonces are deleted when new requests are handled")
+}
+
+func TestInlineSignedRequest(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	request, err := ioutil.ReadFile("test/mails/inline_signed_request.eml")
+	require.NoError(t, err)
+
+	responses := validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	require.Len(t, responses, 1)
+	assert.Equal(t, "test-gpg-validation@client.local", responses[0].RecipientEmail)
+	requestInfo := store.Get(nonceFromMessage(t, responses[0].Message))
+	require.NotNil(t, requestInfo)
+	assert.False(t, requestInfo.Revoke)
+
+	request = bytes.Replace(request, []byte("Subject: Sign this key!"), []byte("Subject: revoke"), 1)
+	responses = validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	assert.Empty(t, responses, "Only certified keys can be revoked")
+}
+
+func TestEncryptedSignedPartRequest(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	request, err := ioutil.ReadFile("test/mails/encrypted_signed_part_request.eml")
+	require.NoError(t, err)
+
+	responses := validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	require.Len(t, responses, 1)
+	assert.Equal(t, "test-gpg-validation@client.local", responses[0].RecipientEmail)
+	assert.NotNil(t, store.Get(nonceFromMessage(t, responses[0].Message)))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/storage"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/TNG/openpgp-validation-server/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const clientKeyPrefix = "test/keys/test-gpg-validation@client.local (0xE93B112A) "
+
+func loadGPG(t *testing.T, path string) *gpg.GPG {
+	keyFile, cleanup := utils.Open(t, path)
+	defer cleanup()
+	util, err := gpg.NewGPG(keyFile, "validation")
+	require.NoError(t, err)
+	return util
+}
+
+// signedRequest returns a PGP/MIME mail signed by the client key, which contains the given text and key. The key is
+// not attached if it is nil.
+func signedRequest(t *testing.T, subject, text string, key []byte) []byte {
+	signedPart := "Content-Type: multipart/mixed; boundary=\"inner\"\n\n" +
+		"--inner\nContent-Type: text/plain; charset=utf-8\n\n" + text + "\n\n"
+	if key != nil {
+		signedPart += "--inner\nContent-Type: application/pgp-keys; name=\"0xE93B112A.asc\"\n" +
+			"Content-Disposition: attachment; filename=\"0xE93B112A.asc\"\n\n" + string(key) + "\n"
+	}
+	signedPart += "--inner--\n"
+	signedPart = strings.Replace(signedPart, "\n", "\r\n", -1)
+
+	signature := new(bytes.Buffer)
+	client := loadGPG(t, clientKeyPrefix+"sec.asc")
+	require.NoError(t, client.SignMessage(strings.NewReader(signedPart), signature))
+
+	return []byte(fmt.Sprintf("From: GPG Client <test-gpg-validation@client.local>\n"+
+		"To: test-gpg-validation@server.local\nSubject: %s\nMIME-Version: 1.0\n"+
+		"Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; "+
+		"boundary=\"outer\"\n\n"+
+		"--outer\n%s\n--outer\nContent-Type: application/pgp-signature; name=\"signature.asc\"\n"+
+		"Content-Disposition: attachment; filename=\"signature.asc\"\n\n%s\n--outer--\n",
+		subject, signedPart, signature.String()))
+}
+
+// nonceFromMessage returns the nonce contained in the confirmation link of a nonce mail.
+func nonceFromMessage(t *testing.T, message string) [validator.NonceLength]byte {
+	link := message[strings.Index(message, "/confirm/")+len("/confirm/"):]
+	nonce, err := validator.NonceFromString(strings.SplitN(link, "\n", 2)[0])
+	require.NoError(t, err)
+	return nonce
+}
+
+func TestRevocationRequest(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+
+	keyFile, cleanup := utils.Open(t, clientKeyPrefix+"pub.asc")
+	defer cleanup()
+	clientKey, err := util.ReadKey(keyFile)
+	require.NoError(t, err)
+	certifiedKey := new(bytes.Buffer)
+	_, err = util.SignUserID("test-gpg-validation@client.local", clientKey, certifiedKey)
+	require.NoError(t, err)
+
+	request := signedRequest(t, "Key", "Revoke the certification of this key, please.", certifiedKey.Bytes())
+	responses := validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	require.Len(t, responses, 1)
+	assert.Equal(t, "test-gpg-validation@client.local", responses[0].RecipientEmail)
+	assert.Contains(t, responses[0].Message, "revoke the certification")
+
+	nonce := nonceFromMessage(t, responses[0].Message)
+	requestInfo := store.Get(nonce)
+	require.NotNil(t, requestInfo)
+	assert.True(t, requestInfo.Revoke)
+
+	outgoingMail, err := validator.ConfirmNonce(nonce, store, util)
+	require.NoError(t, err)
+	assert.Equal(t, "OpenPGP Key Validation Revoked", outgoingMail.Subject)
+	assert.Contains(t, outgoingMail.Message, "Revoked on request of the key owner")
+}
+
+func TestRevocationRequestWithoutCertification(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+
+	request := signedRequest(t, "Revoke", "", key)
+	responses := validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	assert.Empty(t, responses, "Only certified keys can be revoked")
+
+	request = signedRequest(t, "Sign this key!", "Please sign this key.", key)
+	responses = validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+	require.Len(t, responses, 1)
+	requestInfo := store.Get(nonceFromMessage(t, responses[0].Message))
+	require.NotNil(t, requestInfo)
+	assert.False(t, requestInfo.Revoke, "Requests without the revoke command ask for a certification")
+}
+
+func TestRevokeMentionedInText(t *testing.T) {
+	store := storage.NewMemoryStore()
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	key, err := ioutil.ReadFile(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+
+	for _, request := range [][]byte{
+		signedRequest(t, "Sign this key!", "Please sign, do not revoke anything", key),
+		signedRequest(t, "Re: revoke", "> revoke\n\nPlease sign this key.", key),
+	} {
+		responses := validator.HandleMail(bytes.NewReader(request), util, store, "localhost").Responses
+		require.Len(t, responses, 1)
+		requestInfo := store.Get(nonceFromMessage(t, responses[0].Message))
+		require.NotNil(t, requestInfo)
+		assert.False(t, requestInfo.Revoke, "Only an explicit revoke command asks for a revocation")
+	}
+}
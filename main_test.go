@@ -1,9 +1,19 @@
 package main
 
 import (
+	"crypto"
 	"fmt"
+	"github.com/TNG/openpgp-validation-server/agent"
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/signer"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -52,21 +62,220 @@ func testProcessMail(t *testing.T, expectedExitCode int, file string, args ...st
 }
 
 func TestProcessMailFilesSuccessfully(t *testing.T) {
-	testProcessMail(t, okExitCode, "attachment.eml")
 	testProcessMail(t, okExitCode, "crypted_signed_request_enigmail.eml")
-	testProcessMail(t, okExitCode, "plaintext.eml")
-	testProcessMail(t, okExitCode, "signed_multipart_simple.eml")
+	testProcessMail(t, okExitCode, "encrypted_signed_part_request.eml")
+	testProcessMail(t, okExitCode, "inline_armored_request.eml")
+	testProcessMail(t, okExitCode, "inline_signed_attached_key.eml")
+	testProcessMail(t, okExitCode, "inline_signed_request.eml")
+	testProcessMail(t, okExitCode, "signed_request_base64_key.eml")
 	testProcessMail(t, okExitCode, "signed_request_enigmail.eml")
 }
 
+func TestProcessMailFilesRejected(t *testing.T) {
+	testProcessMail(t, rejectedExitCode, "attachment.eml")
+	testProcessMail(t, rejectedExitCode, "plaintext.eml")
+	testProcessMail(t, rejectedExitCode, "plaintext_base64.eml")
+	testProcessMail(t, rejectedExitCode, "plaintext_quoted_printable.eml")
+	testProcessMail(t, rejectedExitCode, "signed_multipart_simple.eml")
+	testProcessMail(t, rejectedExitCode, "signed_request_sha1.eml")
+	testProcessMail(t, rejectedExitCode, "transfer_encodings.eml")
+	testProcessMail(t, rejectedExitCode, "plaintext.eml", "--rejection-replies", "--rejection-reply-interval", "1h")
+	testProcessMail(t, errorExitCode, "plaintext.eml", "--rejection-replies", "--storage", "memory")
+	testProcessMail(t, errorExitCode, "plaintext.eml", "--rejection-replies", "--storage", "none")
+}
+
+func TestProcessMailOutputFormats(t *testing.T) {
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--output", "json")
+	testProcessMail(t, rejectedExitCode, "plaintext.eml", "--output", "json")
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--output", "text")
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--acknowledge-requests")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--acknowledge-requests", "--storage", "memory")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--output", "xml")
+}
+
 func TestProcessFileError(t *testing.T) {
 	testProcessMail(t, errorExitCode, "invalid")
 }
 
 func TestProcessMailStorageTypes(t *testing.T) {
-	testProcessMail(t, okExitCode, "attachment.eml", "--storage", "none")
-	testProcessMail(t, okExitCode, "attachment.eml", "--storage", "memory")
-	testProcessMail(t, okExitCode, "attachment.eml", "--storage", "file")
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--storage", "none")
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--storage", "memory")
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--storage", "file")
+
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--storage", "invalid")
+}
+
+func TestProcessMailLocalCertifications(t *testing.T) {
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--local-certifications", "--storage", "memory")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--local-certifications", "--storage", "file")
+}
+
+func TestProcessMailWithSeveralServerKeys(t *testing.T) {
+	eccKey := "./test/keys/test-gpg-validation@ecc-server.local (0x459EB685) sec.asc"
+	testProcessMail(t, okExitCode, "crypted_signed_request_enigmail.eml", "--private-key", eccKey,
+		"--old-private-key", "./test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--active-key", "0x5AE5111887144E5E")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--active-key", "0xC89B744D459EB685")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--old-private-key", "does_not_exist")
+}
+
+func TestCrossSignKey(t *testing.T) {
+	outputFile, err := ioutil.TempFile("", "cross-signed")
+	require.NoError(t, err)
+	outputPath := outputFile.Name()
+	require.NoError(t, outputFile.Close())
+	defer func() { _ = os.Remove(outputPath) }()
+
+	testMainWithArguments(t, okExitCode, "cross-sign-key", "--output", outputPath,
+		"--new-key", "./test/keys/test-gpg-validation@ecc-server.local (0x459EB685) pub.asc")
+	output, err := ioutil.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+
+	testMainWithArguments(t, errorExitCode, "cross-sign-key", "--new-key", "does_not_exist")
+	testMainWithArguments(t, errorExitCode, "cross-sign-key",
+		"--new-key", "./test/keys/test-gpg-validation@server.local (0x87144E5E) pub.asc")
+}
+
+// startSigner runs a signer daemon holding the given server key on a socket in dir and returns the socket path.
+func startSigner(t *testing.T, dir, keyPath string) (socketPath string, stop func()) {
+	socketPath = filepath.Join(dir, "signer.sock")
+	keyFile, err := os.Open(keyPath)
+	require.NoError(t, err)
+	defer func() { _ = keyFile.Close() }()
+	util, err := gpg.NewGPG(keyFile, "validation")
+	require.NoError(t, err)
+	server, err := signer.NewServer(socketPath, util)
+	require.NoError(t, err)
+	go func() { _ = server.Run() }()
+	return socketPath, func() { _ = server.Close() }
+}
+
+func TestProcessMailWithSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socketPath, stop := startSigner(t, dir, "./test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	defer stop()
+	testProcessMail(t, okExitCode, "crypted_signed_request_enigmail.eml", "--signer-socket", socketPath,
+		"--private-key", "does_not_exist")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--signer-socket", filepath.Join(dir, "missing.sock"))
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--signer-socket", socketPath,
+		"--certification-lifetime", "24h")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--signer-socket", socketPath,
+		"--local-certifications")
+}
+
+func TestProcessMailWithEd25519Signer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socketPath, stop := startSigner(t, dir, "./test/keys/test-gpg-validation@ecc-server.local (0x459EB685) sec.asc")
+	defer stop()
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--signer-socket", socketPath,
+		"--private-key", "does_not_exist")
+}
+
+func TestProcessMailWithAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	socketPath := filepath.Join(dir, "S.gpg-agent")
+
+	keyFile, err := os.Open("./test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	require.NoError(t, err)
+	defer func() { _ = keyFile.Close() }()
+	key, err := gpg.NewSoftwareSigner(keyFile, "validation")
+	require.NoError(t, err)
+	keygrip, err := agent.Keygrip(key.Public())
+	require.NoError(t, err)
+	standIn, err := agent.NewStandIn(socketPath, map[string]crypto.Signer{keygrip: key})
+	require.NoError(t, err)
+	defer func() { _ = standIn.Close() }()
+	go func() { _ = standIn.Run() }()
+
+	testProcessMail(t, okExitCode, "signed_request_enigmail.eml", "--agent-socket", socketPath)
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--agent-socket", socketPath,
+		"--private-key", "./test/keys/test-gpg-validation@client.local (0xE93B112A) pub.asc")
+	testProcessMail(t, errorExitCode, "signed_request_enigmail.eml", "--agent-socket", socketPath,
+		"--private-key", "./test/keys/test-gpg-validation@ecc-server.local (0x459EB685) pub.asc")
+}
+
+func TestRevokeCertificationErrorCases(t *testing.T) {
+	clientKey := "./test/keys/test-gpg-validation@client.local (0xE93B112A) pub.asc"
+	testMainWithArguments(t, errorExitCode, "revoke-certification", "--key", "does_not_exist",
+		"--fingerprint", "0x42744CC1E93B112A", "--email", "test-gpg-validation@client.local")
+	testMainWithArguments(t, errorExitCode, "revoke-certification", "--key", clientKey,
+		"--fingerprint", "0x5AE5111887144E5E", "--email", "test-gpg-validation@client.local")
+	testMainWithArguments(t, errorExitCode, "revoke-certification", "--key", clientKey,
+		"--fingerprint", "0x42744CC1E93B112A", "--email", "impostor@faux.fake")
+	testMainWithArguments(t, errorExitCode, "revoke-certification", "--key", clientKey,
+		"--fingerprint", "0x42744CC1E93B112A", "--email", "test-gpg-validation@client.local", "--reason", "2")
+}
+
+// startSMTPSink runs an SMTP server accepting and discarding all mails and returns its port.
+func startSMTPSink(t *testing.T) (port int, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTPSink(textproto.NewConn(conn))
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, func() { _ = listener.Close() }
+}
+
+func serveSMTPSink(conn *textproto.Conn) {
+	defer func() { _ = conn.Close() }()
+	_ = conn.PrintfLine("220 localhost")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "DATA":
+			_ = conn.PrintfLine("354 Go ahead")
+			_, _ = conn.ReadDotBytes()
+			_ = conn.PrintfLine("250 OK")
+		case "QUIT":
+			_ = conn.PrintfLine("221 Bye")
+			return
+		default:
+			_ = conn.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestRevokeCertificationWithOldKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revoke")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	util := loadGPG(t, "test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")
+	keyFile, err := os.Open(clientKeyPrefix + "pub.asc")
+	require.NoError(t, err)
+	defer func() { _ = keyFile.Close() }()
+	clientKey, err := util.ReadKey(keyFile)
+	require.NoError(t, err)
+	certifiedKey, err := os.Create(filepath.Join(dir, "certified.asc"))
+	require.NoError(t, err)
+	_, err = util.SignUserID("test-gpg-validation@client.local", clientKey, certifiedKey)
+	require.NoError(t, err)
+	require.NoError(t, certifiedKey.Close())
 
-	testProcessMail(t, errorExitCode, "attachment.eml", "--storage", "invalid")
+	port, stop := startSMTPSink(t)
+	defer stop()
+	args := []string{"revoke-certification", "--key", certifiedKey.Name(), "--fingerprint", "0x42744CC1E93B112A",
+		"--email", "test-gpg-validation@client.local", "--smtp-out-host", "127.0.0.1",
+		"--smtp-out-port", fmt.Sprint(port), "--private-key", "./test/keys/test-gpg-validation@ecc-server.local (0x459EB685) sec.asc"}
+	testMainWithArguments(t, errorExitCode, args...)
+	testMainWithArguments(t, okExitCode, append(args,
+		"--old-private-key", "./test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc")...)
 }
@@ -0,0 +1,242 @@
+package signer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+)
+
+// remoteErrors are the errors of the gpg package, which are restored by the client after crossing the socket.
+var remoteErrors = []error{
+	gpg.ErrNoPrivateKey,
+	gpg.ErrMessageNotSigned,
+	gpg.ErrMessageNotEncrypted,
+	gpg.ErrUnknownIdentity,
+	gpg.ErrKeyExpired,
+	gpg.ErrUnknownIssuer,
+	gpg.ErrInvalidRevocationReason,
+	io.EOF,
+}
+
+// Client forwards the operations needing the server key to a signer daemon. Operations on public keys only are
+// performed locally.
+type Client struct {
+	socketPath     string
+	serverIdentity string
+
+	mutex     sync.Mutex
+	rpcClient *rpc.Client
+
+	// KeyPolicy describes the requirements for client keys checked by CheckKey.
+	KeyPolicy gpg.KeyPolicy
+}
+
+// NewClient connects to the signer daemon listening on the given socket.
+func NewClient(socketPath string) (*Client, error) {
+	rpcClient, err := rpc.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{socketPath: socketPath, rpcClient: rpcClient, KeyPolicy: gpg.DefaultKeyPolicy()}
+	if err = client.call("ServerIdentity", struct{}{}, &client.serverIdentity); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close closes the connection to the signer daemon.
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.rpcClient.Close()
+}
+
+// call invokes a method of the signer daemon. The connection is re-established once, if the daemon has been
+// restarted in the meantime.
+func (client *Client) call(method string, args interface{}, reply interface{}) error {
+	client.mutex.Lock()
+	rpcClient := client.rpcClient
+	client.mutex.Unlock()
+
+	err := rpcClient.Call(serviceName+"."+method, args, reply)
+	if err == rpc.ErrShutdown {
+		if rpcClient, err = client.redial(rpcClient); err != nil {
+			return err
+		}
+		err = rpcClient.Call(serviceName+"."+method, args, reply)
+	}
+	return restoreError(err)
+}
+
+func (client *Client) redial(broken *rpc.Client) (*rpc.Client, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.rpcClient != broken {
+		return client.rpcClient, nil
+	}
+
+	rpcClient, err := rpc.Dial("unix", client.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	client.rpcClient = rpcClient
+	return rpcClient, nil
+}
+
+// restoreError maps errors reported by the signer daemon back to the errors of the gpg package.
+func restoreError(err error) error {
+	if serverError, ok := err.(rpc.ServerError); ok {
+		for _, remoteError := range remoteErrors {
+			if string(serverError) == remoteError.Error() {
+				return remoteError
+			}
+		}
+	}
+	return err
+}
+
+// ServerIdentity returns the identity of the active server key of the signer daemon at the time of connecting.
+func (client *Client) ServerIdentity() string {
+	return client.serverIdentity
+}
+
+// ReadKey reads a PGP public key from the given reader.
+func (client *Client) ReadKey(r io.Reader) (gpg.Key, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return gpg.UnmarshalKey(data)
+}
+
+// ReadKeyRing reads all PGP public keys from the given reader.
+func (client *Client) ReadKeyRing(r io.Reader) ([]gpg.Key, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return gpg.UnmarshalKeyRing(data)
+}
+
+// FindSigner returns the key among keys, which made the given detached signature.
+func (client *Client) FindSigner(keys []gpg.Key, signature io.Reader) (gpg.Key, error) {
+	return gpg.FindSigner(keys, signature)
+}
+
+// VerifyInlineMessage checks the signature of a clear-signed or armored signed message and returns the key among
+// keys that made it together with the signed plain text.
+func (client *Client) VerifyInlineMessage(message io.Reader, keys []gpg.Key) (gpg.Key, []byte, error) {
+	return gpg.VerifyInlineMessage(message, keys)
+}
+
+// CheckKey checks whether the given client key complies with the key policy.
+func (client *Client) CheckKey(key gpg.Key) gpg.KeyReport {
+	return client.KeyPolicy.Check(key, time.Now())
+}
+
+// CheckMessageSignature checks whether an armored detached signature is valid for a given message and has been made by the given signer.
+func (client *Client) CheckMessageSignature(message io.Reader, signature io.Reader, checkedSignerKey gpg.Key) error {
+	return gpg.CheckMessageSignature(message, signature, checkedSignerKey)
+}
+
+// SignUserID lets the signer daemon certify the identities of the given key matching the given email and writes the
+// signed public key to w. The names of the certified identities are returned in lexical order.
+func (client *Client) SignUserID(signedEMail string, pubkey gpg.Key, w io.Writer) ([]string, error) {
+	key, err := gpg.MarshalKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	var reply SignUserIDReply
+	if err = client.call("SignUserID", SignUserIDArgs{Email: signedEMail, Key: key}, &reply); err != nil {
+		return nil, err
+	}
+	_, err = w.Write(reply.SignedKey)
+	return reply.Identities, err
+}
+
+// RevokeCertification lets the signer daemon revoke the certifications of the identities of the given key matching
+// the given email and writes the public key including the revocations to w. The names of the identities are returned
+// in lexical order.
+func (client *Client) RevokeCertification(email string, key gpg.Key, reason gpg.RevocationReason, reasonText string,
+	w io.Writer) ([]string, error) {
+	data, err := gpg.MarshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	args := RevokeCertificationArgs{Email: email, Key: data, Reason: reason, ReasonText: reasonText}
+	var reply RevokeCertificationReply
+	if err = client.call("RevokeCertification", args, &reply); err != nil {
+		return nil, err
+	}
+	_, err = w.Write(reply.RevokedKey)
+	return reply.Identities, err
+}
+
+// CertifiedIdentities asks the signer daemon for the identities of the given key, which are currently certified by a
+// server key. Errors are logged and reported as no certified identities.
+func (client *Client) CertifiedIdentities(key gpg.Key) []string {
+	data, err := gpg.MarshalKey(key)
+	if err == nil {
+		var identities []string
+		if err = client.call("CertifiedIdentities", data, &identities); err == nil {
+			return identities
+		}
+	}
+	log.Printf("Cannot look up certified identities: %v", err)
+	return nil
+}
+
+// encryptStream collects the plaintext and lets the signer daemon sign and encrypt it on Close.
+type encryptStream struct {
+	bytes.Buffer
+	client    *Client
+	output    io.Writer
+	recipient []byte
+}
+
+func (s *encryptStream) Close() error {
+	var cipherText []byte
+	err := s.client.call("EncryptMessage", EncryptMessageArgs{Recipient: s.recipient, Plaintext: s.Bytes()}, &cipherText)
+	if err != nil {
+		return err
+	}
+	_, err = s.output.Write(cipherText)
+	return err
+}
+
+// EncryptMessage returns a stream, which lets the signer daemon sign and encrypt the written plain text for the
+// given recipient. The cipher text is written to output when the stream is closed.
+func (client *Client) EncryptMessage(output io.Writer, recipient gpg.Key) (plaintext io.WriteCloser, err error) {
+	key, err := gpg.MarshalKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptStream{client: client, output: output, recipient: key}, nil
+}
+
+// DecryptPackets lets the signer daemon decrypt a message sent to server and returns the OpenPGP message it contains.
+func (client *Client) DecryptPackets(message io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	var packets []byte
+	if err = client.call("DecryptPackets", data, &packets); err != nil {
+		return nil, err
+	}
+	return packets, nil
+}
+
+// ReadDecryptedMessage reads the OpenPGP message returned by DecryptPackets and checks its signature, if it has
+// been made by one of keys.
+func (client *Client) ReadDecryptedMessage(packets []byte, keys []gpg.Key) (*gpg.DecryptedMessage, error) {
+	return gpg.ReadDecryptedMessage(packets, keys)
+}
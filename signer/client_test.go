@@ -0,0 +1,241 @@
+package signer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const expectedIdentity = "TEST gpg-validation-server (For Testing Only) <test-gpg-validation@server.local>"
+const expectedClientIdentity = "TEST-client gpg-validation-server (For Testing Only) <test-gpg-validation@client.local>"
+const serverPublicKeyFile = "../test/keys/test-gpg-validation@server.local (0x87144E5E) pub.asc"
+const clientKeyFile = "../test/keys/test-gpg-validation@client.local (0xE93B112A) pub.asc"
+const clientSecretKeyFile = "../test/keys/test-gpg-validation@client.local (0xE93B112A) sec.asc"
+const otherKeyFile = "../test/keys/test-gpg-validation@other.local (0xF043F26E) pub.asc"
+
+var testMessageBytes = []byte("Hello World!")
+
+func readKeyTest(t *testing.T, client *Client, path string) gpg.Key {
+	file, cleanup := utils.Open(t, path)
+	defer cleanup()
+
+	key, err := client.ReadKey(file)
+	require.NoError(t, err, "Failed to read key:", path)
+	return key
+}
+
+func readSecretKeyTest(t *testing.T, path string) *openpgp.Entity {
+	file, cleanup := utils.Open(t, path)
+	defer cleanup()
+
+	entities, err := openpgp.ReadArmoredKeyRing(file)
+	require.NoError(t, err)
+	require.NoError(t, entities[0].DecryptPrivateKeys([]byte(passphrase)))
+	return entities[0]
+}
+
+func setupClient(t *testing.T) (*Client, func()) {
+	socketPath, stop := startServer(t)
+	client, err := NewClient(socketPath)
+	require.NoError(t, err, "Failed to connect to signer")
+	return client, func() {
+		assert.NoError(t, client.Close())
+		stop()
+	}
+}
+
+func TestClientServerIdentity(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	assert.Equal(t, expectedIdentity, client.ServerIdentity())
+}
+
+func TestNewClientWithoutServer(t *testing.T) {
+	_, err := NewClient("does_not_exist.sock")
+	assert.Error(t, err)
+}
+
+func TestClientSignUserID(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	buffer := new(bytes.Buffer)
+	identities, err := client.SignUserID("test-gpg-validation@client.local", readKeyTest(t, client, clientKeyFile), buffer)
+	require.NoError(t, err, "Failed to sign user id")
+	assert.Equal(t, []string{expectedClientIdentity}, identities)
+
+	signedKey, err := openpgp.ReadArmoredKeyRing(buffer)
+	require.NoError(t, err)
+	serverKey := readKeyTest(t, client, serverPublicKeyFile)
+	signatures := 0
+	for name, identity := range signedKey[0].Identities {
+		for _, sig := range identity.Signatures {
+			if sig.CheckKeyIdOrFingerprint(serverKey.PrimaryKey) {
+				assert.NoError(t, serverKey.PrimaryKey.VerifyUserIdSignature(name, signedKey[0].PrimaryKey, sig))
+				signatures++
+			}
+		}
+	}
+	assert.Equal(t, 1, signatures, "Expected one certification by the server")
+
+	_, err = client.SignUserID("impostor@faux.fake", readKeyTest(t, client, clientKeyFile), new(bytes.Buffer))
+	assert.Equal(t, gpg.ErrUnknownIdentity, err)
+}
+
+func TestClientRevokeCertification(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	signed := new(bytes.Buffer)
+	_, err := client.SignUserID("test-gpg-validation@client.local", readKeyTest(t, client, clientKeyFile), signed)
+	require.NoError(t, err, "Failed to sign user id")
+	certifiedKey, err := client.ReadKey(signed)
+	require.NoError(t, err)
+
+	buffer := new(bytes.Buffer)
+	identities, err := client.RevokeCertification("test-gpg-validation@client.local", certifiedKey,
+		gpg.RevocationUserIDInvalid, "", buffer)
+	require.NoError(t, err, "Failed to revoke certification")
+	assert.Equal(t, []string{expectedClientIdentity}, identities)
+
+	revokedKey, err := openpgp.ReadArmoredKeyRing(buffer)
+	require.NoError(t, err)
+	serverKey := readKeyTest(t, client, serverPublicKeyFile)
+	revocations := 0
+	for _, sig := range revokedKey[0].Identities[expectedClientIdentity].Signatures {
+		if sig.CheckKeyIdOrFingerprint(serverKey.PrimaryKey) && sig.SigType == packet.SigTypeCertificationRevocation {
+			revocations++
+		}
+	}
+	assert.Equal(t, 1, revocations, "Expected one revocation by the server")
+
+	_, err = client.RevokeCertification("test-gpg-validation@client.local", readKeyTest(t, client, clientKeyFile),
+		gpg.RevocationUserIDInvalid, "", new(bytes.Buffer))
+	assert.Equal(t, gpg.ErrUnknownIdentity, err, "Uncertified identities cannot be revoked")
+	_, err = client.RevokeCertification("test-gpg-validation@client.local", certifiedKey,
+		gpg.RevocationReason(1), "", new(bytes.Buffer))
+	assert.Equal(t, gpg.ErrInvalidRevocationReason, err)
+}
+
+func TestClientCheckMessage(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	signature := new(bytes.Buffer)
+	require.NoError(t, openpgp.ArmoredDetachSign(signature, readSecretKeyTest(t, clientSecretKeyFile),
+		bytes.NewReader(testMessageBytes), nil), "Signing message failed")
+	signatureBytes := signature.Bytes()
+
+	err := client.CheckMessageSignature(bytes.NewReader(testMessageBytes), bytes.NewReader(signatureBytes),
+		readKeyTest(t, client, clientKeyFile))
+	assert.NoError(t, err)
+	err = client.CheckMessageSignature(bytes.NewReader(testMessageBytes), bytes.NewReader(signatureBytes),
+		readKeyTest(t, client, serverPublicKeyFile))
+	assert.Equal(t, gpg.ErrUnknownIssuer, err)
+}
+
+func TestClientEncryptMessage(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	cipherText := new(bytes.Buffer)
+	plaintext, err := client.EncryptMessage(cipherText, readKeyTest(t, client, clientKeyFile))
+	require.NoError(t, err)
+	_, err = plaintext.Write(testMessageBytes)
+	require.NoError(t, err)
+	assert.Zero(t, cipherText.Len(), "Cipher text written before closing the stream")
+	require.NoError(t, plaintext.Close(), "Encryption failed")
+
+	keyRing := openpgp.EntityList{readSecretKeyTest(t, clientSecretKeyFile), readKeyTest(t, client, serverPublicKeyFile)}
+	block, err := armor.Decode(cipherText)
+	require.NoError(t, err)
+	md, err := openpgp.ReadMessage(block.Body, keyRing, nil, nil)
+	require.NoError(t, err, "Decryption failed")
+	assert.True(t, md.IsSigned, "Encrypted message has not been signed")
+	decrypted, err := ioutil.ReadAll(md.UnverifiedBody)
+	require.NoError(t, err)
+	assert.Equal(t, testMessageBytes, decrypted)
+	assert.NoError(t, md.SignatureError)
+}
+
+func encryptForServer(t *testing.T, client *Client, signed bool) []byte {
+	var sender *openpgp.Entity
+	if signed {
+		sender = readSecretKeyTest(t, clientSecretKeyFile)
+	}
+
+	cipherText := new(bytes.Buffer)
+	armorWriter, err := armor.Encode(cipherText, "PGP MESSAGE", nil)
+	require.NoError(t, err)
+	w, err := openpgp.Encrypt(armorWriter, []*openpgp.Entity{readKeyTest(t, client, serverPublicKeyFile)}, sender, nil, nil)
+	require.NoError(t, err)
+	_, err = w.Write(testMessageBytes)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, armorWriter.Close())
+	return cipherText.Bytes()
+}
+
+func TestServiceServesOnlyFrontendOperations(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	var reply []byte
+	for _, method := range []string{"SignMessage", "DecryptMessage", "DecryptSignedMessage"} {
+		assert.Error(t, client.call(method, testMessageBytes, &reply), method+" must not be served")
+	}
+}
+
+func TestClientDecryptPackets(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	packets, err := client.DecryptPackets(bytes.NewReader(encryptForServer(t, client, true)))
+	require.NoError(t, err, "Decryption failed")
+	decrypted, err := client.ReadDecryptedMessage(packets, []gpg.Key{readKeyTest(t, client, clientKeyFile)})
+	require.NoError(t, err)
+	assert.Equal(t, testMessageBytes, decrypted.Body)
+	assert.True(t, decrypted.IsSigned)
+	require.NotNil(t, decrypted.SignedBy)
+	assert.Equal(t, decrypted.SignedByKeyID, decrypted.SignedBy.PrimaryKey.KeyId)
+
+	_, err = client.DecryptPackets(bytes.NewReader(testMessageBytes))
+	assert.Error(t, err)
+}
+
+func TestClientCheckKey(t *testing.T) {
+	client, cleanup := setupClient(t)
+	defer cleanup()
+
+	clientIdentity := "TEST-client gpg-validation-server (For Testing Only) <test-gpg-validation@client.local>"
+	assert.True(t, client.CheckKey(readKeyTest(t, client, clientKeyFile)).Accepted(clientIdentity))
+
+	client.KeyPolicy.MinRSABits = 8192
+	assert.False(t, client.CheckKey(readKeyTest(t, client, clientKeyFile)).Accepted(clientIdentity))
+}
+
+func TestClientReconnects(t *testing.T) {
+	socketPath, cleanup := tempSocketPath(t)
+	defer cleanup()
+	stop := runServer(t, socketPath)
+	client, err := NewClient(socketPath)
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+
+	// Restart the signer daemon on the same socket
+	stop()
+	stop = runServer(t, socketPath)
+	defer stop()
+
+	_, err = client.DecryptPackets(bytes.NewReader(encryptForServer(t, client, false)))
+	assert.NoError(t, err, "Client did not reconnect")
+}
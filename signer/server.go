@@ -0,0 +1,211 @@
+// Package signer separates the private server key from the SMTP and HTTP frontends.
+//
+// The signer daemon holds the decrypted server key and serves the operations needing it over a Unix domain socket
+// using net/rpc. The frontends use a Client, which implements mail.GpgUtility, so that a compromised frontend cannot
+// leak the certification key.
+package signer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/internal/socket"
+)
+
+// serviceName is the name under which the Service is registered.
+const serviceName = "Signer"
+
+// Service provides the operations of the server key via net/rpc. Keys are transferred in their binary encoding,
+// messages as complete byte slices. Only the operations used by the frontends are served, in particular arbitrary
+// messages are not signed.
+type Service struct {
+	gpg *gpg.GPG
+}
+
+// SignUserIDArgs are the arguments of Service.SignUserID.
+type SignUserIDArgs struct {
+	Email string
+	Key   []byte
+}
+
+// SignUserIDReply is the result of Service.SignUserID.
+type SignUserIDReply struct {
+	SignedKey  []byte
+	Identities []string
+}
+
+// RevokeCertificationArgs are the arguments of Service.RevokeCertification.
+type RevokeCertificationArgs struct {
+	Email      string
+	Key        []byte
+	Reason     gpg.RevocationReason
+	ReasonText string
+}
+
+// RevokeCertificationReply is the result of Service.RevokeCertification.
+type RevokeCertificationReply struct {
+	RevokedKey []byte
+	Identities []string
+}
+
+// EncryptMessageArgs are the arguments of Service.EncryptMessage.
+type EncryptMessageArgs struct {
+	Recipient []byte
+	Plaintext []byte
+}
+
+// ServerIdentity returns the identity of the active server key.
+func (s *Service) ServerIdentity(_ struct{}, reply *string) error {
+	*reply = s.gpg.ServerIdentity()
+	return nil
+}
+
+// SignUserID certifies the identities of the given key matching the given email and returns the armored key together
+// with the certified identities.
+func (s *Service) SignUserID(args SignUserIDArgs, reply *SignUserIDReply) error {
+	key, err := gpg.UnmarshalKey(args.Key)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	identities, err := s.gpg.SignUserID(args.Email, key, buf)
+	if err != nil {
+		return err
+	}
+	*reply = SignUserIDReply{SignedKey: buf.Bytes(), Identities: identities}
+	return nil
+}
+
+// RevokeCertification revokes the certifications of the identities of the given key matching the given email and
+// returns the armored key together with the affected identities.
+func (s *Service) RevokeCertification(args RevokeCertificationArgs, reply *RevokeCertificationReply) error {
+	key, err := gpg.UnmarshalKey(args.Key)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	identities, err := s.gpg.RevokeCertification(args.Email, key, args.Reason, args.ReasonText, buf)
+	if err != nil {
+		return err
+	}
+	*reply = RevokeCertificationReply{RevokedKey: buf.Bytes(), Identities: identities}
+	return nil
+}
+
+// CertifiedIdentities returns the identities of the given key, which are currently certified by a server key.
+func (s *Service) CertifiedIdentities(key []byte, reply *[]string) error {
+	entity, err := gpg.UnmarshalKey(key)
+	if err != nil {
+		return err
+	}
+	*reply = s.gpg.CertifiedIdentities(entity)
+	return nil
+}
+
+// EncryptMessage signs the plaintext and encrypts it for the given recipient.
+func (s *Service) EncryptMessage(args EncryptMessageArgs, reply *[]byte) error {
+	recipient, err := gpg.UnmarshalKey(args.Recipient)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	plaintext, err := s.gpg.EncryptMessage(buf, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err = plaintext.Write(args.Plaintext); err != nil {
+		return err
+	}
+	if err = plaintext.Close(); err != nil {
+		return err
+	}
+	*reply = buf.Bytes()
+	return nil
+}
+
+// DecryptPackets decrypts the given message and returns the OpenPGP message it contains.
+func (s *Service) DecryptPackets(message []byte, reply *[]byte) error {
+	packets, err := s.gpg.DecryptPackets(bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	*reply = packets
+	return nil
+}
+
+// Server serves the Service on a Unix domain socket.
+type Server struct {
+	listener  net.Listener
+	rpcServer *rpc.Server
+
+	mutex       sync.Mutex
+	connections map[net.Conn]bool
+}
+
+// NewServer creates the Unix domain socket at the given path, which is only accessible by the current user.
+// A stale socket left behind by a previous signer daemon is replaced.
+func NewServer(socketPath string, gpgUtil *gpg.GPG) (*Server, error) {
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := socket.ListenPrivate(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcServer := rpc.NewServer()
+	if err = rpcServer.RegisterName(serviceName, &Service{gpg: gpgUtil}); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return &Server{listener: listener, rpcServer: rpcServer, connections: map[net.Conn]bool{}}, nil
+}
+
+// Run serves connections until the server is closed.
+func (server *Server) Run() error {
+	for {
+		conn, err := server.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("signer: Cannot accept connection: %v", err)
+		}
+		go server.serveConn(conn)
+	}
+}
+
+func (server *Server) serveConn(conn net.Conn) {
+	server.mutex.Lock()
+	server.connections[conn] = true
+	server.mutex.Unlock()
+	log.Printf("Signer connection accepted")
+
+	server.rpcServer.ServeConn(conn)
+
+	server.mutex.Lock()
+	delete(server.connections, conn)
+	server.mutex.Unlock()
+}
+
+// Close stops accepting connections, closes the open connections and removes the socket.
+func (server *Server) Close() error {
+	err := server.listener.Close()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for conn := range server.connections {
+		_ = conn.Close()
+	}
+	return err
+}
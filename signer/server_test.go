@@ -0,0 +1,94 @@
+package signer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/test/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const serverKeyFile = "../test/keys/test-gpg-validation@server.local (0x87144E5E) sec.asc"
+const passphrase = "validation"
+
+func setupGPG(t *testing.T) *gpg.GPG {
+	file, cleanup := utils.Open(t, serverKeyFile)
+	defer cleanup()
+
+	gpgUtil, err := gpg.NewGPG(file, passphrase)
+	require.NoError(t, err, "Failed to create GPG object")
+	return gpgUtil
+}
+
+// tempSocketPath returns a socket path in a new temporary directory and a function to remove the directory.
+func tempSocketPath(t *testing.T) (socketPath string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "signer")
+	require.NoError(t, err)
+	return filepath.Join(dir, "signer.sock"), func() { _ = os.RemoveAll(dir) }
+}
+
+// runServer runs a signer daemon on the given socket and returns a function to stop it.
+func runServer(t *testing.T, socketPath string) (stop func()) {
+	server, err := NewServer(socketPath, setupGPG(t))
+	require.NoError(t, err, "Failed to create server")
+	done := make(chan error)
+	go func() { done <- server.Run() }()
+
+	return func() {
+		assert.NoError(t, server.Close())
+		assert.NoError(t, <-done, "Server did not stop cleanly")
+	}
+}
+
+// startServer runs a signer daemon in a temporary directory and returns the socket path and a function to stop it.
+func startServer(t *testing.T) (socketPath string, stop func()) {
+	socketPath, cleanup := tempSocketPath(t)
+	stopServer := runServer(t, socketPath)
+	return socketPath, func() {
+		stopServer()
+		cleanup()
+	}
+}
+
+func TestServerSocket(t *testing.T) {
+	umask := syscall.Umask(0022)
+	defer syscall.Umask(umask)
+	socketPath, stop := startServer(t)
+	assert.Equal(t, 0022, syscall.Umask(0022), "Umask must be restored after creating the socket")
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSocket, "Not a socket")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Socket must only be accessible by the owner")
+
+	stop()
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "Socket not removed on close")
+}
+
+func TestServerReplacesStaleSocket(t *testing.T) {
+	socketPath, stop := startServer(t)
+	defer stop()
+
+	// A second daemon takes over the socket, e.g. after the first one crashed
+	server, err := NewServer(socketPath, setupGPG(t))
+	require.NoError(t, err, "Failed to replace stale socket")
+	assert.NoError(t, server.Close())
+}
+
+func TestServerDoesNotReplaceFiles(t *testing.T) {
+	file, err := ioutil.TempFile("", "signer")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	defer func() { _ = os.Remove(file.Name()) }()
+
+	_, err = NewServer(file.Name(), setupGPG(t))
+	assert.Error(t, err, "Regular file replaced by socket")
+	_, err = os.Stat(file.Name())
+	assert.NoError(t, err)
+}
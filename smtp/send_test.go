@@ -37,7 +37,7 @@ func TestEmail(t *testing.T) {
 }
 
 func runMailServer(resultChannel chan string) {
-	mailHandler := func(origin net.Addr, from string, to []string, data []byte) {
+	mailHandler := func(origin net.Addr, from string, to []string, data []byte) error {
 		message, err := mail.ReadMessage(bytes.NewReader(data))
 		if err != nil {
 			log.Fatalf("ERROR: Received mail from %s for %s: %v", from, to[0], err)
@@ -45,6 +45,7 @@ func runMailServer(resultChannel chan string) {
 			log.Printf("Received mail from %s for %s: %v", from, to[0], message)
 		}
 		resultChannel <- to[0]
+		return nil
 	}
 
 	go func() {
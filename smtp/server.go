@@ -21,10 +21,12 @@ func NewServer(Address string, Handler Handler) *MailServer {
 	return &MailServer{Address, Handler}
 }
 
-func (server *MailServer) mailHandler(origin net.Addr, fromAddress string, toAddresses []string, data []byte) {
+func (server *MailServer) mailHandler(origin net.Addr, fromAddress string, toAddresses []string,
+	data []byte) error {
 	log.Printf("Incoming mail Origin: %v From: %v To: %v\n", origin, fromAddress, toAddresses)
 	mail := MailEnvelope{fromAddress, toAddresses, data}
 	server.Handler(&mail)
+	return nil
 }
 
 // Run starts a goroutine which listens and processes mail as it arrives.
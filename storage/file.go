@@ -1,29 +1,41 @@
 package storage
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"github.com/TNG/openpgp-validation-server/gpg"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-// NewFileStore returns a GetSetDeleter that stores values in a /requests subdirectory
-func NewFileStore() GetSetDeleter {
+// NewFileStore returns a Store that stores requests in a /requests, keys in a /keys and the times of replies in a
+// /replies subdirectory
+func NewFileStore() Store {
 	log.Println("Using file store in current directory")
 	m := fileStore{
-		directory: "./requests",
+		directory:      "./requests",
+		keyDirectory:   "./keys",
+		replyDirectory: "./replies",
 	}
-	err := os.MkdirAll(m.directory, 0700)
-	if err != nil {
-		panic(err)
+	for _, directory := range []string{m.directory, m.keyDirectory, m.replyDirectory} {
+		err := os.MkdirAll(directory, 0700)
+		if err != nil {
+			panic(err)
+		}
 	}
 	return &m
 }
 
-// fileStore provides a filesystem-based GetSetDeleter
+// fileStore provides a filesystem-based Store
 type fileStore struct {
-	directory string
+	directory      string
+	keyDirectory   string
+	replyDirectory string
 }
 
 func (s *fileStore) fileName(nonce [nonceLength]byte, suffix string) string {
@@ -91,6 +103,19 @@ func (s *fileStore) Get(nonce [nonceLength]byte) *RequestInfo {
 		}
 	}
 
+	expiresBytes := s.getData(nonce, "expires")
+	if expiresBytes != nil {
+		err := info.Expires.UnmarshalText(expiresBytes)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	revokeBytes := s.getData(nonce, "revoke")
+	if revokeBytes != nil {
+		info.Revoke = string(revokeBytes) == "true"
+	}
+
 	keyBytes := s.getData(nonce, "key")
 	if keyBytes != nil {
 		var err error
@@ -113,6 +138,16 @@ func (s *fileStore) Set(nonce [nonceLength]byte, requestor RequestInfo) {
 		panic(err)
 	}
 	s.setData(nonce, "timestamp", ts)
+	if !requestor.Expires.IsZero() {
+		expires, err := requestor.Expires.MarshalText()
+		if err != nil {
+			panic(err)
+		}
+		s.setData(nonce, "expires", expires)
+	}
+	if requestor.Revoke {
+		s.setData(nonce, "revoke", []byte("true"))
+	}
 
 	if requestor.Key != nil {
 		key, err := gpg.MarshalKey(requestor.Key)
@@ -128,4 +163,98 @@ func (s *fileStore) Delete(nonce [nonceLength]byte) {
 	s.clearData(nonce, "email")
 	s.clearData(nonce, "timestamp")
 	s.clearData(nonce, "key")
+	for _, suffix := range []string{"expires", "revoke"} {
+		if _, err := os.Stat(s.fileName(nonce, suffix)); err == nil {
+			s.clearData(nonce, suffix)
+		}
+	}
+}
+
+// DeleteExpired removes all nonces, which have expired at the given time. Only nonces with an expiry are considered.
+func (s *fileStore) DeleteExpired(now time.Time) {
+	fileNames, err := filepath.Glob(s.directory + "/*.expires")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, fileName := range fileNames {
+		nonce, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(fileName), ".expires"))
+		if err != nil || len(nonce) != nonceLength {
+			continue
+		}
+		var key [nonceLength]byte
+		copy(key[:], nonce)
+		var expires time.Time
+		if err = expires.UnmarshalText(s.getData(key, "expires")); err != nil {
+			log.Println(err)
+			continue
+		}
+		if now.After(expires) {
+			s.Delete(key)
+		}
+	}
+}
+
+func (s *fileStore) keyFileName(keyID uint64) string {
+	return fmt.Sprintf("%s/%016X.key", s.keyDirectory, keyID)
+}
+
+// GetKey returns the certified key with the given primary key or subkey ID
+func (s *fileStore) GetKey(keyID uint64) gpg.Key {
+	data, err := ioutil.ReadFile(s.keyFileName(keyID))
+	if err != nil {
+		return nil
+	}
+	key, err := gpg.UnmarshalKey(data)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return key
+}
+
+// AddKey persists the given certified key under the IDs of its primary key and subkeys, replacing a former version
+func (s *fileStore) AddKey(key gpg.Key) {
+	data, err := gpg.MarshalKey(key)
+	if err != nil {
+		panic(err)
+	}
+	for _, keyID := range keyIDs(key) {
+		err = ioutil.WriteFile(s.keyFileName(keyID), data, 0600)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// replyFileName returns the name of the file holding the time of the last reply to address. The address is hashed, so
+// that any address yields a valid file name.
+func (s *fileStore) replyFileName(address string) string {
+	hash := sha256.Sum256([]byte(address))
+	return s.replyDirectory + "/" + hex.EncodeToString(hash[:]) + ".reply"
+}
+
+// GetLastReply returns the time of the last reply sent to the given address
+func (s *fileStore) GetLastReply(address string) (time.Time, bool) {
+	var sent time.Time
+	data, err := ioutil.ReadFile(s.replyFileName(address))
+	if err != nil {
+		return sent, false
+	}
+	if err = sent.UnmarshalText(data); err != nil {
+		log.Println(err)
+		return sent, false
+	}
+	return sent, true
+}
+
+// SetLastReply persists the time of a reply sent to the given address
+func (s *fileStore) SetLastReply(address string, sent time.Time) {
+	data, err := sent.MarshalText()
+	if err != nil {
+		panic(err)
+	}
+	if err = ioutil.WriteFile(s.replyFileName(address), data, 0600); err != nil {
+		panic(err)
+	}
 }
@@ -2,19 +2,26 @@ package storage
 
 import (
 	"log"
+	"time"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
 )
 
-// NewMemoryStore returns a GetSetDeleter that only stores values in memory
-func NewMemoryStore() GetSetDeleter {
+// NewMemoryStore returns a Store that only stores values in memory
+func NewMemoryStore() Store {
 	log.Println("Using in-memory store: All data will be lost on service restart.")
 	m := memoryStore{}
 	m.store = map[[nonceLength]byte]*RequestInfo{}
+	m.keys = map[uint64]gpg.Key{}
+	m.replies = map[string]time.Time{}
 	return &m
 }
 
-// memoryStore provides an in-memory GetSetDeleter
+// memoryStore provides an in-memory Store
 type memoryStore struct {
-	store map[[nonceLength]byte]*RequestInfo
+	store   map[[nonceLength]byte]*RequestInfo
+	keys    map[uint64]gpg.Key
+	replies map[string]time.Time
 }
 
 // Get returns the openpgp Entity saved under the given nonce
@@ -31,3 +38,35 @@ func (s *memoryStore) Set(nonce [nonceLength]byte, requestor RequestInfo) {
 func (s *memoryStore) Delete(nonce [nonceLength]byte) {
 	delete(s.store, nonce)
 }
+
+// DeleteExpired removes all nonces, which have expired at the given time
+func (s *memoryStore) DeleteExpired(now time.Time) {
+	for nonce, request := range s.store {
+		if !request.Expires.IsZero() && now.After(request.Expires) {
+			delete(s.store, nonce)
+		}
+	}
+}
+
+// GetKey returns the certified key with the given primary key or subkey ID
+func (s *memoryStore) GetKey(keyID uint64) gpg.Key {
+	return s.keys[keyID]
+}
+
+// AddKey persists the given certified key, replacing a former version of it
+func (s *memoryStore) AddKey(key gpg.Key) {
+	for _, keyID := range keyIDs(key) {
+		s.keys[keyID] = key
+	}
+}
+
+// GetLastReply returns the time of the last reply sent to the given address
+func (s *memoryStore) GetLastReply(address string) (time.Time, bool) {
+	sent, ok := s.replies[address]
+	return sent, ok
+}
+
+// SetLastReply records the time of a reply sent to the given address
+func (s *memoryStore) SetLastReply(address string, sent time.Time) {
+	s.replies[address] = sent
+}
@@ -4,8 +4,8 @@ import (
 	"log"
 )
 
-// NewNoneStore returns a GetSetDeleter that does not store anything
-func NewNoneStore() GetSetDeleter {
+// NewNoneStore returns a Store that does not store anything
+func NewNoneStore() Store {
 	log.Println("Using no store: No data will be saved.")
 	return nil
 }
@@ -14,6 +14,13 @@ type RequestInfo struct {
 	Key       gpg.Key
 	Email     string
 	Timestamp time.Time
+
+	// Expires is the time, after which the nonce of the request can no longer be confirmed. The nonce does not expire
+	// if it is zero.
+	Expires time.Time
+
+	// Revoke is set for requests to revoke the certification of the key instead of issuing one.
+	Revoke bool
 }
 
 // GetSetDeleter provides a persistent map from []byte nonces to openpgp.Entities
@@ -21,6 +28,37 @@ type GetSetDeleter interface {
 	Get(nonce [nonceLength]byte) *RequestInfo
 	Set(nonce [nonceLength]byte, request RequestInfo)
 	Delete(nonce [nonceLength]byte)
+	DeleteExpired(now time.Time)
+}
+
+// KeyGetAdder provides a persistent map from the key IDs of primary keys and subkeys to the keys certified by the
+// server
+type KeyGetAdder interface {
+	GetKey(keyID uint64) gpg.Key
+	AddKey(key gpg.Key)
+}
+
+// ReplyGetSetter provides a persistent map from addresses to the time of the last automatic reply sent to them, so
+// that replies are limited across restarts of the server and invocations of process-mail
+type ReplyGetSetter interface {
+	GetLastReply(address string) (time.Time, bool)
+	SetLastReply(address string, sent time.Time)
+}
+
+// Store contains the pending requests, the certified keys and the times of the last replies
+type Store interface {
+	GetSetDeleter
+	KeyGetAdder
+	ReplyGetSetter
+}
+
+// keyIDs returns the key IDs of the primary key and all subkeys of key.
+func keyIDs(key gpg.Key) []uint64 {
+	ids := []uint64{key.PrimaryKey.KeyId}
+	for _, subkey := range key.Subkeys {
+		ids = append(ids, subkey.PublicKey.KeyId)
+	}
+	return ids
 }
 
 // StorageTypes contains all implemented storage types.
@@ -30,14 +68,14 @@ var StorageTypes = [...]string{
 	"file",
 }
 
-var storageConstructors = map[string](func() GetSetDeleter){
+var storageConstructors = map[string](func() Store){
 	StorageTypes[0]: NewNoneStore,
 	StorageTypes[1]: NewMemoryStore,
 	StorageTypes[2]: NewFileStore,
 }
 
-// NewStore returns a net GetSetDeleter that is backed by the specified storage.
-func NewStore(storageType string) (GetSetDeleter, error) {
+// NewStore returns a new Store that is backed by the specified storage.
+func NewStore(storageType string) (Store, error) {
 	constructor, ok := storageConstructors[storageType]
 
 	if !ok {
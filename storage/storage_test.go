@@ -34,16 +34,72 @@ func testGetSetDeleter(t *testing.T, store GetSetDeleter) {
 	require.Equal(t, e1.Email, e2.Email, "Stored and retrieved entity should be equal")
 	require.Equal(t, e1.Timestamp.Unix(), e2.Timestamp.Unix(), "Stored and retrieved entity should be equal")
 	require.Equal(t, e1.Key.PrimaryKey.KeyId, e2.Key.PrimaryKey.KeyId, "Stored and retrieved entity should be equal")
+	require.False(t, e2.Revoke, "Stored and retrieved entity should be equal")
 	store.Delete(nonce0)
 	assert.Nil(t, store.Get(nonce0))
+
+	e1.Revoke = true
+	store.Set(nonce1, e1)
+	require.True(t, store.Get(nonce1).Revoke, "Stored and retrieved entity should be equal")
+	store.Delete(nonce1)
+	assert.Nil(t, store.Get(nonce1))
+
+	e1.Revoke = false
+	e1.Expires = time.Now().Add(-time.Minute)
+	store.Set(nonce0, e1)
+	require.Equal(t, e1.Expires.Unix(), store.Get(nonce0).Expires.Unix(), "Stored and retrieved entity should be equal")
+	e1.Expires = time.Now().Add(time.Hour)
+	store.Set(nonce1, e1)
+	store.DeleteExpired(time.Now())
+	assert.Nil(t, store.Get(nonce0), "Expired nonces should be deleted")
+	require.NotNil(t, store.Get(nonce1), "Nonces, which have not expired, should be kept")
+	store.Delete(nonce1)
+	assert.Nil(t, store.Get(nonce1))
+}
+
+func testKeyGetAdder(t *testing.T, store KeyGetAdder) {
+	f, err := os.Open(asciiKeyFilePublic)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	key, err := gpg.UnmarshalKey(data)
+	assert.Nil(t, err)
+	require.NotEmpty(t, key.Subkeys)
+
+	assert.Nil(t, store.GetKey(0))
+	store.AddKey(key)
+	for _, keyID := range []uint64{key.PrimaryKey.KeyId, key.Subkeys[0].PublicKey.KeyId} {
+		storedKey := store.GetKey(keyID)
+		require.NotNil(t, storedKey, "Key must be found by the IDs of primary key and subkeys")
+		require.Equal(t, key.PrimaryKey.Fingerprint, storedKey.PrimaryKey.Fingerprint)
+	}
+}
+
+func testReplyGetSetter(t *testing.T, store ReplyGetSetter) {
+	_, ok := store.GetLastReply("unknown@localhost")
+	assert.False(t, ok)
+
+	sent := time.Now()
+	store.SetLastReply("test@localhost", sent)
+	stored, ok := store.GetLastReply("test@localhost")
+	require.True(t, ok)
+	assert.True(t, sent.Equal(stored), "Stored and retrieved time should be equal")
+
+	store.SetLastReply("test@localhost", sent.Add(time.Hour))
+	stored, _ = store.GetLastReply("test@localhost")
+	assert.True(t, sent.Add(time.Hour).Equal(stored), "Later replies should replace the time")
 }
 
 func TestMemoryStore(t *testing.T) {
 	m := NewMemoryStore()
 	testGetSetDeleter(t, m)
+	testKeyGetAdder(t, m)
+	testReplyGetSetter(t, m)
 }
 
 func TestFileStore(t *testing.T) {
 	m := NewFileStore()
 	testGetSetDeleter(t, m)
+	testKeyGetAdder(t, m)
+	testReplyGetSetter(t, m)
 }
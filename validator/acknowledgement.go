@@ -0,0 +1,111 @@
+package validator
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/mail"
+)
+
+var acknowledgementMessage = template.Must(template.ParseFiles("./templates/acknowledgementMail.tmpl"))
+
+// acknowledgementSubject is the subject of mails acknowledging a request.
+const acknowledgementSubject = "OpenPGP Key Validation Request Received"
+
+// Acknowledger decides whether the acknowledgements of accepted requests are sent. Like RejectionReplier, it protects
+// against mail loops and limits the replies per address.
+type Acknowledger struct {
+	// GPG provides the identity of the server, which sends the acknowledgements.
+	GPG mail.MessageEncrypter
+	// OwnAddresses are the addresses of the server, which never get acknowledgements.
+	OwnAddresses []string
+	// Limiter limits the replies per address, unless it is nil.
+	Limiter *RateLimiter
+}
+
+// Acknowledge returns the acknowledgement of the request with the given result, or nil if none must be sent.
+func (acknowledger *Acknowledger) Acknowledge(result *Result) *mail.OutgoingMail {
+	acknowledgement := result.Acknowledgement
+	if acknowledgement == nil {
+		return nil
+	}
+
+	recipient := acknowledgement.RecipientEmail
+	if reason := loopReason(result.header, recipient, acknowledger.GPG, acknowledger.OwnAddresses); reason != "" {
+		log.Printf("Not acknowledging request from '%s': %s\n", recipient, reason)
+		return nil
+	}
+	if acknowledger.Limiter != nil && !acknowledger.Limiter.Allow(strings.ToLower(recipient)) {
+		log.Printf("Not acknowledging request from '%s': rate limit exceeded\n", recipient)
+		return nil
+	}
+	return acknowledgement
+}
+
+// acknowledgement returns the mail telling the sender of an accepted request, which addresses have been sent nonce
+// mails and which user IDs have been skipped. The mail is encrypted to the key of the request. It returns nil if the
+// From address of the request is not the address of a user ID of the key, so that no mail is sent to forged senders.
+// The expiry of the nonces is zero if they do not expire.
+func acknowledgement(result *Result, key gpg.Key, expires time.Time, gpgUtil mail.MessageEncrypter) *mail.OutgoingMail {
+	sender, err := netmail.ParseAddress(result.Sender)
+	if err != nil {
+		log.Printf("Cannot acknowledge request from '%s': %v\n", result.Sender, err)
+		return nil
+	}
+	if !hasIdentityEmail(key, sender.Address) {
+		log.Printf("Not acknowledging request from '%s': address is no user ID of key %s\n", sender.Address,
+			key.PrimaryKey.KeyIdString())
+		return nil
+	}
+
+	var skipped []UIDResult
+	for _, uid := range result.UIDs {
+		if !uid.NonceSent {
+			skipped = append(skipped, uid)
+		}
+	}
+
+	message := new(bytes.Buffer)
+	err = acknowledgementMessage.Execute(message, struct {
+		Fingerprint string
+		Revoke      bool
+		Sent        []string
+		Skipped     []UIDResult
+		Expiry      string
+	}{
+		Fingerprint: fmt.Sprintf("%X", key.PrimaryKey.Fingerprint),
+		Revoke:      result.Revoke,
+		Sent:        result.pendingEmails(),
+		Skipped:     skipped,
+		Expiry:      formatExpiry(expires),
+	})
+	if err != nil {
+		log.Panicf("Cannot generate acknowledgement message: %v\n", err)
+		return nil
+	}
+
+	return &mail.OutgoingMail{
+		Message:        message.String(),
+		Subject:        acknowledgementSubject,
+		RecipientEmail: sender.Address,
+		RecipientKey:   key,
+		GPG:            gpgUtil,
+		InReplyTo:      result.header.Get("Message-Id"),
+	}
+}
+
+// hasIdentityEmail returns true if the email address of a user ID of key equals address, ignoring case.
+func hasIdentityEmail(key gpg.Key, address string) bool {
+	for _, identity := range key.Identities {
+		if strings.EqualFold(identity.UserId.Email, address) {
+			return true
+		}
+	}
+	return false
+}
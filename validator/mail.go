@@ -1,10 +1,16 @@
 package validator
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/textproto"
+	"regexp"
+	"strings"
 	"text/template"
 	"time"
 
@@ -13,63 +19,124 @@ import (
 	"github.com/TNG/openpgp-validation-server/storage"
 )
 
-var requestResponseMessage = template.Must(template.ParseFiles("./templates/nonceMail.tmpl"))
+var (
+	requestResponseMessage    = template.Must(template.ParseFiles("./templates/nonceMail.tmpl"))
+	revocationResponseMessage = template.Must(template.ParseFiles("./templates/revokeNonceMail.tmpl"))
+)
+
+// revokeSubject is the subject of mails requesting the revocation of certifications, compared case-insensitively.
+const revokeSubject = "revoke"
+
+// revokeCommand matches a line of text starting with the command requesting the revocation of certifications.
+var revokeCommand = regexp.MustCompile(`(?im)^revoke\b`)
+
+// GpgUtility contains the operations needed to handle incoming requests.
+type GpgUtility interface {
+	mail.GpgUtility
+	CertifiedIdentities(key gpg.Key) []string
+}
 
 // MailInfo contains the result of processing a given mail.
 type MailInfo struct {
 	entity *mail.MimeEntity
 }
 
-// HandleMail returns zero or more outgoing mails in response to an incoming mail.
-func HandleMail(incomingMail io.Reader, gpgUtil mail.GpgUtility, store storage.GetSetDeleter, host string) (responses []mail.OutgoingMail) {
-	responses = []mail.OutgoingMail{}
+// HandleMail processes an incoming mail and returns the result including zero or more outgoing mails in response.
+// Mails containing the revoke command request the revocation of the certifications previously issued for the signing
+// key, all other mails request a certification.
+func HandleMail(incomingMail io.Reader, gpgUtil GpgUtility, store storage.Store, host string) *Result {
+	result := &Result{UIDs: []UIDResult{}, Errors: []string{}, Responses: []mail.OutgoingMail{}}
 
-	parser := mail.Parser{Gpg: gpgUtil}
-	requestEntity, err := parser.ParseMail(incomingMail)
+	data, err := ioutil.ReadAll(incomingMail)
 	if err != nil {
-		log.Printf("Cannot parse mail: %s", err)
-		return
+		result.reject(ReasonUnparseable, "Cannot read mail: %s", err)
+		return result
 	}
+	// The header is kept for replies to mails, which cannot be parsed, so that errors reading it are ignored.
+	result.header, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+
+	parser := mail.Parser{Gpg: gpgUtil, Keys: store}
+	requestEntity, err := parser.ParseMail(bytes.NewReader(data))
+	if err != nil {
+		result.reject(parseReason(err), "Cannot parse mail: %s", err)
+		return result
+	}
+	result.Parsed = true
 
 	request := &MailInfo{entity: requestEntity}
+	result.Sender = request.getSender()
 
 	if !request.isSigned() {
-		log.Printf("Mail from '%s' is missing valid signature.", request.getSender())
-		return
+		result.reject(signatureReason(requestEntity), "Mail from '%s' is missing valid signature.",
+			request.getSender())
+		return result
 	}
 
 	log.Printf("Mail from '%s' has valid signature.", request.getSender())
 
 	requestKey := request.getPublicKey()
+	result.Signer = fmt.Sprintf("%X", requestKey.PrimaryKey.Fingerprint)
+	result.KeySource = requestEntity.KeySource
+	result.Revoke = request.isRevocationRequest()
+	if result.Revoke {
+		log.Printf("Mail from '%s' requests revocation.", request.getSender())
+		result.UIDs = revocationDecisions(requestKey, gpgUtil.CertifiedIdentities(requestKey))
+	} else {
+		result.UIDs = certificationDecisions(requestKey, gpgUtil.CheckKey(requestKey))
+	}
 
-	for _, identity := range requestKey.Identities {
+	now := time.Now()
+	var expires time.Time
+	if NonceLifetime > 0 {
+		expires = now.Add(NonceLifetime)
+	}
+	if store != nil {
+		store.DeleteExpired(now)
+	}
+	for _, email := range result.pendingEmails() {
 		nonce, err := generateNonce()
 		if err != nil {
 			log.Panicf("Cannot generate nonce: %v\n", err)
-			return
+			return result
 		}
 		nonceString := hex.EncodeToString(nonce[:])
-		message := request.getNonceMessage(nonceString, requestKey.PrimaryKey.KeyIdString(), host)
+		message := request.getNonceMessage(nonceString, requestKey.PrimaryKey.KeyIdString(), host, expires,
+			result.Revoke)
 
-		log.Printf("Sending nonce mail to %s with nonce %s\n", identity.UserId.Email, nonceString)
+		log.Printf("Sending nonce mail to %s with nonce %s\n", email, nonceString)
 
 		if store != nil {
 			store.Set(nonce, storage.RequestInfo{
 				Key:       requestKey,
-				Email:     identity.UserId.Email,
-				Timestamp: time.Now(),
+				Email:     email,
+				Timestamp: now,
+				Expires:   expires,
+				Revoke:    result.Revoke,
 			})
 		}
 
-		responses = append(responses, mail.OutgoingMail{
+		result.Responses = append(result.Responses, mail.OutgoingMail{
 			Message:        message,
-			RecipientEmail: identity.UserId.Email,
+			RecipientEmail: email,
 			RecipientKey:   requestKey,
 			Attachment:     nil,
 			GPG:            gpgUtil,
 		})
+		result.nonceSent(email)
+	}
+
+	if result.Rejected() {
+		if result.Revoke {
+			result.reject(ReasonNotCertified, "Key %s has no certified identities to revoke",
+				requestKey.PrimaryKey.KeyIdString())
+		} else {
+			result.reject(ReasonNoAcceptedIdentity, "Key %s has no identities accepted by the key policy",
+				requestKey.PrimaryKey.KeyIdString())
+		}
+	} else {
+		result.Acknowledgement = acknowledgement(result, requestKey, expires, gpgUtil)
 	}
-	return
+	return result
 }
 
 // IsSigned returns true if the corresponding mail has a valid signature.
@@ -88,13 +155,63 @@ func (info *MailInfo) getSender() string {
 	return info.entity.GetSender()
 }
 
-func (info *MailInfo) getNonceMessage(nonceString, fingerprint, httpHost string) string {
+// isRevocationRequest returns true if the subject of the mail is the revoke command or a line of its signed text starts
+// with it. Mentioning the command elsewhere, e.g. in a quoted reply, does not turn a request into a revocation request.
+func (info *MailInfo) isRevocationRequest() bool {
+	if strings.EqualFold(strings.TrimSpace(info.entity.GetSubject()), revokeSubject) {
+		return true
+	}
+	signed := signedEntity(info.entity)
+	return signed != nil && containsRevokeCommand(signed)
+}
+
+// signedEntity returns the part of the mail covered by the signature: the text carrying an inline signature or the
+// first part of a PGP/MIME mail. It returns nil if there is no such part.
+func signedEntity(entity *mail.MimeEntity) *mail.MimeEntity {
+	if entity.Parts == nil {
+		return entity
+	}
+	for i := range entity.Parts {
+		if entity.Parts[i].SignedBy != nil {
+			return signedEntity(&entity.Parts[i])
+		}
+	}
+	if len(entity.Parts) == 0 {
+		return nil
+	}
+	return &entity.Parts[0]
+}
+
+// containsRevokeCommand returns true if a line of any text part of the given entity starts with the revoke command.
+func containsRevokeCommand(entity *mail.MimeEntity) bool {
+	if entity.IsAttachment {
+		return false
+	}
+	if entity.Parts == nil {
+		contentType := entity.Header.Get("Content-Type")
+		return (contentType == "" || strings.HasPrefix(contentType, "text/plain")) && revokeCommand.Match(entity.Content)
+	}
+	for i := range entity.Parts {
+		if containsRevokeCommand(&entity.Parts[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (info *MailInfo) getNonceMessage(nonceString, fingerprint, httpHost string, expires time.Time,
+	revoke bool) string {
+	template := requestResponseMessage
+	if revoke {
+		template = revocationResponseMessage
+	}
 	message := new(bytes.Buffer)
-	err := requestResponseMessage.Execute(message, struct{ Nonce, Requester, Fingerprint, Host string }{
+	err := template.Execute(message, struct{ Nonce, Requester, Fingerprint, Host, Expiry string }{
 		Nonce:       nonceString,
 		Requester:   info.getSender(),
 		Fingerprint: fingerprint,
 		Host:        httpHost,
+		Expiry:      formatExpiry(expires),
 	})
 	if err != nil {
 		log.Panicf("Cannot generate nonce message: %v\n", err)
@@ -103,3 +220,11 @@ func (info *MailInfo) getNonceMessage(nonceString, fingerprint, httpHost string)
 
 	return message.String()
 }
+
+// formatExpiry returns the given expiry of nonces as shown in mails, or the empty string if nonces do not expire.
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return expires.Format(time.RFC1123Z)
+}
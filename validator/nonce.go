@@ -5,8 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"text/template"
+	"time"
 
 	"github.com/TNG/openpgp-validation-server/gpg"
 	"github.com/TNG/openpgp-validation-server/mail"
@@ -15,9 +17,23 @@ import (
 
 var signedKeyMessage = template.Must(template.ParseFiles("./templates/signedKeyMail.tmpl"))
 
+// KeySigner certifies keys, revokes certifications on request of the key owner and encrypts the mails containing
+// the keys.
+type KeySigner interface {
+	CertificationRevoker
+	SignUserID(signedEMail string, pubkey gpg.Key, w io.Writer) ([]string, error)
+}
+
+// ownerRevocationText is the reason given in revocations requested by the key owner.
+const ownerRevocationText = "Revoked on request of the key owner"
+
 // NonceLength in byte
 const NonceLength = 32
 
+// NonceLifetime is the time, after which nonces of new requests can no longer be confirmed. Nonces do not expire if
+// it is zero.
+var NonceLifetime time.Duration
+
 func generateNonce() ([NonceLength]byte, error) {
 	var nonce [NonceLength]byte
 
@@ -46,8 +62,10 @@ func NonceFromString(nonceString string) (nonce [NonceLength]byte, err error) {
 	return
 }
 
-// ConfirmNonce checks the given nonce, and if there is associated information, sends an email with the signed key
-func ConfirmNonce(nonce [NonceLength]byte, store storage.GetSetDeleter, gpgUtil *gpg.GPG) (*mail.OutgoingMail, error) {
+// ConfirmNonce checks the given nonce, and if there is associated information, sends an email with the signed key, or
+// with the revoked certifications if the request was a revocation request. The key is added to the certified keys of
+// the store, so that later requests need not attach it. Certifications of other identities stored before are kept.
+func ConfirmNonce(nonce [NonceLength]byte, store storage.Store, gpgUtil KeySigner) (*mail.OutgoingMail, error) {
 	if gpgUtil == nil {
 		return nil, fmt.Errorf("skipping nonce confirmation, as gpgUtil is not available")
 	}
@@ -60,15 +78,46 @@ func ConfirmNonce(nonce [NonceLength]byte, store storage.GetSetDeleter, gpgUtil
 	if requestInfo == nil {
 		return nil, fmt.Errorf("cannot confirm nonce, %v not found", hex.EncodeToString(nonce[:]))
 	}
+	if !requestInfo.Expires.IsZero() && time.Now().After(requestInfo.Expires) {
+		store.Delete(nonce)
+		return nil, fmt.Errorf("cannot confirm nonce, %v expired", hex.EncodeToString(nonce[:]))
+	}
+
+	var outgoingMail *mail.OutgoingMail
+	var err error
+	if requestInfo.Revoke {
+		outgoingMail, err = RevokeCertification(requestInfo.Email, requestInfo.Key, gpg.RevocationUserIDInvalid,
+			ownerRevocationText, gpgUtil)
+	} else {
+		outgoingMail, err = signKey(requestInfo, gpgUtil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certifiedKey, err := gpg.UnmarshalKey(outgoingMail.Attachment)
+	if err != nil {
+		log.Printf("Cannot store certified key: %v", err)
+	} else {
+		if storedKey := store.GetKey(certifiedKey.PrimaryKey.KeyId); storedKey != nil {
+			gpg.MergeKey(certifiedKey, storedKey)
+		}
+		store.AddKey(certifiedKey)
+	}
+
+	return outgoingMail, nil
+}
 
+// signKey certifies the key of the request and returns the mail sending it to the requested address.
+func signKey(requestInfo *storage.RequestInfo, gpgUtil KeySigner) (*mail.OutgoingMail, error) {
 	log.Printf("Signing key %v of '%v'.", requestInfo.Key.PrimaryKey.KeyIdString(), requestInfo.Email)
 
 	buf := bytes.Buffer{}
-	err := gpgUtil.SignUserID(requestInfo.Email, requestInfo.Key, &buf)
+	identities, err := gpgUtil.SignUserID(requestInfo.Email, requestInfo.Key, &buf)
 	if err != nil {
 		return nil, err
 	}
-	message := getSignedKeyMessage(requestInfo.Key.PrimaryKey.KeyIdString())
+	message := getSignedKeyMessage(requestInfo.Key.PrimaryKey.KeyIdString(), identities)
 
 	mail := mail.OutgoingMail{
 		Message:        message,
@@ -81,10 +130,14 @@ func ConfirmNonce(nonce [NonceLength]byte, store storage.GetSetDeleter, gpgUtil
 	return &mail, nil
 }
 
-func getSignedKeyMessage(fingerprint string) string {
+func getSignedKeyMessage(fingerprint string, identities []string) string {
 	message := new(bytes.Buffer)
-	err := signedKeyMessage.Execute(message, struct{ Fingerprint string }{
+	err := signedKeyMessage.Execute(message, struct {
+		Fingerprint string
+		Identities  []string
+	}{
 		Fingerprint: fingerprint,
+		Identities:  identities,
 	})
 	if err != nil {
 		log.Panicf("cannot generate signed-key message: %v", err)
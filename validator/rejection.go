@@ -0,0 +1,154 @@
+package validator
+
+import (
+	"bytes"
+	"log"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/TNG/openpgp-validation-server/mail"
+	"github.com/TNG/openpgp-validation-server/smtp"
+	"github.com/TNG/openpgp-validation-server/storage"
+)
+
+var rejectionMessage = template.Must(template.ParseFiles("./templates/rejectionMail.tmpl"))
+
+// rejectionSubject is the subject of mails explaining why a request has been rejected.
+const rejectionSubject = "OpenPGP Key Validation Request Rejected"
+
+// systemLocalParts are the local parts of addresses, which are used by mail systems and must never get replies.
+var systemLocalParts = map[string]bool{"mailer-daemon": true, "postmaster": true, "noreply": true, "no-reply": true}
+
+// RejectionReplier composes mails explaining to requesters why their requests have been rejected. It protects against
+// mail loops and, with a rate limit per address, against becoming a source of backscatter to forged senders.
+type RejectionReplier struct {
+	// GPG provides the identity of the server, which sends the replies.
+	GPG mail.MessageEncrypter
+	// OwnAddresses are the addresses of the server, which never get replies.
+	OwnAddresses []string
+	// Limiter limits the replies per address, unless it is nil.
+	Limiter *RateLimiter
+}
+
+// Reply returns the reply to a rejected mail with the given result, or nil if no reply must be sent. The reply is sent
+// to the sender of the SMTP envelope, or to the From address if the mail has not been received via SMTP and envelope
+// is nil.
+func (replier *RejectionReplier) Reply(result *Result, envelope *smtp.MailEnvelope) *mail.OutgoingMail {
+	if !result.Rejected() {
+		return nil
+	}
+
+	recipient := ""
+	if envelope != nil {
+		recipient = envelope.From
+	} else if address, err := netmail.ParseAddress(result.header.Get("From")); err == nil {
+		recipient = address.Address
+	}
+	if reason := loopReason(result.header, recipient, replier.GPG, replier.OwnAddresses); reason != "" {
+		log.Printf("Not replying to rejected mail from '%s': %s\n", recipient, reason)
+		return nil
+	}
+	if replier.Limiter != nil && !replier.Limiter.Allow(strings.ToLower(recipient)) {
+		log.Printf("Not replying to rejected mail from '%s': rate limit exceeded\n", recipient)
+		return nil
+	}
+
+	return &mail.OutgoingMail{
+		Message:        getRejectionMessage(result),
+		Subject:        rejectionSubject,
+		RecipientEmail: recipient,
+		GPG:            replier.GPG,
+		InReplyTo:      result.header.Get("Message-Id"),
+	}
+}
+
+// loopReason returns why replying to the mail with the given header could cause a mail loop, or the empty string if
+// a reply can be sent to recipient. It follows the recommendations of RFC 3834 for automatic responses. The identity
+// of gpgUtil and ownAddresses are the addresses of the server, which never get replies.
+func loopReason(header textproto.MIMEHeader, recipient string, gpgUtil mail.MessageEncrypter,
+	ownAddresses []string) string {
+	if header == nil {
+		return "header cannot be read"
+	}
+	if _, err := netmail.ParseAddress(recipient); err != nil {
+		return "no sender address"
+	}
+	if autoSubmitted := strings.TrimSpace(header.Get("Auto-Submitted")); autoSubmitted != "" &&
+		!strings.EqualFold(autoSubmitted, "no") {
+		return "mail has been submitted automatically"
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "mail has been sent in bulk"
+	}
+	if header.Get("List-Id") != "" || header.Get("List-Unsubscribe") != "" {
+		return "mail has been sent via a mailing list"
+	}
+	if strings.HasPrefix(strings.ToLower(header.Get("Content-Type")), "multipart/report") {
+		return "mail is a delivery report"
+	}
+	localPart := recipient
+	if at := strings.LastIndex(recipient, "@"); at >= 0 {
+		localPart = recipient[:at]
+	}
+	if systemLocalParts[strings.ToLower(localPart)] {
+		return "sender is a system address"
+	}
+	for _, address := range append([]string{gpgUtil.ServerIdentity()}, ownAddresses...) {
+		if parsed, err := netmail.ParseAddress(address); err == nil && strings.EqualFold(parsed.Address, recipient) {
+			return "sender is the server itself"
+		}
+	}
+	return ""
+}
+
+func getRejectionMessage(result *Result) string {
+	message := new(bytes.Buffer)
+	err := rejectionMessage.Execute(message, struct {
+		Requester string
+		Reason    RejectReason
+		UIDs      []UIDResult
+	}{
+		Requester: result.Sender,
+		Reason:    result.Reason,
+		UIDs:      result.UIDs,
+	})
+	if err != nil {
+		log.Panicf("Cannot generate rejection message: %v\n", err)
+		return ""
+	}
+
+	return message.String()
+}
+
+// RateLimiter allows an event per key at most once within an interval. The time of the last event per key is kept in
+// a store, so that the limit holds across restarts and separate invocations of process-mail.
+type RateLimiter struct {
+	interval time.Duration
+
+	mutex sync.Mutex
+	last  storage.ReplyGetSetter
+}
+
+// NewRateLimiter returns a rate limiter allowing an event per key at most once within interval, which records the
+// events in last.
+func NewRateLimiter(interval time.Duration, last storage.ReplyGetSetter) *RateLimiter {
+	return &RateLimiter{interval: interval, last: last}
+}
+
+// Allow returns true and records the event, if there has been no event for key within the interval.
+func (limiter *RateLimiter) Allow(key string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	if last, ok := limiter.last.GetLastReply(key); ok && now.Sub(last) < limiter.interval {
+		return false
+	}
+	limiter.last.SetLastReply(key, now)
+	return true
+}
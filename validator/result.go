@@ -0,0 +1,185 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/mail"
+)
+
+// skipNotCertified is the reason for skipping the user IDs of a revocation request, which have not been certified.
+const skipNotCertified = "not certified"
+
+// RejectReason names why an incoming mail has been rejected.
+type RejectReason string
+
+// The reasons for rejecting incoming mails.
+const (
+	ReasonUnparseable        RejectReason = "unparseable"
+	ReasonUnsigned           RejectReason = "unsigned"
+	ReasonNoKey              RejectReason = "no key"
+	ReasonInvalidSignature   RejectReason = "signature invalid"
+	ReasonWeakHash           RejectReason = "weak hash"
+	ReasonNoAcceptedIdentity RejectReason = "no accepted identity"
+	ReasonNotCertified       RejectReason = "not certified"
+)
+
+// Result describes how an incoming mail has been processed.
+type Result struct {
+	// Parsed is set if the mail could be parsed.
+	Parsed bool `json:"parsed"`
+	// Sender is the From header of the mail.
+	Sender string `json:"sender,omitempty"`
+	// Signer is the fingerprint of the key, which made the valid signature of the mail, or empty if there is none.
+	Signer string `json:"signer,omitempty"`
+	// KeySource tells where the key of the signer has been found.
+	KeySource mail.KeySource `json:"keySource,omitempty"`
+	// Revoke is set if the mail requests the revocation of certifications instead of a certification.
+	Revoke bool `json:"revoke"`
+	// UIDs are the decisions on the user IDs of the signer key, sorted by user ID.
+	UIDs []UIDResult `json:"uids"`
+	// Reason tells why the mail has been rejected, or is empty if it has not been rejected.
+	Reason RejectReason `json:"reason,omitempty"`
+	// Errors are the reasons why the mail or some of its user IDs have been rejected.
+	Errors []string `json:"errors"`
+
+	// Responses are the nonce mails to send in response to the mail.
+	Responses []mail.OutgoingMail `json:"-"`
+	// Acknowledgement is the mail telling the requester which nonce mails have been sent, or nil if the mail has been
+	// rejected.
+	Acknowledgement *mail.OutgoingMail `json:"-"`
+
+	// header is the header of the mail as received, which is available even if the mail cannot be parsed.
+	header textproto.MIMEHeader
+}
+
+// UIDResult is the decision on a single user ID of the signer key.
+type UIDResult struct {
+	UserID string `json:"uid"`
+	Email  string `json:"email"`
+	// NonceSent is set if a nonce mail is sent to the email address of the user ID.
+	NonceSent bool `json:"nonceSent"`
+	// SkipReason tells why no nonce mail is sent for the user ID.
+	SkipReason string `json:"skipReason,omitempty"`
+}
+
+// Rejected returns true if no nonce mail is sent in response to the mail.
+func (result *Result) Rejected() bool {
+	return len(result.Responses) == 0
+}
+
+// reject records the reason of the rejection, logs the formatted error and adds it to the errors of the result.
+func (result *Result) reject(reason RejectReason, format string, args ...interface{}) {
+	result.Reason = reason
+	message := fmt.Sprintf(format, args...)
+	log.Println(message)
+	result.Errors = append(result.Errors, message)
+}
+
+// signatureReason returns why the parsed mail has no valid signature.
+func signatureReason(entity *mail.MimeEntity) RejectReason {
+	err := signatureError(entity)
+	switch {
+	case err == nil:
+		return ReasonUnsigned
+	case errors.Is(err, mail.ErrNoSignerKey) || errors.Is(err, gpg.ErrUnknownSigner):
+		return ReasonNoKey
+	case errors.Is(err, mail.ErrWeakHash):
+		return ReasonWeakHash
+	default:
+		return ReasonInvalidSignature
+	}
+}
+
+// signatureError returns the error of the first signature of the entity, which could not be verified, or nil.
+func signatureError(entity *mail.MimeEntity) error {
+	if entity.Signature != nil && entity.Signature.Err != nil {
+		return entity.Signature.Err
+	}
+	for i := range entity.Parts {
+		if err := signatureError(&entity.Parts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseReason returns why a mail could not be parsed with the given error.
+func parseReason(err error) RejectReason {
+	if errors.Is(err, mail.ErrNoSignerKey) || errors.Is(err, gpg.ErrUnknownSigner) {
+		return ReasonNoKey
+	}
+	return ReasonUnparseable
+}
+
+// pendingEmails returns the sorted email addresses of the user IDs, which have not been skipped, each address once.
+func (result *Result) pendingEmails() []string {
+	var emails []string
+	seen := map[string]bool{}
+	for _, uid := range result.UIDs {
+		if uid.SkipReason == "" && !seen[uid.Email] {
+			seen[uid.Email] = true
+			emails = append(emails, uid.Email)
+		}
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+// nonceSent marks the user IDs with the given email address, which have not been skipped, as sent a nonce.
+func (result *Result) nonceSent(email string) {
+	for i := range result.UIDs {
+		if result.UIDs[i].SkipReason == "" && result.UIDs[i].Email == email {
+			result.UIDs[i].NonceSent = true
+		}
+	}
+}
+
+// certificationDecisions returns the decisions on the user IDs of key for a certification request. User IDs rejected
+// by the key policy are skipped.
+func certificationDecisions(key gpg.Key, report gpg.KeyReport) []UIDResult {
+	return decideUserIDs(key, func(name string) []string {
+		return report.IdentityVerdict(name)
+	})
+}
+
+// revocationDecisions returns the decisions on the user IDs of key for a revocation request. User IDs, which are not
+// among the given certified identities, are skipped.
+func revocationDecisions(key gpg.Key, certifiedIdentities []string) []UIDResult {
+	certified := map[string]bool{}
+	for _, name := range certifiedIdentities {
+		certified[name] = true
+	}
+	return decideUserIDs(key, func(name string) []string {
+		if !certified[name] {
+			return []string{skipNotCertified}
+		}
+		return nil
+	})
+}
+
+// decideUserIDs returns a decision for each user ID of key sorted by user ID. The user IDs, for which problems returns
+// any problem, are skipped.
+func decideUserIDs(key gpg.Key, problems func(name string) []string) []UIDResult {
+	names := make([]string, 0, len(key.Identities))
+	for name := range key.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	decisions := make([]UIDResult, len(names))
+	for i, name := range names {
+		decisions[i] = UIDResult{UserID: name, Email: key.Identities[name].UserId.Email}
+		if reasons := problems(name); len(reasons) > 0 {
+			decisions[i].SkipReason = strings.Join(reasons, ", ")
+			log.Printf("Skipping identity '%s' of key %s: %s\n", name, key.PrimaryKey.KeyIdString(),
+				decisions[i].SkipReason)
+		}
+	}
+	return decisions
+}
@@ -0,0 +1,64 @@
+package validator
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"text/template"
+
+	"github.com/TNG/openpgp-validation-server/gpg"
+	"github.com/TNG/openpgp-validation-server/mail"
+)
+
+var revokedKeyMessage = template.Must(template.ParseFiles("./templates/revokedKeyMail.tmpl"))
+
+// revocationSubject is the subject of mails containing revoked certifications.
+const revocationSubject = "OpenPGP Key Validation Revoked"
+
+// CertificationRevoker revokes certifications and encrypts the mails containing the revoked keys.
+type CertificationRevoker interface {
+	mail.MessageEncrypter
+	RevokeCertification(email string, key gpg.Key, reason gpg.RevocationReason, reasonText string,
+		w io.Writer) ([]string, error)
+}
+
+// RevokeCertification revokes the certifications of the given key for the given email and returns the mail sending
+// the key including the revocations to the affected address.
+func RevokeCertification(email string, key gpg.Key, reason gpg.RevocationReason, reasonText string,
+	gpgUtil CertificationRevoker) (*mail.OutgoingMail, error) {
+	log.Printf("Revoking certification of key %v for '%v'.", key.PrimaryKey.KeyIdString(), email)
+
+	buf := bytes.Buffer{}
+	identities, err := gpgUtil.RevokeCertification(email, key, reason, reasonText, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mail.OutgoingMail{
+		Message:        getRevokedKeyMessage(key.PrimaryKey.KeyIdString(), identities, reasonText),
+		Subject:        revocationSubject,
+		RecipientEmail: email,
+		RecipientKey:   key,
+		Attachment:     buf.Bytes(),
+		GPG:            gpgUtil,
+	}, nil
+}
+
+func getRevokedKeyMessage(fingerprint string, identities []string, reasonText string) string {
+	message := new(bytes.Buffer)
+	err := revokedKeyMessage.Execute(message, struct {
+		Fingerprint string
+		Identities  []string
+		Reason      string
+	}{
+		Fingerprint: fingerprint,
+		Identities:  identities,
+		Reason:      reasonText,
+	})
+	if err != nil {
+		log.Panicf("cannot generate revoked-key message: %v", err)
+		return ""
+	}
+
+	return message.String()
+}